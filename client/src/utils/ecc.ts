@@ -1,14 +1,17 @@
 // ecc.ts
 
-// Parameters for the curve
+// Parameters for the curve, NIST P-521 as on the server
 const p =
-  9391992014528224411648387829887779452968700080555255747361254716652003361688800380330385633056245683444877536960503368327139028742945338465232435742415490790285260907481871880469373580741241260948876883488819453317735629504379161346245998683504143286421351n;
+  6864797660130609714981900799081393217269435300143305409394463459185543183397656052122559640661454554977296311391480858037121987999716643812574028291115057151n;
 const a =
-  9233124640038346995100978392313313511369492123558996708844011838096113732285757053789463384591671694743340670303624555512347783309238918503776319156266971458062018710184003825351802199040926442114671941913985501450211259391979794403797469337351719270652351n;
+  6864797660130609714981900799081393217269435300143305409394463459185543183397656052122559640661454554977296311391480858037121987999716643812574028291115057148n;
 const Gx =
-  2398249831791816336028631263148105895130194480594232706681452236075099255914833333176431307231368483589360217800747308174513483544427244190177932600264268134572314832192520846016006636941990751131120801543171652309984054140576933467418364998622752106966361n;
+  2661740802050217063228768716723360960729859168756973147706671368418802944996427808491545080627771902352094241225065558662157113545570916814161637315895999846n;
 const Gy =
-  2937610345392163240898320965449658011204813209985492263862609624172037174893838813802778590568695212500828225410673923612008661914350991091209447994751752919108072103550418611957669073010110009093661014607538825852066098351822205667186845598987024537485599n;
+  3757180025770020463545507224491183603594455134769762486694567779615544477440556316691234405012945539562144444537289428522585666729196580810124344277578376784n;
+// Order of G, private keys are drawn in [1, n-1]
+const n =
+  6864797660130609714981900799081393217269435300143305409394463459185543183397655394245057746333217197532963996371363321113864768612440380340372808892707005449n;
 
 // Point class
 export class Point {
@@ -142,13 +145,12 @@ export function scalarMultiply(k: bigint, p1: Point): Point {
 }
 
 function generatePrivateKey(): bigint {
-  const hexString = Array(250)
-    .fill(0)
-    .map(() => Math.round(Math.random() * 0xf).toString(16))
-    .join("");
+  // 64 bits more than n so reducing mod n - 1 is close to uniform
+  const bytes = crypto.getRandomValues(new Uint8Array(74));
+  const hexString = Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
 
   const randomInt = BigInt(`0x${hexString}`);
-  return randomInt;
+  return (randomInt % (n - 1n)) + 1n;
 }
 
 export function generatePublicKey(privateKey: bigint): Point {
@@ -127,7 +127,11 @@ func Encrypt(key, plaintext string) (string, error) {
 		return "", err
 	}
 
+	// A fresh nonce per message, sent in front of the ciphertext
 	iv := make([]byte, gbc.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
 
     ctr, err := goblockc.NewCTR(gbc, iv)
 
@@ -139,7 +143,7 @@ func Encrypt(key, plaintext string) (string, error) {
 	copy(ciphertext, []byte(plaintext))
     ctr.XORKeyStream(ciphertext, ciphertext)
 
-	return hex.EncodeToString(ciphertext), nil
+	return hex.EncodeToString(append(iv, ciphertext...)), nil
 }
 
 func Decrypt(key, ciphertext string) (string, error) {
@@ -153,15 +157,17 @@ func Decrypt(key, ciphertext string) (string, error) {
 		return "", err
 	}
 
-	iv := make([]byte, gbc.BlockSize())
-
-    ctr, err := goblockc.NewCTR(gbc, iv)
-
+	c, err := hex.DecodeString(ciphertext)
 	if err != nil {
 		return "", err
 	}
+	if len(c) < gbc.BlockSize() {
+		return "", errors.New("ciphertext shorter than its nonce")
+	}
+	iv, c := c[:gbc.BlockSize()], c[gbc.BlockSize():]
+
+    ctr, err := goblockc.NewCTR(gbc, iv)
 
-	c, err := hex.DecodeString(ciphertext)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+)
+
+// How long readiness checks may take before the node counts as not ready
+const readyTimeout = 2 * time.Second
+
+// A connection on this node, as listed by the admin API
+type ClientInfo struct {
+	Address     string    `json:"address"`
+	User        string    `json:"user"`
+	Room        string    `json:"room"`
+	Away        bool      `json:"away"`
+	ConnectedAt time.Time `json:"connected_at"`
+	QueueDepth  int       `json:"queue_depth"`
+}
+
+// This node's hub, as dumped by the admin API
+type HubStats struct {
+	Node           string         `json:"node"`
+	StartedAt      time.Time      `json:"started_at"`
+	Clients        int            `json:"clients"`
+	Rooms          map[string]int `json:"rooms"`
+	BroadcastQueue int            `json:"broadcast_queue"`
+	ShardQueues    []int          `json:"shard_queues"` // Work waiting for each shard
+	Spilled        int            `json:"spilled"`      // Slow clients whose messages wait in the offline queue
+	Members        int            `json:"members"`      // Users present in any room, on any node
+}
+
+// Result of one readiness check, Error is empty when it passed
+type readyCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET /healthz, answers as long as the process serves HTTP
+func healthEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// GET /readyz, 503 unless Redis answers and the hub loop is running
+func readyEndpoint(hub *Hub, ping func(context.Context) error, w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	check := func(err error) readyCheck {
+		if err != nil {
+			return readyCheck{Status: "failed", Error: err.Error()}
+		}
+		return readyCheck{Status: "ok"}
+	}
+	checks := map[string]readyCheck{
+		"redis": check(ping(ctx)),
+		"hub":   check(hub.ping(ctx)),
+	}
+
+	status := http.StatusOK
+	for name, c := range checks {
+		if c.Error != "" {
+			httpLog.Warn("not ready", "check", name, "err", c.Error)
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, checks)
+}
+
+// Connections on this node, sorted by address
+func (h *Hub) clientInfo(ctx context.Context) ([]ClientInfo, error) {
+	clients := []ClientInfo{}
+	for _, s := range h.shards {
+		err := s.do(ctx, func() {
+			for client := range s.clients {
+				clients = append(clients, ClientInfo{
+					Address:     client.address,
+					User:        client.id,
+					Room:        client.room,
+					Away:        client.away,
+					ConnectedAt: client.connectedAt,
+					QueueDepth:  len(client.send),
+				})
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortFunc(clients, func(x, y ClientInfo) int {
+		if c := strings.Compare(x.Address, y.Address); c != 0 {
+			return c
+		}
+		return x.ConnectedAt.Compare(y.ConnectedAt)
+	})
+	return clients, nil
+}
+
+// Read from the shards' membership snapshots, so it never waits on the hub
+func (h *Hub) stats() HubStats {
+	stats := HubStats{
+		Node:           h.node,
+		StartedAt:      h.startedAt,
+		Rooms:          map[string]int{},
+		BroadcastQueue: len(h.broadcast),
+		Members:        len(h.presence.members("", "")),
+	}
+	for _, s := range h.shards {
+		m := s.members.Load()
+		for room, n := range m.rooms {
+			stats.Rooms[room] += n
+			stats.Clients += n
+		}
+		for _, n := range m.spilled {
+			stats.Spilled += n
+		}
+		stats.ShardQueues = append(stats.ShardQueues, s.inbox.len())
+	}
+	return stats
+}
+
+// Routes under /admin, callers are expected to have been authenticated
+func adminRoutes(hub *Hub) http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/clients", func(w http.ResponseWriter, r *http.Request) {
+		clients, err := hub.clientInfo(r.Context())
+		if err != nil {
+			middlewares.WriteError(w, r, http.StatusServiceUnavailable, "unavailable", "hub unavailable, try again")
+			return
+		}
+		writeJSON(w, http.StatusOK, clients)
+	})
+
+	r.Delete("/clients/{address}", func(w http.ResponseWriter, r *http.Request) {
+		address := chi.URLParam(r, "address")
+		httpLog.Info("admin disconnect", "address", address, "remote", r.RemoteAddr)
+		if err := hub.disconnectAll(r.Context(), address); err != nil {
+			middlewares.WriteError(w, r, http.StatusServiceUnavailable, "unavailable", "hub unavailable, try again")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// The client has to handshake again, whatever it still has open is closed
+	r.Delete("/sessions/{address}", func(w http.ResponseWriter, r *http.Request) {
+		address := chi.URLParam(r, "address")
+		httpLog.Info("admin revoke", "address", address, "remote", r.RemoteAddr)
+		if err := handlers.RevokeSession(address); err != nil {
+			httpLog.Error("revoke failed", "address", address, "err", err)
+			middlewares.WriteError(w, r, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		if err := hub.disconnectAll(r.Context(), address); err != nil {
+			middlewares.WriteError(w, r, http.StatusServiceUnavailable, "unavailable", "hub unavailable, try again")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Get("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, hub.stats())
+	})
+
+	return r
+}
+
+// Authentication for /admin from the config, nil when neither a token nor
+// client certificates are configured and the API should stay off
+func adminAuth(token, clientCA string) []func(http.Handler) http.Handler {
+	var auth []func(http.Handler) http.Handler
+	if clientCA != "" {
+		auth = append(auth, middlewares.RequireClientCert)
+	}
+	if token != "" {
+		auth = append(auth, middlewares.RequireBearerToken(token))
+	}
+	return auth
+}
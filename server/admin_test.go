@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/providers"
+)
+
+const testAdminToken = "0123456789abcdef"
+
+// A running hub with Redis behind providers.Pool and the admin API enabled
+func newAdminHub(t *testing.T) (*Hub, *miniredis.Miniredis, context.CancelFunc) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	providers.Setup(config.Redis{URL: "redis://" + mr.Addr()})
+
+	cfg := config.Default()
+	cfg.Admin.Token = testAdminToken
+	hub := newTestHub(cfg, bus.NewMemory())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := hub.listen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go hub.run(ctx)
+	return hub, mr, cancel
+}
+
+func request(h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHealthAndReady(t *testing.T) {
+	hub, mr, stopHub := newAdminHub(t)
+	routes := setupRoutes(hub, hub.cfg)
+
+	if rec := request(routes, http.MethodGet, "/healthz", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected healthz to answer 200, got %d", rec.Code)
+	}
+	if rec := request(routes, http.MethodGet, "/readyz", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected readyz to answer 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	mr.Close()
+	rec := request(routes, http.MethodGet, "/readyz", "")
+	var checks map[string]readyCheck
+	json.Unmarshal(rec.Body.Bytes(), &checks)
+	if rec.Code != http.StatusServiceUnavailable || checks["redis"].Error == "" || checks["hub"].Error != "" {
+		t.Errorf("Expected only redis to fail, got %d: %s", rec.Code, rec.Body)
+	}
+
+	stopHub()
+	<-hub.done
+	rec = request(routes, http.MethodGet, "/readyz", "")
+	json.Unmarshal(rec.Body.Bytes(), &checks)
+	if rec.Code != http.StatusServiceUnavailable || checks["hub"].Error == "" {
+		t.Errorf("Expected the hub to fail once stopped, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	hub, _, _ := newAdminHub(t)
+
+	routes := setupRoutes(hub, hub.cfg)
+	if rec := request(routes, http.MethodGet, "/admin/stats", ""); rec.Code != http.StatusUnauthorized || errorCode(rec.Result()) != "unauthorized" {
+		t.Errorf("Expected 401 without a token, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := request(routes, http.MethodGet, "/admin/stats", "wrong"+testAdminToken); rec.Code != http.StatusUnauthorized || errorCode(rec.Result()) != "unauthorized" {
+		t.Errorf("Expected 401 with the wrong token, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := request(routes, http.MethodGet, "/admin/stats", testAdminToken); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 with the token, got %d", rec.Code)
+	}
+
+	// Nothing configured, nothing served
+	hub.cfg.Admin.Token = ""
+	routes = setupRoutes(hub, hub.cfg)
+	if rec := request(routes, http.MethodGet, "/admin/stats", testAdminToken); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected the admin API to be off, got %d", rec.Code)
+	}
+}
+
+func TestAdminClientsAndRevoke(t *testing.T) {
+	hub, mr, _ := newAdminHub(t)
+	routes := setupRoutes(hub, hub.cfg)
+
+	alice := dial(t, newTestServer(t, hub), "id=alice&room=lobby")
+	hub.sendTo("test:alice", []byte("registered"))
+	expectMessage(t, alice, "registered")
+
+	rec := request(routes, http.MethodGet, "/admin/clients", testAdminToken)
+	var clients []ClientInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0].Address != "test:alice" || clients[0].User != "alice" || clients[0].Room != "lobby" || clients[0].ConnectedAt.IsZero() {
+		t.Fatalf("Unexpected clients %+v", clients)
+	}
+
+	rec = request(routes, http.MethodGet, "/admin/stats", testAdminToken)
+	var stats HubStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Node != hub.node || stats.Clients != 1 || stats.Rooms["lobby"] != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	mr.Set("test:alice", testSharedKey)
+	mr.Set("test:alice:verify", "")
+	if rec := request(routes, http.MethodDelete, "/admin/sessions/test:alice", testAdminToken); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", rec.Code, rec.Body)
+	}
+	if mr.Exists("test:alice") || mr.Exists("test:alice:verify") {
+		t.Error("Session keys were not deleted")
+	}
+
+	for {
+		alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := alice.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+			t.Fatalf("Expected a policy violation close frame, got %v", err)
+		}
+		break
+	}
+}
+
+func TestAdminErrors(t *testing.T) {
+	hub, mr, stopHub := newAdminHub(t)
+	routes := setupRoutes(hub, hub.cfg)
+
+	mr.Close()
+	rec := request(routes, http.MethodDelete, "/admin/sessions/test:alice", testAdminToken)
+	if rec.Code != http.StatusInternalServerError || errorCode(rec.Result()) != "internal" {
+		t.Errorf("Expected the revoke to fail without Redis, got %d: %s", rec.Code, rec.Body)
+	}
+
+	stopHub()
+	<-hub.done
+	rec = request(routes, http.MethodGet, "/admin/clients", testAdminToken)
+	if rec.Code != http.StatusServiceUnavailable || errorCode(rec.Result()) != "unavailable" {
+		t.Errorf("Expected the clients to be unavailable once stopped, got %d: %s", rec.Code, rec.Body)
+	}
+}
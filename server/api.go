@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+	"github.com/FelineJTD/secure-chat-kripto/server/history"
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+	"github.com/FelineJTD/secure-chat-kripto/server/rooms"
+)
+
+const (
+	// Messages in a history page unless the caller asks for another number
+	defaultPageSize = 50
+
+	// Most messages a history page holds
+	maxPageSize = 200
+)
+
+type CreateRoomRequest struct {
+	Name    string `json:"name"`
+	Private bool   `json:"private,omitempty"` // Only members may join it and read its history
+}
+
+// Rooms the caller may join
+type RoomList struct {
+	Rooms []rooms.Room `json:"rooms"`
+}
+
+// A message from a room's history. The envelope is the frame as relayed, its
+// content end-to-end encrypted by the sender, and gone once deleted.
+type HistoryMessage struct {
+	ID        string              `json:"id"`
+	Sender    string              `json:"sender"`
+	Envelope  json.RawMessage     `json:"envelope,omitempty"`
+	SentAt    time.Time           `json:"sent_at"`
+	EditedAt  *time.Time          `json:"edited_at,omitempty"`
+	ExpiresAt *time.Time          `json:"expires_at,omitempty"`
+	Deleted   bool                `json:"deleted,omitempty"`
+	Reactions map[string][]string `json:"reactions,omitempty"` // Users by emoji
+}
+
+type HistoryPage struct {
+	Messages []HistoryMessage `json:"messages"`       // Newest first
+	Next     string           `json:"next,omitempty"` // Passed as before, fetches the page after this one
+}
+
+type UserKeys struct {
+	User      string `json:"user"`
+	VerifyKey string `json:"verify_key"` // Schnorr key the user signs messages with
+}
+
+// An error the API reports to its caller as it is, anything else is logged
+// and reported as unavailable
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+// The same error along with what caused it, the cause is logged but never shown
+func (e *apiError) because(cause error) error {
+	return &causedError{apiError: e, cause: cause}
+}
+
+type causedError struct {
+	*apiError
+	cause error
+}
+
+func (e *causedError) Error() string { return e.message + ": " + e.cause.Error() }
+
+func (e *causedError) Unwrap() []error { return []error{e.apiError, e.cause} }
+
+var (
+	errBadJSON         = &apiError{http.StatusBadRequest, "bad_request", "body must be a JSON object"}
+	errInvalidRoomName = &apiError{http.StatusBadRequest, "invalid_room_name", "room names are 1 to 64 letters, digits, '-', '_' or '.'"}
+	errBadCursor       = &apiError{http.StatusBadRequest, "bad_cursor", "before must be a message id"}
+	errBadPageSize     = &apiError{http.StatusBadRequest, "bad_limit", "limit must be between 1 and " + strconv.Itoa(maxPageSize)}
+	errNotRoomOwner    = &apiError{http.StatusForbidden, "not_owner", "only the owner may invite and remove others"}
+	errUnauthenticated = &apiError{http.StatusUnauthorized, "unauthenticated", "sign the handshake with a verification key to use the API"}
+	errRoomNotFound    = &apiError{http.StatusNotFound, "room_not_found", "no such room"}
+	errNoKeys          = &apiError{http.StatusNotFound, "no_keys", "user has not registered a verification key"}
+	errRoomExists      = &apiError{http.StatusConflict, "room_exists", "room already exists"}
+	errOwnerStays      = &apiError{http.StatusConflict, "owner_stays", "the owner cannot be removed"}
+	errAPIUnavailable  = &apiError{http.StatusServiceUnavailable, "unavailable", "service unavailable, try again"}
+)
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		httpLog.Error("api request failed", "method", r.Method, "path", r.URL.Path, "request_id", middleware.GetReqID(r.Context()), "err", err)
+		e = errAPIUnavailable
+	}
+	middlewares.WriteError(w, r, e.status, e.code, e.message)
+}
+
+// A route of the API with what the spec says about it. Bodies are described
+// by the Go values given for them, nil when there is none.
+type endpoint struct {
+	method, path string
+	id, summary  string
+	query        []queryParam
+	request      any
+	response     any
+	status       int
+	errors       []*apiError
+	handler      http.HandlerFunc
+}
+
+type queryParam struct {
+	name, description string
+}
+
+// Routes under /api/v1, the spec is served in the clear and everything else
+// through encrypted, which also tells who is calling
+func apiRoutes(hub *Hub, encrypted func(http.Handler) http.Handler) http.Handler {
+	endpoints := apiEndpoints(hub)
+	spec, _ := json.Marshal(openAPISpec(endpoints))
+
+	r := chi.NewRouter()
+	r.Get("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(encrypted, signedIn)
+		for _, e := range endpoints {
+			r.Method(e.method, e.path, e.handler)
+		}
+	})
+	return r
+}
+
+func apiEndpoints(hub *Hub) []endpoint {
+	return []endpoint{
+		{
+			method: http.MethodGet, path: "/rooms", id: "listRooms",
+			summary:  "List the rooms the caller may join",
+			response: RoomList{}, status: http.StatusOK,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				listRooms(hub, w, r)
+			},
+		},
+		{
+			method: http.MethodPost, path: "/rooms", id: "createRoom",
+			summary: "Create a room owned by the caller, unless it is the default room or already in use",
+			request: CreateRoomRequest{}, response: rooms.Room{}, status: http.StatusCreated,
+			errors: []*apiError{errBadJSON, errInvalidRoomName, errRoomExists},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				createRoom(hub, w, r)
+			},
+		},
+		{
+			method: http.MethodGet, path: "/rooms/{room}", id: "getRoom",
+			summary:  "Get a room and its members",
+			response: rooms.Room{}, status: http.StatusOK,
+			errors: []*apiError{errRoomNotFound},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				getRoom(hub, w, r)
+			},
+		},
+		{
+			method: http.MethodPut, path: "/rooms/{room}/members/{user}", id: "inviteMember",
+			summary:  "Add a member to a room, only its owner may",
+			response: rooms.Room{}, status: http.StatusOK,
+			errors: []*apiError{errRoomNotFound, errNotRoomOwner},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				inviteMember(hub, w, r)
+			},
+		},
+		{
+			method: http.MethodDelete, path: "/rooms/{room}/members/{user}", id: "removeMember",
+			summary: "Remove a member from a room, its owner may remove anyone and members themselves. Removed members are disconnected from private rooms.",
+			status:  http.StatusNoContent,
+			errors:  []*apiError{errRoomNotFound, errNotRoomOwner, errOwnerStays},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				removeMember(hub, w, r)
+			},
+		},
+		{
+			method: http.MethodGet, path: "/rooms/{room}/messages", id: "roomHistory",
+			summary: "Page through a room's history, newest first",
+			query: []queryParam{
+				{"before", "Only messages older than this id, as given by next"},
+				{"limit", "Messages in the page, " + strconv.Itoa(defaultPageSize) + " unless given, at most " + strconv.Itoa(maxPageSize)},
+			},
+			response: HistoryPage{}, status: http.StatusOK,
+			errors: []*apiError{errRoomNotFound, errBadCursor, errBadPageSize},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				roomHistory(hub, w, r)
+			},
+		},
+		{
+			method: http.MethodGet, path: "/users/{user}/keys", id: "userKeys",
+			summary:  "Get the key a user's signatures verify with",
+			response: UserKeys{}, status: http.StatusOK,
+			errors:  []*apiError{errNoKeys},
+			handler: userKeys,
+		},
+	}
+}
+
+// User whose key signed the session's handshake, empty for sessions that
+// only claimed a name
+func caller(r *http.Request) string {
+	_, user := middlewares.Session(r.Context())
+	return user
+}
+
+// Refuse sessions that never proved who they are, everything in the API
+// depends on the caller
+func signedIn(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if caller(r) == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errBadJSON
+	}
+	return nil
+}
+
+// GET /api/v1/rooms
+func listRooms(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	all, err := hub.rooms.List(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	list := RoomList{Rooms: []rooms.Room{}}
+	for _, room := range all {
+		if room.Open(caller(r)) {
+			list.Rooms = append(list.Rooms, room)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// POST /api/v1/rooms
+func createRoom(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	var req CreateRoomRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !rooms.ValidName(req.Name) {
+		writeError(w, r, errInvalidRoomName)
+		return
+	}
+	// Everyone is put in the default room, nobody gets to own it
+	if req.Name == defaultRoom {
+		writeError(w, r, errRoomExists)
+		return
+	}
+	// Nor a room people were already using before anyone made it
+	inUse, err := hub.inUse(r.Context(), req.Name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if inUse {
+		writeError(w, r, errRoomExists)
+		return
+	}
+
+	room, err := hub.rooms.Create(r.Context(), rooms.Room{Name: req.Name, Owner: caller(r), Private: req.Private, CreatedAt: time.Now()})
+	if errors.Is(err, rooms.ErrExists) {
+		err = errRoomExists
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	httpLog.Info("room created", "room", room.Name, "owner", room.Owner, "private", room.Private)
+	writeJSON(w, http.StatusCreated, room)
+}
+
+// The room of the request, private rooms are not found by those outside them
+func roomOf(hub *Hub, r *http.Request) (rooms.Room, error) {
+	room, err := hub.rooms.Get(r.Context(), chi.URLParam(r, "room"))
+	if errors.Is(err, rooms.ErrNotFound) || err == nil && !room.Open(caller(r)) {
+		return rooms.Room{}, errRoomNotFound
+	}
+	return room, err
+}
+
+// GET /api/v1/rooms/{room}
+func getRoom(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	room, err := roomOf(hub, r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, room)
+}
+
+// PUT /api/v1/rooms/{room}/members/{user}
+func inviteMember(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	room, err := roomOf(hub, r)
+	if err == nil && room.Owner != caller(r) {
+		err = errNotRoomOwner
+	}
+	if err == nil {
+		room, err = hub.rooms.AddMember(r.Context(), room.Name, chi.URLParam(r, "user"))
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	httpLog.Info("member invited", "room", room.Name, "user", chi.URLParam(r, "user"))
+	writeJSON(w, http.StatusOK, room)
+}
+
+// DELETE /api/v1/rooms/{room}/members/{user}
+func removeMember(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	room, err := roomOf(hub, r)
+	switch {
+	case err != nil:
+	case user == room.Owner:
+		err = errOwnerStays
+	case caller(r) != room.Owner && caller(r) != user:
+		err = errNotRoomOwner
+	default:
+		_, err = hub.rooms.RemoveMember(r.Context(), room.Name, user)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	httpLog.Info("member removed", "room", room.Name, "user", user)
+	if room.Private {
+		hub.evictAll(r.Context(), room.Name, user)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/rooms/{room}/messages
+func roomHistory(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	room := chi.URLParam(r, "room")
+	// Nothing was ever written under a name serveWs refuses
+	if !rooms.ValidName(room) {
+		writeError(w, r, errRoomNotFound)
+		return
+	}
+	ok, err := hub.mayEnter(r.Context(), room, caller(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !ok {
+		writeError(w, r, errRoomNotFound)
+		return
+	}
+
+	limit := defaultPageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxPageSize {
+			writeError(w, r, errBadPageSize)
+			return
+		}
+	}
+
+	messages, next, err := hub.history.Page(r.Context(), room, r.URL.Query().Get("before"), limit)
+	if errors.Is(err, history.ErrBadCursor) {
+		err = errBadCursor
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	page := HistoryPage{Messages: make([]HistoryMessage, 0, len(messages)), Next: next}
+	for _, m := range messages {
+		page.Messages = append(page.Messages, historyMessage(m))
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// As the API shows it, without the author, which for an unsigned sender is
+// their session address
+func historyMessage(m history.Message) HistoryMessage {
+	hm := HistoryMessage{
+		ID:        m.ID,
+		Sender:    m.Sender,
+		Envelope:  m.Envelope,
+		SentAt:    m.SentAt,
+		Deleted:   m.Deleted,
+		Reactions: m.Reactions,
+	}
+	if !m.EditedAt.IsZero() {
+		hm.EditedAt = &m.EditedAt
+	}
+	if !m.ExpiresAt.IsZero() {
+		hm.ExpiresAt = &m.ExpiresAt
+	}
+	return hm
+}
+
+// GET /api/v1/users/{user}/keys
+func userKeys(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	key, err := handlers.GetUserVerifyKey(user)
+	if err == nil && key == "" {
+		err = errNoKeys
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, UserKeys{User: user, VerifyKey: key})
+}
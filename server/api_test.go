@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/history"
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+	"github.com/FelineJTD/secure-chat-kripto/server/rooms"
+)
+
+// Calls the API as a user whose session key is testSharedKey, encrypting and
+// tagging the way clients do
+type apiClient struct {
+	t       *testing.T
+	routes  http.Handler
+	session string
+}
+
+// Store a session for user under testSharedKey as a signed handshake would, returning its id
+func login(mr *miniredis.Miniredis, user string) string {
+	id := guest(mr, user)
+	mr.Set(middlewares.SessionAddress(id)+":verify", "04abcd")
+	return id
+}
+
+// Store a session that only claimed the name user, returning its id
+func guest(mr *miniredis.Miniredis, user string) string {
+	id := hex.EncodeToString([]byte(user))
+	id += strings.Repeat("0", 32-len(id))
+	mr.Set(middlewares.SessionAddress(id), testSharedKey)
+	mr.Set(middlewares.SessionAddress(id)+":user", user)
+	return id
+}
+
+func (c apiClient) do(method, path string, body any, out any) int {
+	c.t.Helper()
+	var plaintext []byte
+	if body != nil {
+		plaintext, _ = json.Marshal(body)
+	}
+	status, data := c.send(method, "/api/v1"+path, plaintext)
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			c.t.Fatalf("%s %s: %v in %s", method, path, err, data)
+		}
+	}
+	return status
+}
+
+// Send plaintext to uri as is, returning the status and decrypted response
+func (c apiClient) send(method, uri string, plaintext []byte) (int, []byte) {
+	c.t.Helper()
+	ciphertext, _ := testCipher.Encrypt(plaintext)
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	sent := strconv.FormatInt(time.Now().Unix(), 10)
+	stamp := sent + " " + hex.EncodeToString(nonce)
+
+	req := httptest.NewRequest(method, uri, strings.NewReader(ciphertext))
+	req.Header.Set(middlewares.SessionHeader, c.session)
+	req.Header.Set(middlewares.NonceHeader, hex.EncodeToString(nonce))
+	req.Header.Set(middlewares.TimeHeader, sent)
+	req.Header.Set(middlewares.BodyMACHeader, testCipher.Sign([]byte(method+" "+uri+"\n"+stamp+"\n"+ciphertext)))
+	rec := httptest.NewRecorder()
+	c.routes.ServeHTTP(rec, req)
+
+	tagged := strconv.Itoa(rec.Code) + " " + method + " " + uri + "\n" + stamp + "\n" + rec.Body.String()
+	if !testCipher.Verify([]byte(tagged), rec.Header().Get(middlewares.BodyMACHeader)) {
+		c.t.Fatalf("%s %s: response tag does not verify, got %d %s", method, uri, rec.Code, rec.Body)
+	}
+	data, err := testCipher.Decrypt(rec.Body.String())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return rec.Code, data
+}
+
+// Expect an error status with its code in the JSON body
+func (c apiClient) fails(method, path string, body any, status int, code string) {
+	c.t.Helper()
+	var e middlewares.ErrorBody
+	if got := c.do(method, path, body, &e); got != status || e.Code != code || e.Message == "" {
+		c.t.Errorf("%s %s: expected %d %s, got %d %+v", method, path, status, code, got, e)
+	}
+}
+
+func TestAPIRooms(t *testing.T) {
+	hub, mr, _ := newAdminHub(t)
+	routes := setupRoutes(hub, hub.cfg)
+	alice := apiClient{t, routes, login(mr, "alice")}
+	bob := apiClient{t, routes, login(mr, "bob")}
+
+	var room rooms.Room
+	if code := alice.do("POST", "/rooms", CreateRoomRequest{Name: "ops", Private: true}, &room); code != http.StatusCreated || room.Owner != "alice" || !room.Private {
+		t.Fatalf("Room not created: %d %+v", code, room)
+	}
+	bob.fails("POST", "/rooms", CreateRoomRequest{Name: "ops"}, http.StatusConflict, "room_exists")
+	bob.fails("POST", "/rooms", CreateRoomRequest{Name: defaultRoom}, http.StatusConflict, "room_exists")
+	bob.fails("POST", "/rooms", CreateRoomRequest{Name: "no spaces"}, http.StatusBadRequest, "invalid_room_name")
+	bob.fails("POST", "/rooms", "ops", http.StatusBadRequest, "bad_request")
+	bob.do("POST", "/rooms", CreateRoomRequest{Name: "lobby"}, nil)
+
+	// A private room is hidden from those outside it
+	var list RoomList
+	bob.do("GET", "/rooms", nil, &list)
+	if len(list.Rooms) != 1 || list.Rooms[0].Name != "lobby" {
+		t.Errorf("Expected bob to only see the lobby, got %+v", list)
+	}
+	bob.fails("GET", "/rooms/ops", nil, http.StatusNotFound, "room_not_found")
+	bob.fails("GET", "/rooms/ops/messages", nil, http.StatusNotFound, "room_not_found")
+	alice.do("GET", "/rooms", nil, &list)
+	if len(list.Rooms) != 2 {
+		t.Errorf("Expected alice to see both rooms, got %+v", list)
+	}
+
+	if code := alice.do("PUT", "/rooms/ops/members/bob", nil, &room); code != http.StatusOK || !room.Member("bob") {
+		t.Errorf("Bob not invited: %d %+v", code, room)
+	}
+	bob.fails("PUT", "/rooms/ops/members/carol", nil, http.StatusForbidden, "not_owner")
+	bob.fails("DELETE", "/rooms/ops/members/alice", nil, http.StatusConflict, "owner_stays")
+
+	// History pages, newest first
+	for i := 0; i < 3; i++ {
+		hub.history.Append(context.Background(), history.Message{Room: "ops", Author: "alice", Sender: "alice", Envelope: json.RawMessage(`{"message":"hi"}`), SentAt: time.Now()})
+	}
+	var page HistoryPage
+	bob.do("GET", "/rooms/ops/messages?limit=2", nil, &page)
+	if len(page.Messages) != 2 || page.Messages[0].ID != "3" || page.Messages[0].Sender != "alice" || page.Next != "2" {
+		t.Fatalf("Unexpected first page %+v", page)
+	}
+	before := page.Next
+	page = HistoryPage{}
+	bob.do("GET", "/rooms/ops/messages?limit=2&before="+before, nil, &page)
+	if len(page.Messages) != 1 || page.Messages[0].ID != "1" || page.Next != "" {
+		t.Errorf("Unexpected last page %+v", page)
+	}
+	bob.fails("GET", "/rooms/ops/messages?limit=1000", nil, http.StatusBadRequest, "bad_limit")
+	bob.fails("GET", "/rooms/ops/messages?before=latest", nil, http.StatusBadRequest, "bad_cursor")
+	bob.fails("GET", "/rooms/ops:seq/messages", nil, http.StatusNotFound, "room_not_found")
+
+	// Removed from a private room, bob is disconnected from it
+	conn := dial(t, newTestServer(t, hub), "id=bob&room=ops")
+	hub.sendTo("test:bob", []byte("registered"))
+	expectMessage(t, conn, "registered")
+	if code := alice.do("DELETE", "/rooms/ops/members/bob", nil, nil); code != http.StatusNoContent {
+		t.Fatalf("Bob not removed: %d", code)
+	}
+	expectClosed(t, conn, websocket.ClosePolicyViolation)
+	bob.fails("GET", "/rooms/ops", nil, http.StatusNotFound, "room_not_found")
+	if ok, _ := hub.mayEnter(context.Background(), "ops", "bob"); ok {
+		t.Error("Bob may still join the room")
+	}
+}
+
+func TestAPICreateRoomInUse(t *testing.T) {
+	hub, mr, _ := newAdminHub(t)
+	routes := setupRoutes(hub, hub.cfg)
+	alice := apiClient{t, routes, login(mr, "alice")}
+
+	// Rooms people already talk in cannot be taken over by making them
+	hub.history.Append(context.Background(), history.Message{Room: "archive", Author: "bob", Sender: "bob", Envelope: json.RawMessage(`{"message":"hi"}`), SentAt: time.Now()})
+	alice.fails("POST", "/rooms", CreateRoomRequest{Name: "archive", Private: true}, http.StatusConflict, "room_exists")
+
+	conn := dial(t, newTestServer(t, hub), "id=bob&room=hangout")
+	hub.sendTo("test:bob", []byte("registered"))
+	expectMessage(t, conn, "registered")
+	alice.fails("POST", "/rooms", CreateRoomRequest{Name: "hangout", Private: true}, http.StatusConflict, "room_exists")
+
+	if code := alice.do("POST", "/rooms", CreateRoomRequest{Name: "quiet", Private: true}, nil); code != http.StatusCreated {
+		t.Errorf("Expected an unused room to be created, got %d", code)
+	}
+	if ok, _ := hub.mayEnter(context.Background(), "hangout", "bob"); !ok {
+		t.Error("Bob was locked out of hangout")
+	}
+}
+
+func TestAPIUserKeys(t *testing.T) {
+	hub, mr, _ := newAdminHub(t)
+	mr.Set("verify:bob", "04abcd")
+	alice := apiClient{t, setupRoutes(hub, hub.cfg), login(mr, "alice")}
+
+	var keys UserKeys
+	if code := alice.do("GET", "/users/bob/keys", nil, &keys); code != http.StatusOK || keys.User != "bob" || keys.VerifyKey != "04abcd" {
+		t.Errorf("Unexpected keys %d %+v", code, keys)
+	}
+	alice.fails("GET", "/users/carol/keys", nil, http.StatusNotFound, "no_keys")
+
+	// A name alone is no identity
+	carol := apiClient{t, setupRoutes(hub, hub.cfg), guest(mr, "carol")}
+	carol.fails("GET", "/users/bob/keys", nil, http.StatusUnauthorized, "unauthenticated")
+
+	// Without a session nothing is answered, in the clear since it could not be read otherwise
+	rec := request(setupRoutes(hub, hub.cfg), http.MethodGet, "/api/v1/users/bob/keys", "")
+	var e middlewares.ErrorBody
+	if json.Unmarshal(rec.Body.Bytes(), &e); rec.Code != http.StatusUnauthorized || e.Code != "no_session" {
+		t.Errorf("Expected a session to be required, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// Every route served is in the spec, with the schemas it refers to
+func TestOpenAPISpec(t *testing.T) {
+	hub, _, _ := newAdminHub(t)
+	rec := request(setupRoutes(hub, hub.cfg), http.MethodGet, "/api/v1/openapi.json", "")
+	var spec struct {
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any
+			}
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Spec not served: %d %v", rec.Code, err)
+	}
+
+	routes := apiRoutes(hub, func(h http.Handler) http.Handler { return h }).(chi.Routes)
+	chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if route == "/openapi.json" {
+			return nil
+		}
+		if _, ok := spec.Paths[route][strings.ToLower(method)]; !ok {
+			t.Errorf("%s %s is missing from the spec", method, route)
+		}
+		return nil
+	})
+
+	for _, name := range []string{"Room", "RoomList", "CreateRoomRequest", "HistoryPage", "HistoryMessage", "UserKeys", "ErrorBody"} {
+		if len(spec.Components.Schemas[name].Properties) == 0 {
+			t.Errorf("Schema %s is missing", name)
+		}
+	}
+	if _, ok := spec.Components.Schemas["HistoryMessage"].Properties["sent_at"]; !ok {
+		t.Error("Schema fields are not named as in JSON")
+	}
+}
+
+func expectClosed(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != code {
+			t.Fatalf("Expected close code %d, got %v", code, err)
+		}
+		return
+	}
+}
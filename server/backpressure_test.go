@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/offline"
+)
+
+// A client without a connection, whose send buffer only the test reads
+func newSlowClient(hub *Hub, address string, buffer int) *Client {
+	return &Client{hub: hub, send: make(chan outbound, buffer), address: address, id: address, room: defaultRoom}
+}
+
+// Run a hub with one shard and no bus subscription, so no presence frames
+// reach the clients. Calls on the shard go through do.
+func runShard(t *testing.T, cfg *config.Config) (*Hub, *shard) {
+	t.Helper()
+	cfg.Hub.Shards = 1
+	hub := newTestHub(cfg, bus.NewMemory())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go hub.run(ctx)
+	return hub, hub.shards[0]
+}
+
+func deliver(s *shard, client *Client, messages ...string) {
+	s.do(context.Background(), func() {
+		for _, m := range messages {
+			s.deliver(client, outbound{data: []byte(m)})
+		}
+	})
+}
+
+func registered(s *shard, client *Client) bool {
+	var ok bool
+	s.do(context.Background(), func() { _, ok = s.clients[client] })
+	return ok
+}
+
+// Everything in the client's buffer, leaving out presence frames
+func queued(client *Client) []string {
+	var messages []string
+	for {
+		select {
+		case m, ok := <-client.send:
+			if !ok {
+				return messages
+			}
+			var env Envelope
+			if json.Unmarshal(m.data, &env) == nil && env.Type == envelopePresence {
+				continue
+			}
+			messages = append(messages, string(m.data))
+		default:
+			return messages
+		}
+	}
+}
+
+func TestBackpressureDropOldest(t *testing.T) {
+	cfg := config.Default()
+	cfg.Backpressure.Policy = config.PolicyDropOldest
+	hub, s := runShard(t, cfg)
+	client := newSlowClient(hub, "alice", 3)
+	hub.join(client)
+
+	deliver(s, client, "1", "2", "3", "4", "5")
+	if got := queued(client); len(got) != 3 || got[0] != "3" || got[2] != "5" {
+		t.Fatalf("Expected the newest three, got %q", got)
+	}
+
+	// Told what it missed once it has caught up
+	deliver(s, client, "6")
+	got := queued(client)
+	if len(got) != 2 || got[1] != "6" {
+		t.Fatalf("Expected a gap notice then 6, got %q", got)
+	}
+	var env Envelope
+	if err := json.Unmarshal([]byte(got[0]), &env); err != nil || env.Type != envelopeGap || env.Missed != 2 {
+		t.Errorf("Expected a gap notice for 2 messages, got %q", got[0])
+	}
+	if !registered(s, client) {
+		t.Error("Client was disconnected")
+	}
+}
+
+func TestBackpressureDisconnectAfterGrace(t *testing.T) {
+	cfg := config.Default()
+	cfg.Backpressure.Grace = time.Hour
+	hub, s := runShard(t, cfg)
+	client := newSlowClient(hub, "alice", 1)
+	hub.join(client)
+
+	deliver(s, client, "1", "2")
+	if !registered(s, client) || client.dropped != 1 {
+		t.Fatalf("Expected the client to be kept within the grace period, %d dropped", client.dropped)
+	}
+
+	s.do(context.Background(), func() { client.fullSince = time.Now().Add(-2 * time.Hour) })
+	deliver(s, client, "3")
+	if registered(s, client) {
+		t.Fatal("Expected the client to be disconnected after the grace period")
+	}
+	if got := queued(client); len(got) != 1 || got[0] != "1" {
+		t.Errorf("Expected only the first message, got %q", got)
+	}
+	if code := int(client.closeMessage[0])<<8 | int(client.closeMessage[1]); code != websocket.CloseTryAgainLater {
+		t.Errorf("Expected a try again later close, got %d", code)
+	}
+}
+
+// Signals every push, so tests know when spilled messages have landed
+type notifyingQueue struct {
+	offline.Queue
+	pushed chan struct{}
+}
+
+func (q *notifyingQueue) Push(ctx context.Context, address string, data []byte) error {
+	err := q.Queue.Push(ctx, address, data)
+	q.pushed <- struct{}{}
+	return err
+}
+
+func TestBackpressureSpill(t *testing.T) {
+	cfg := config.Default()
+	cfg.Backpressure.Policy = config.PolicySpill
+	q := &notifyingQueue{Queue: offline.NewMemory(10, time.Hour), pushed: make(chan struct{}, 10)}
+	hub := newHub(cfg, bus.NewMemory(), q)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := hub.listen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go hub.run(ctx)
+
+	slow := newSlowClient(hub, "alice", 2)
+	hub.join(slow)
+
+	// The join comes back over the bus, have it out of the way first
+	select {
+	case <-slow.send:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Join never arrived")
+	}
+
+	for _, m := range []string{"1", "2", "3", "4"} {
+		hub.broadcast <- roomMessage{room: defaultRoom, data: []byte(m)}
+	}
+
+	// 3 overflowed and 4 was sent while alice was away
+	for i := 0; i < 2; i++ {
+		select {
+		case <-q.pushed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Messages were not spilled")
+		}
+	}
+	if got := queued(slow); len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Errorf("Expected the messages before the disconnect, got %q", got)
+	}
+
+	back := newSlowClient(hub, "alice", 10)
+	hub.join(back)
+	deadline := time.Now().Add(5 * time.Second)
+	var got []string
+	for len(got) < 2 && time.Now().Before(deadline) {
+		got = append(got, queued(back)...)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(got) != 2 || got[0] != "3" || got[1] != "4" {
+		t.Errorf("Expected the spilled messages on reconnect, got %q", got)
+	}
+
+	if spilled := hub.stats().Spilled; spilled != 0 {
+		t.Errorf("Still spilling for %d clients after the client came back", spilled)
+	}
+}
@@ -0,0 +1,82 @@
+// Package blob keeps the chunks of uploaded files. Senders encrypt files under
+// a key the server never sees, chunks are stored exactly as uploaded.
+package blob
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("blob: no such upload")
+	ErrNoChunk     = errors.New("blob: no such chunk")
+	ErrExists      = errors.New("blob: chunk already uploaded")
+	ErrInvalidID   = errors.New("blob: invalid id")
+	ErrBadManifest = errors.New("blob: manifest needs an id and at least one chunk")
+)
+
+// An upload, fixed when it is created
+type Manifest struct {
+	ID        string    `json:"id"`
+	Chunks    int       `json:"chunks"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Store interface {
+	// Start an upload, none of its chunks stored yet
+	Create(ctx context.Context, m Manifest) error
+
+	// The upload and which of its chunks are stored, by index
+	Stat(ctx context.Context, id string) (Manifest, []bool, error)
+
+	// Store chunk n, each chunk is written once so what recipients fetch cannot change
+	Put(ctx context.Context, id string, n int, data []byte) error
+
+	Get(ctx context.Context, id string, n int) ([]byte, error)
+
+	// Remove uploads created before t, returning how many went
+	Expire(ctx context.Context, before time.Time) (int, error)
+}
+
+// Random and unguessable, the id is all it takes to fetch an upload
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Ids are also file names for the disk store, nothing but lowercase hex passes
+func ValidID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func check(m Manifest) error {
+	if !ValidID(m.ID) {
+		return ErrInvalidID
+	}
+	if m.Chunks < 1 {
+		return ErrBadManifest
+	}
+	return nil
+}
+
+// Whether every chunk is stored
+func Complete(stored []bool) bool {
+	for _, ok := range stored {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	m := Manifest{ID: NewID(), Chunks: 3, CreatedAt: time.Now()}
+	if err := s.Create(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(ctx, m.ID, 1, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, m.ID, 1, []byte("replaced")); !errors.Is(err, ErrExists) {
+		t.Errorf("Expected a chunk to be written once, got %v", err)
+	}
+	if err := s.Put(ctx, m.ID, 3, []byte("extra")); !errors.Is(err, ErrNoChunk) {
+		t.Errorf("Expected a chunk past the manifest to be refused, got %v", err)
+	}
+
+	// A resumed upload only sends what is missing
+	got, stored, err := s.Stat(ctx, m.ID)
+	if err != nil || got.Chunks != 3 || stored[0] || !stored[1] || stored[2] || Complete(stored) {
+		t.Fatalf("Unexpected stat %+v %v %v", got, stored, err)
+	}
+	s.Put(ctx, m.ID, 0, []byte("first"))
+	s.Put(ctx, m.ID, 2, []byte{})
+	if _, stored, _ := s.Stat(ctx, m.ID); !Complete(stored) {
+		t.Errorf("Expected the upload to be complete, got %v", stored)
+	}
+
+	if data, err := s.Get(ctx, m.ID, 1); err != nil || string(data) != "second" {
+		t.Errorf("Expected the second chunk, got %q %v", data, err)
+	}
+	if data, err := s.Get(ctx, m.ID, 2); err != nil || len(data) != 0 {
+		t.Errorf("Expected the empty chunk, got %q %v", data, err)
+	}
+	if _, _, err := s.Stat(ctx, NewID()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an unknown upload to be missing, got %v", err)
+	}
+	if err := s.Create(ctx, Manifest{ID: "../escape", Chunks: 1}); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Expected a path in the id to be refused, got %v", err)
+	}
+
+	old := Manifest{ID: NewID(), Chunks: 1, CreatedAt: time.Now().Add(-2 * time.Hour)}
+	s.Create(ctx, old)
+	if n, err := s.Expire(ctx, time.Now().Add(-time.Hour)); err != nil || n != 1 {
+		t.Errorf("Expected one upload to expire, got %d %v", n, err)
+	}
+	if _, _, err := s.Stat(ctx, old.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the expired upload to be gone, got %v", err)
+	}
+	if _, _, err := s.Stat(ctx, m.ID); err != nil {
+		t.Errorf("Expected the recent upload to be kept, got %v", err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestDisk(t *testing.T) {
+	d, err := NewDisk(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, d)
+}
@@ -0,0 +1,151 @@
+package blob
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const manifestFile = "manifest.json"
+
+// Uploads under a local directory, one directory per upload holding its
+// manifest and a file per stored chunk. Instances only share them through a
+// shared filesystem.
+type Disk struct {
+	dir string
+}
+
+func NewDisk(dir string) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Disk{dir: dir}, nil
+}
+
+func (d *Disk) path(id string, name string) string {
+	return filepath.Join(d.dir, id, name)
+}
+
+func (d *Disk) Create(ctx context.Context, m Manifest) error {
+	if err := check(m); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(filepath.Join(d.dir, m.ID), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(d.path(m.ID, manifestFile), data, 0o600)
+}
+
+func (d *Disk) manifest(id string) (Manifest, error) {
+	var m Manifest
+	if !ValidID(id) {
+		return m, ErrNotFound
+	}
+	data, err := os.ReadFile(d.path(id, manifestFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, ErrNotFound
+	}
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(data, &m)
+}
+
+func (d *Disk) Stat(ctx context.Context, id string) (Manifest, []bool, error) {
+	m, err := d.manifest(id)
+	if err != nil {
+		return m, nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(d.dir, id))
+	if err != nil {
+		return m, nil, err
+	}
+	stored := make([]bool, m.Chunks)
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil && n >= 0 && n < m.Chunks {
+			stored[n] = true
+		}
+	}
+	return m, stored, nil
+}
+
+// Written to a temporary file and linked into place, so a chunk is either
+// whole or missing and a second upload of it fails
+func (d *Disk) Put(ctx context.Context, id string, n int, data []byte) error {
+	m, err := d.manifest(id)
+	if err != nil {
+		return err
+	}
+	if n < 0 || n >= m.Chunks {
+		return ErrNoChunk
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(d.dir, id), "upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	err = os.Link(tmp.Name(), d.path(id, strconv.Itoa(n)))
+	if errors.Is(err, fs.ErrExist) {
+		return ErrExists
+	}
+	return err
+}
+
+func (d *Disk) Get(ctx context.Context, id string, n int) ([]byte, error) {
+	m, err := d.manifest(id)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n >= m.Chunks {
+		return nil, ErrNoChunk
+	}
+
+	data, err := os.ReadFile(d.path(id, strconv.Itoa(n)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoChunk
+	}
+	return data, err
+}
+
+func (d *Disk) Expire(ctx context.Context, before time.Time) (int, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		m, err := d.manifest(e.Name())
+		if err != nil || !m.CreatedAt.Before(before) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(d.dir, m.ID)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
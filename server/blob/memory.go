@@ -0,0 +1,93 @@
+package blob
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type upload struct {
+	manifest Manifest
+	chunks   [][]byte
+}
+
+// Uploads in process memory, lost on restart and only seen by this node
+type Memory struct {
+	mu      sync.Mutex
+	uploads map[string]*upload
+}
+
+func NewMemory() *Memory {
+	return &Memory{uploads: make(map[string]*upload)}
+}
+
+func (m *Memory) Create(ctx context.Context, manifest Manifest) error {
+	if err := check(manifest); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[manifest.ID] = &upload{manifest: manifest, chunks: make([][]byte, manifest.Chunks)}
+	return nil
+}
+
+func (m *Memory) Stat(ctx context.Context, id string) (Manifest, []bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[id]
+	if !ok {
+		return Manifest{}, nil, ErrNotFound
+	}
+
+	stored := make([]bool, len(u.chunks))
+	for i, c := range u.chunks {
+		stored[i] = c != nil
+	}
+	return u.manifest, stored, nil
+}
+
+func (m *Memory) Put(ctx context.Context, id string, n int, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if n < 0 || n >= len(u.chunks) {
+		return ErrNoChunk
+	}
+	if u.chunks[n] != nil {
+		return ErrExists
+	}
+
+	// Never nil, so an empty chunk still counts as stored
+	u.chunks[n] = append(make([]byte, 0, len(data)), data...)
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, id string, n int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if n < 0 || n >= len(u.chunks) || u.chunks[n] == nil {
+		return nil, ErrNoChunk
+	}
+	return u.chunks[n], nil
+}
+
+func (m *Memory) Expire(ctx context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, u := range m.uploads {
+		if u.manifest.CreatedAt.Before(before) {
+			delete(m.uploads, id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,15 @@
+package bus
+
+import (
+	"context"
+)
+
+// Carries hub traffic between server instances. Every subscriber on every node
+// receives every message published on its topic, including the publisher's own.
+type Bus interface {
+	Publish(ctx context.Context, topic string, data []byte) error
+
+	// Returns once subscribed, handler is then called for each message on topic
+	// until ctx is done. Handler runs on a single goroutine and must not block for long.
+	Subscribe(ctx context.Context, topic string, handler func(data []byte)) error
+}
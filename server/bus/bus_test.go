@@ -0,0 +1,86 @@
+package bus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func newRedisBus(t *testing.T) *Redis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) },
+	}
+	t.Cleanup(func() { pool.Close() })
+	return NewRedis(pool)
+}
+
+// Every subscriber of a topic gets every message, in order, and nothing from other topics
+func testFanOut(t *testing.T, b Bus) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := []chan string{make(chan string, 10), make(chan string, 10)}
+	for _, ch := range received {
+		ch := ch
+		if err := b.Subscribe(ctx, "room", func(data []byte) { ch <- string(data) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Subscribe(ctx, "other", func(data []byte) { t.Errorf("Unexpected message %q on other topic", data) }); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"first", "second"} {
+		if err := b.Publish(ctx, "room", []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, ch := range received {
+		for _, want := range []string{"first", "second"} {
+			select {
+			case got := <-ch:
+				if got != want {
+					t.Errorf("Subscriber %d: expected %q, got %q", i, want, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Subscriber %d: timed out waiting for %q", i, want)
+			}
+		}
+	}
+}
+
+func TestMemoryFanOut(t *testing.T) {
+	testFanOut(t, NewMemory())
+}
+
+func TestRedisFanOut(t *testing.T) {
+	testFanOut(t, newRedisBus(t))
+}
+
+func TestMemoryUnsubscribe(t *testing.T) {
+	b := NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	received := make(chan []byte, 1)
+	if err := b.Subscribe(ctx, "room", func(data []byte) { received <- data }); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// The subscription is removed by an AfterFunc, give it a moment
+	time.Sleep(10 * time.Millisecond)
+	if err := b.Publish(context.Background(), "room", []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		t.Errorf("Received %q after unsubscribing", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
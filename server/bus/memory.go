@@ -0,0 +1,97 @@
+package bus
+
+import (
+	"context"
+	"sync"
+)
+
+// In-process bus, for a single node and for tests
+type Memory struct {
+	mu   sync.Mutex
+	subs map[string]map[*subscription]bool
+}
+
+// Queue of undelivered messages, unbounded so a publisher never waits on a subscriber
+type subscription struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{subs: make(map[string]map[*subscription]bool)}
+}
+
+func (m *Memory) Publish(ctx context.Context, topic string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for sub := range m.subs[topic] {
+		sub.push(data)
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context, topic string, handler func(data []byte)) error {
+	sub := &subscription{}
+	sub.cond = sync.NewCond(&sub.mu)
+
+	m.mu.Lock()
+	if m.subs[topic] == nil {
+		m.subs[topic] = make(map[*subscription]bool)
+	}
+	m.subs[topic][sub] = true
+	m.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		delete(m.subs[topic], sub)
+		m.mu.Unlock()
+		sub.close()
+	})
+
+	go func() {
+		for {
+			data, ok := sub.pop()
+			if !ok {
+				return
+			}
+			handler(data)
+		}
+	}()
+	return nil
+}
+
+func (s *subscription) push(data []byte) {
+	s.mu.Lock()
+	s.queue = append(s.queue, data)
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *subscription) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// Blocks until a message is queued, false once the subscription is closed
+func (s *subscription) pop() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, false
+	}
+	data := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	return data, true
+}
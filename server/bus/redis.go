@@ -0,0 +1,133 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+)
+
+var log = logger.For("bus")
+
+// Wait before subscribing again after the connection dropped
+const resubscribeDelay = time.Second
+
+// Bus over Redis pub/sub. Messages published while a node is resubscribing are lost to that node.
+type Redis struct {
+	pool *redis.Pool
+}
+
+func NewRedis(pool *redis.Pool) *Redis {
+	return &Redis{pool: pool}
+}
+
+func (r *Redis) Publish(ctx context.Context, topic string, data []byte) error {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", topic, data)
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues("PUBLISH").Inc()
+	}
+	return err
+}
+
+// Subscribes on a dedicated connection, resubscribing in the background whenever it drops
+func (r *Redis) Subscribe(ctx context.Context, topic string, handler func(data []byte)) error {
+	psc, err := r.subscribe(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			err := receive(ctx, psc, handler)
+			if ctx.Err() != nil {
+				return
+			}
+			metrics.RedisErrors.WithLabelValues("SUBSCRIBE").Inc()
+			log.Warn("subscription dropped, resubscribing", "topic", topic, "err", err)
+
+			for psc = nil; psc == nil; {
+				select {
+				case <-time.After(resubscribeDelay):
+				case <-ctx.Done():
+					return
+				}
+				if psc, err = r.subscribe(ctx, topic); err != nil {
+					log.Error("resubscribe failed", "topic", topic, "err", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Open a connection and wait for Redis to confirm the subscription
+func (r *Redis) subscribe(ctx context.Context, topic string) (*redis.PubSubConn, error) {
+	psc, err := r.dialSubscribe(ctx, topic)
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues("SUBSCRIBE").Inc()
+	}
+	return psc, err
+}
+
+func (r *Redis) dialSubscribe(ctx context.Context, topic string) (*redis.PubSubConn, error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	psc := &redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(topic); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	switch v := psc.Receive().(type) {
+	case redis.Subscription:
+		return psc, nil
+	case error:
+		conn.Close()
+		return nil, v
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("bus: unexpected reply %T to subscribe", v)
+	}
+}
+
+// Hand messages to handler until the connection fails or ctx is done
+func receive(ctx context.Context, psc *redis.PubSubConn, handler func(data []byte)) error {
+	// Unsubscribing may run alongside Receive, which then sees the confirmation and returns
+	unsubscribed := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		psc.Unsubscribe()
+		close(unsubscribed)
+	})
+	defer func() {
+		if !stop() {
+			<-unsubscribed
+		}
+		psc.Close()
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			handler(v.Data)
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			return v
+		}
+	}
+}
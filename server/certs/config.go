@@ -0,0 +1,42 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+)
+
+// TLS settings for the server, the certificate reloads until ctx is done.
+// With a client CA, certificates are verified when offered but not required,
+// routes that need one check for it themselves.
+func ServerConfig(ctx context.Context, cfg config.TLS) (*tls.Config, error) {
+	reloader, err := NewReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(ctx, cfg.ReloadInterval)
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,117 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+)
+
+var log = logger.For("certs")
+
+// Serves a certificate from disk and swaps it when the files change or on SIGHUP,
+// so renewed certificates are picked up without dropping connections.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load the pair again, the old certificate is kept if the new one is invalid
+func (r *Reloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// For tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *Reloader) changed() bool {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return modTime.After(r.modTime)
+}
+
+// Reload on SIGHUP, and when the files change if interval is positive, until ctx is done
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info("SIGHUP, reloading certificate", "file", r.certFile)
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+			log.Info("certificate changed on disk, reloading", "file", r.certFile)
+		}
+
+		if err := r.Reload(); err != nil {
+			log.Error("reload failed, keeping the previous certificate", "file", r.certFile, "err", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package certs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePair(t *testing.T, certFile, keyFile string, modTime time.Time) []byte {
+	t.Helper()
+	certPEM, keyPEM, err := GenerateSelfSigned([]string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, certPEM, 0o644)
+	os.WriteFile(keyFile, keyPEM, 0o600)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+	return certPEM
+}
+
+func TestReloaderPicksUpNewCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	now := time.Now()
+	writePair(t, certFile, keyFile, now.Add(-time.Minute))
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := r.GetCertificate(nil)
+
+	if r.changed() {
+		t.Error("Unchanged files reported as changed")
+	}
+
+	writePair(t, certFile, keyFile, now)
+	if !r.changed() {
+		t.Fatal("Rewritten files not detected")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := r.GetCertificate(nil)
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Error("Certificate was not swapped")
+	}
+
+	// A broken file must not replace a working certificate
+	os.WriteFile(certFile, []byte("garbage"), 0o644)
+	if err := r.Reload(); err == nil {
+		t.Error("Invalid certificate accepted")
+	}
+	if current, _ := r.GetCertificate(nil); current != second {
+		t.Error("Working certificate dropped after a failed reload")
+	}
+}
@@ -6,8 +6,9 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	// "encoding/hex"
-	"strings"
 
 	// "encoding/json"
 
@@ -16,33 +17,40 @@ import (
 	"time"
 
 	// "github.com/FelineJTD/secure-chat-kripto/server/ecdh"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
 	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
 	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+	"github.com/FelineJTD/secure-chat-kripto/server/ratelimit"
+	"github.com/FelineJTD/secure-chat-kripto/server/rooms"
 	"github.com/gorilla/websocket"
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 12800
-)
-
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// Marks a sealed message on the wire, session encrypted ones are plain hex
+const sealedPrefix = "room:"
+
+// A message queued for a client
+type outbound struct {
+	// Plaintext, encrypted under the session key by writePump.
+	data []byte
+
+	// Already encrypted under the room key and written as is, nil outside keyed rooms.
+	sealed []byte
+}
+
+// Built once at startup, checkOrigin nil keeps gorilla's same origin check
+func newUpgrader(cfg config.WebSocket, checkOrigin func(r *http.Request) bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  cfg.ReadBufferSize,
+		WriteBufferSize: cfg.WriteBufferSize,
+		CheckOrigin:     checkOrigin,
+	}
 }
 
 // Client is a middleman between the websocket connection and the hub.
@@ -53,13 +61,50 @@ type Client struct {
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan outbound
+
+	// Close frame to send once send is closed, set by the shard before closing it.
+	closeMessage []byte
+
+	// Closed when writePump returns.
+	writeDone chan struct{}
 
 	// Address as ID
 	address string
 
-	// Shared key
-	sharedKey string
+	// Name claimed at handshake, shown as the sender of messages, typing frames
+	// and presence. Anyone can claim any name, it authorizes nothing.
+	id string
+
+	// Same as id once the handshake was signed with the key bound to it, empty
+	// for sessions that only claimed a name. Checked wherever access is decided.
+	user string
+
+	// Room the client is chatting in
+	room string
+
+	// Registered Schnorr verification key, hex encoded, empty if none
+	verifyKey string
+
+	// Set by the client through status frames, owned by the shard
+	away bool
+
+	// Last typing frame relayed, owned by readPump
+	lastTyping time.Time
+
+	// Built from the session key at handshake, shared by both pumps
+	cipher *handlers.Cipher
+
+	// Shard the client is registered with, set by Hub.join
+	shard *shard
+
+	connectedAt time.Time
+
+	// Messages dropped by the backpressure policy since the last gap notice, owned by the shard
+	dropped int
+
+	// When the send buffer was first found full, zero once it has room again, owned by the shard
+	fullSince time.Time
 }
 
 type PubKeyClient struct {
@@ -74,55 +119,145 @@ type PubKeyClient struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.leave(c)
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	cfg := c.hub.cfg.WebSocket
+	c.conn.SetReadLimit(cfg.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(cfg.PongWait)); return nil })
+	messages := ratelimit.New(c.hub.cfg.Limits.Messages)
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				logger.HandleError(err)
+				wsLog.Warn("unexpected close", "address", c.address, "err", err)
 			}
 			break
 		}
+		metrics.MessagesIn.Inc()
 
-		logger.Info("\n[" + c.address + "] => Decrypt{" + c.sharedKey + ", " + string(message) + "}")
+		// Checked before decrypting so a flood costs as little as possible
+		if !messages.Allow() {
+			wsLog.Info("rate limited, closing", "address", c.address)
+			closeRateLimited(c.conn, "messages", cfg.WriteWait)
+			return
+		}
+		// A verified user shares one bucket across their sessions, an unsigned
+		// session has its own so nobody can drain another's by claiming the name
+		if !c.hub.limits.users.Allow(c.author()) {
+			wsLog.Info("rate limited user, closing", "address", c.address, "user", c.id)
+			closeRateLimited(c.conn, "users", cfg.WriteWait)
+			return
+		}
 
-		plaintext, err := handlers.Decrypt(c.sharedKey, string(message))
+		wsLog.Log(context.Background(), logger.LevelMinutia, "frame received", "address", c.address, "size", len(message))
+
+		plaintext, err := c.cipher.Decrypt(string(message))
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				logger.HandleError(err)
-			}
+			metrics.DecryptFailures.Inc()
+			wsLog.Info("undecryptable frame, closing", "address", c.address, "err", err)
 			break
 		}
 
-		c.hub.broadcast <- bytes.TrimSpace(bytes.Replace([]byte(plaintext), newline, space, -1))
+		message = bytes.TrimSpace(bytes.Replace(plaintext, newline, space, -1))
+
+		// Control frames are handled here, anything that is not one is a chat message
+		env, err := parseEnvelope(message)
+		if err == nil && !isChat(env.Type) {
+			if !c.control(env) {
+				return
+			}
+			continue
+		}
+
+		if err := c.checkPolicy(message); err != nil {
+			if !c.reject(err) {
+				return
+			}
+			continue
+		}
+
+		// Not an envelope, relayed as it is without an id
+		if err != nil {
+			if !c.hub.broadcastRoom(c.room, message) {
+				return
+			}
+			continue
+		}
+
+		if !c.chat(env) {
+			return
+		}
+	}
+}
+
+// Who messages are kept as written by: the user the session proved it is, or
+// the session itself when it only claimed a name
+func (c *Client) author() string {
+	if c.user != "" {
+		return c.user
+	}
+	return c.address
+}
+
+func (c *Client) member() memberKey {
+	return memberKey{room: c.room, user: c.id}
+}
+
+// Handle a control frame from the client, false once the hub has stopped.
+func (c *Client) control(env *Envelope) bool {
+	switch env.Type {
+	case envelopeTyping:
+		interval := c.hub.cfg.Presence.TypingInterval
+		if time.Since(c.lastTyping) < interval {
+			return true
+		}
+		c.lastTyping = time.Now()
+
+		frame, _ := json.Marshal(Envelope{Type: envelopeTyping, Sender: c.id})
+		return c.hub.broadcastRoom(c.room, frame)
+	case envelopeStatus:
+		if env.Status != statusOnline && env.Status != statusAway {
+			return c.reject(errUnknownStatus)
+		}
+		return c.hub.setAway(c, env.Status == statusAway)
+	case envelopeDelete, envelopeReact, envelopeUnreact:
+		return c.amend(env)
+	default:
+		return c.reject(errUnknownType)
 	}
 }
 
+// Tell the client its frame was refused, false once the hub has stopped.
+func (c *Client) reject(err error) bool {
+	wsLog.Info("rejected message", "address", c.address, "reason", err.Error())
+	return c.hub.sendClient(c, errorFrame(err))
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
-	var err error = nil
-	ticker := time.NewTicker(pingPeriod)
-	defer logger.HandleError(err)
+	cfg := c.hub.cfg.WebSocket
+	ticker := time.NewTicker(cfg.PingPeriod())
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.writeDone)
 	}()
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				if c.closeMessage == nil {
+					c.closeMessage = []byte{}
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
 				return
 			}
 
@@ -131,27 +266,33 @@ func (c *Client) writePump() {
 				return
 			}
 
-			logger.Info("\n[" + c.address + "] <= Encrypt{" + c.sharedKey + ", " + string(message) + "}")
+			wsLog.Log(context.Background(), logger.LevelMinutia, "frame sent", "address", c.address, "size", len(message.data))
 
-			encrypted, err := handlers.Encrypt(c.sharedKey, string(message))
+			encrypted, err := c.encrypt(message)
 			if err != nil {
 				return
 			}
 
-			w.Write([]byte(encrypted))
+			w.Write(encrypted)
+			metrics.MessagesOut.Inc()
 
-			// Add queued chat messages to the current websocket message.
+			// Add queued chat messages to the current websocket message, each encrypted on its own.
 			n := len(c.send)
 			for i := 0; i < n; i++ {
+				encrypted, err := c.encrypt(<-c.send)
+				if err != nil {
+					return
+				}
 				w.Write(newline)
-				w.Write(<-c.send)
+				w.Write(encrypted)
+				metrics.MessagesOut.Inc()
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -159,29 +300,96 @@ func (c *Client) writePump() {
 	}
 }
 
+// Wire form of a message, sealed ones were encrypted for the whole room already
+func (c *Client) encrypt(message outbound) ([]byte, error) {
+	if message.sealed != nil {
+		return message.sealed, nil
+	}
+	encrypted, err := c.cipher.Encrypt(message.data)
+	return []byte(encrypted), err
+}
+
 // serveWs handles websocket requests from the peer.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+func serveWs(hub *Hub, upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	if err != nil {
-		logger.HandleError(err)
+		wsLog.Info("upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+
+	// Refused after upgrading, browsers only let scripts see why through the close frame
+	if ip := middlewares.ClientIP(r); !hub.limits.connects.Allow(ip) {
+		wsLog.Info("rate limited connection", "ip", ip)
+		closeRateLimited(conn, "connects", hub.cfg.WebSocket.WriteWait)
+		conn.Close()
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !middlewares.ValidSessionID(session) {
+		wsLog.Info("no session id, closing", "remote", r.RemoteAddr)
+		conn.Close()
+		return
+	}
+	address := middlewares.SessionAddress(session)
+
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = defaultRoom
+	}
+	// The name ends up in Redis keys
+	if !rooms.ValidName(room) {
+		wsLog.Info("invalid room name, closing", "address", address)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid room name"), time.Now().Add(hub.cfg.WebSocket.WriteWait))
+		conn.Close()
+		return
+	}
+	wsLog.Info("connected", "address", address, "room", room)
+
+	cipher, err := handlers.SessionCipher(address)
+	if err != nil {
+		wsLog.Info("no session key, closing", "address", address, "err", err)
+		conn.Close()
 		return
 	}
 
-	address := strings.Split(r.RemoteAddr, ":")[0] + ":" + r.URL.Query().Get("id")
-	logger.Info("Address: " + address)
+	// The name claimed at handshake, shown whether or not it was signed for
+	id, err := handlers.GetSessionUser(address)
+	if err != nil {
+		wsLog.Info("no session user, closing", "address", address, "err", err)
+		conn.Close()
+		return
+	}
 
-	sharedKey, err := handlers.GetSharedKey(address)
+	verifyKey, err := handlers.GetVerifyKey(address)
 	if err != nil {
-		logger.HandleError(err)
+		wsLog.Error("verification key lookup failed", "address", address, "err", err)
+		conn.Close()
+		return
+	}
+
+	// Only a session signed with the name's key counts as that user
+	var user string
+	if verifyKey != "" {
+		user = id
+	}
+	if ok, err := hub.mayEnter(r.Context(), room, user); !ok {
+		wsLog.Info("not let into the room, closing", "address", address, "room", room, "err", err)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "not a member of the room"), time.Now().Add(hub.cfg.WebSocket.WriteWait))
+		conn.Close()
 		return
 	}
 
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), address: address, sharedKey: sharedKey}
+	client := &Client{hub: hub, conn: conn, send: make(chan outbound, hub.cfg.WebSocket.SendBufferSize), writeDone: make(chan struct{}), address: address, id: id, user: user, room: room, cipher: cipher, verifyKey: verifyKey, connectedAt: time.Now()}
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
 	go client.readPump()
-	client.hub.register <- client
+
+	if !hub.join(client) {
+		// Shutting down, unblock writePump so both pumps exit
+		client.closeMessage = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		close(client.send)
+	}
 }
@@ -0,0 +1,40 @@
+// Command devcert writes a self-signed certificate for running the server with TLS locally.
+//
+//	go run ./cmd/devcert -hosts localhost,127.0.0.1
+//	go run . -tls-cert cert.pem -tls-key key.pem
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/certs"
+)
+
+func main() {
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma separated host names and IPs")
+	certOut := flag.String("cert", "cert.pem", "certificate output file")
+	keyOut := flag.String("key", "key.pem", "private key output file")
+	validFor := flag.Duration("valid-for", 30*24*time.Hour, "validity period")
+	flag.Parse()
+
+	certPEM, keyPEM, err := certs.GenerateSelfSigned(strings.Split(*hosts, ","), *validFor)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(*certOut, certPEM, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*keyOut, keyPEM, 0o600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Wrote %s and %s for %s\n", *certOut, *keyOut, *hosts)
+}
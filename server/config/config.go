@@ -0,0 +1,542 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of every environment variable read by Load
+const envPrefix = "SECURECHAT_"
+
+type Server struct {
+	Addr          string `yaml:"addr"`
+	SchnorrParams string `yaml:"schnorr_params"` // Persisted Schnorr domain parameters
+	TLS           TLS    `yaml:"tls"`
+
+	// Origins allowed for CORS and WebSocket upgrades, * matches any
+	AllowedOrigins []string `yaml:"allowed_origins"`
+
+	// CIDRs of proxies whose X-Forwarded-For and X-Real-IP are believed
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// How long to wait for connections to drain on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type TLS struct {
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ClientCAFile   string        `yaml:"client_ca_file"`  // Enables mTLS for admin routes
+	ReloadInterval time.Duration `yaml:"reload_interval"` // How often to check the files for changes, 0 for SIGHUP only
+}
+
+// TLS is served when a certificate is configured
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+type Redis struct {
+	URL         string        `yaml:"url"`
+	MaxIdle     int           `yaml:"max_idle"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// Carries broadcasts between server instances
+type Bus struct {
+	Driver  string `yaml:"driver"`  // redis to fan out across instances, memory for a single instance
+	Channel string `yaml:"channel"` // Redis pub/sub channel shared by every instance
+}
+
+type WebSocket struct {
+	MaxMessageSize  int64         `yaml:"max_message_size"` // Maximum message size allowed from peer
+	PongWait        time.Duration `yaml:"pong_wait"`        // Time allowed to read the next pong message from the peer
+	WriteWait       time.Duration `yaml:"write_wait"`       // Time allowed to write a message to the peer
+	ReadBufferSize  int           `yaml:"read_buffer_size"`
+	WriteBufferSize int           `yaml:"write_buffer_size"`
+	SendBufferSize  int           `yaml:"send_buffer_size"` // Outbound messages queued per client
+}
+
+type Hub struct {
+	Shards int `yaml:"shards"` // Goroutines the clients are spread over, 0 for one per CPU
+}
+
+// Slow consumer policies, applied when a client's send buffer is full
+const (
+	PolicyDisconnect = "disconnect"  // Drop new messages, disconnect if still full after Grace
+	PolicyDropOldest = "drop-oldest" // Make room by dropping the oldest, the client is told how many it missed
+	PolicySpill      = "spill"       // Disconnect and keep its messages in the offline queue until it reconnects
+)
+
+type Backpressure struct {
+	Policy          string        `yaml:"policy"`           // disconnect, drop-oldest or spill
+	Grace           time.Duration `yaml:"grace"`            // How long a full client is kept with the disconnect policy
+	BroadcastBuffer int           `yaml:"broadcast_buffer"` // Room and direct messages queued for the hub
+}
+
+// Messages kept for clients that are not connected
+type Offline struct {
+	Driver string        `yaml:"driver"` // redis to share them between instances, memory for a single instance
+	Limit  int           `yaml:"limit"`  // Messages kept per address, the oldest go first
+	TTL    time.Duration `yaml:"ttl"`
+}
+
+// Messages kept per room, so they can be edited, deleted and reacted to
+type History struct {
+	Driver string        `yaml:"driver"` // redis to share it between instances, memory for a single instance
+	Limit  int           `yaml:"limit"`  // Messages kept per room, the oldest go first
+	Sweep  time.Duration `yaml:"sweep"`  // How often expired messages are purged
+}
+
+// Encrypted file uploads, chunked so no request holds a whole file
+type Files struct {
+	Driver    string        `yaml:"driver"`     // disk, or memory for a single instance
+	Dir       string        `yaml:"dir"`        // Where the disk driver keeps uploads
+	ChunkSize int           `yaml:"chunk_size"` // Largest chunk accepted, in bytes
+	MaxChunks int           `yaml:"max_chunks"` // Chunks per file, with chunk_size this caps the file size
+	Quota     int           `yaml:"quota"`      // Chunks a session may start uploads for within ttl
+	TTL       time.Duration `yaml:"ttl"`        // Uploads are deleted this long after they were started
+}
+
+// The admin API and metrics are only served when a token or client certificates are configured, both apply when set
+type Admin struct {
+	Token string `yaml:"token"` // Bearer token for /admin
+}
+
+type Presence struct {
+	Heartbeat      time.Duration `yaml:"heartbeat"`       // How often each instance re-announces its users, three missed marks them gone
+	TypingInterval time.Duration `yaml:"typing_interval"` // Minimum time between typing frames relayed per connection
+}
+
+// Instances missing this long are considered gone
+func (p Presence) TTL() time.Duration {
+	return 3 * p.Heartbeat
+}
+
+// Token bucket refilled at Rate tokens per second, holding at most Burst. A zero rate disables it.
+type Limit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+type RateLimits struct {
+	Messages   Limit `yaml:"messages"`   // Frames per connection
+	Users      Limit `yaml:"users"`      // Frames per user across their connections to an instance
+	Handshakes Limit `yaml:"handshakes"` // Handshakes per IP
+	Connects   Limit `yaml:"connects"`   // WebSocket connections per IP
+	Uploads    Limit `yaml:"uploads"`    // Upload starts and chunks per session
+}
+
+type Log struct {
+	Verbosity int               `yaml:"verbosity"` // 3: Minutia, 2: Debug, 1: Info, 0: Error
+	Format    string            `yaml:"format"`    // json or text
+	Levels    map[string]string `yaml:"levels"`    // Per component overrides: error, warn, info, debug or minutia
+}
+
+type Rooms struct {
+	Driver string   `yaml:"driver"` // Where rooms made through the API are kept, redis or memory for a single instance
+	Signed []string `yaml:"signed"` // Rooms that only accept validly signed messages
+	Keyed  []string `yaml:"keyed"`  // Rooms whose broadcasts are encrypted once under a room key instead of per member
+
+	// Rooms whose messages disappear, from history and offline queues, this long after they were sent
+	TTL map[string]time.Duration `yaml:"ttl"`
+}
+
+type Config struct {
+	Server       Server       `yaml:"server"`
+	Redis        Redis        `yaml:"redis"`
+	Bus          Bus          `yaml:"bus"`
+	WebSocket    WebSocket    `yaml:"websocket"`
+	Hub          Hub          `yaml:"hub"`
+	Backpressure Backpressure `yaml:"backpressure"`
+	Offline      Offline      `yaml:"offline"`
+	History      History      `yaml:"history"`
+	Files        Files        `yaml:"files"`
+	Presence     Presence     `yaml:"presence"`
+	Limits       RateLimits   `yaml:"limits"`
+	Admin        Admin        `yaml:"admin"`
+	Log          Log          `yaml:"log"`
+	Rooms        Rooms        `yaml:"rooms"`
+}
+
+// Send pings to peer with this period. Must be less than PongWait.
+func (ws WebSocket) PingPeriod() time.Duration {
+	return (ws.PongWait * 9) / 10
+}
+
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:          ":8080",
+			SchnorrParams: "schnorr.json",
+			TLS: TLS{
+				ReloadInterval: time.Minute,
+			},
+			ShutdownTimeout: 10 * time.Second,
+			AllowedOrigins:  []string{"http://localhost:5173", "http://127.0.0.1:5173"},
+		},
+		Redis: Redis{
+			URL:         "redis://cache:6379/0",
+			MaxIdle:     3,
+			IdleTimeout: 240 * time.Second,
+		},
+		Bus: Bus{
+			Driver:  "redis",
+			Channel: "securechat:hub",
+		},
+		WebSocket: WebSocket{
+			MaxMessageSize:  12800,
+			PongWait:        60 * time.Second,
+			WriteWait:       10 * time.Second,
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			SendBufferSize:  256,
+		},
+		Backpressure: Backpressure{
+			Policy:          PolicyDisconnect,
+			Grace:           5 * time.Second,
+			BroadcastBuffer: 256,
+		},
+		Offline: Offline{
+			Driver: "redis",
+			Limit:  256,
+			TTL:    24 * time.Hour,
+		},
+		History: History{
+			Driver: "redis",
+			Limit:  1000,
+			Sweep:  10 * time.Second,
+		},
+		Files: Files{
+			Driver:    "disk",
+			Dir:       "files",
+			ChunkSize: 256 << 10,
+			MaxChunks: 256,
+			Quota:     1024,
+			TTL:       7 * 24 * time.Hour,
+		},
+		Presence: Presence{
+			Heartbeat:      30 * time.Second,
+			TypingInterval: 2 * time.Second,
+		},
+		Limits: RateLimits{
+			Messages:   Limit{Rate: 10, Burst: 20},
+			Users:      Limit{Rate: 20, Burst: 40},
+			Handshakes: Limit{Rate: 0.2, Burst: 5},
+			Connects:   Limit{Rate: 1, Burst: 10},
+			Uploads:    Limit{Rate: 5, Burst: 300},
+		},
+		Log: Log{
+			Verbosity: 1,
+			Format:    "json",
+		},
+		Rooms: Rooms{
+			Driver: "redis",
+		},
+	}
+}
+
+// A single setting, reachable as a flag and as SECURECHAT_<FLAG NAME>
+type setting struct {
+	flag  string
+	usage string
+	field func(*Config) any
+}
+
+var settings = []setting{
+	{"addr", "listen address", func(c *Config) any { return &c.Server.Addr }},
+	{"schnorr-params", "file holding the persisted Schnorr parameters", func(c *Config) any { return &c.Server.SchnorrParams }},
+	{"shutdown-timeout", "how long to wait for connections to drain on shutdown", func(c *Config) any { return &c.Server.ShutdownTimeout }},
+	{"allowed-origins", "comma separated origins allowed for CORS and websockets, * for any", func(c *Config) any { return &c.Server.AllowedOrigins }},
+	{"trusted-proxies", "comma separated CIDRs of proxies trusted to report the client IP", func(c *Config) any { return &c.Server.TrustedProxies }},
+	{"tls-cert", "TLS certificate file, enables HTTPS and WSS", func(c *Config) any { return &c.Server.TLS.CertFile }},
+	{"tls-key", "TLS private key file", func(c *Config) any { return &c.Server.TLS.KeyFile }},
+	{"tls-client-ca", "CA bundle for client certificates on admin routes", func(c *Config) any { return &c.Server.TLS.ClientCAFile }},
+	{"tls-reload-interval", "how often to check the certificate for changes, 0 for SIGHUP only", func(c *Config) any { return &c.Server.TLS.ReloadInterval }},
+	{"redis-url", "redis connection URL", func(c *Config) any { return &c.Redis.URL }},
+	{"redis-max-idle", "idle redis connections kept in the pool", func(c *Config) any { return &c.Redis.MaxIdle }},
+	{"redis-idle-timeout", "close idle redis connections after this long", func(c *Config) any { return &c.Redis.IdleTimeout }},
+	{"bus-driver", "message bus between instances, redis or memory", func(c *Config) any { return &c.Bus.Driver }},
+	{"bus-channel", "redis channel shared by every instance", func(c *Config) any { return &c.Bus.Channel }},
+	{"max-message-size", "maximum websocket message size in bytes", func(c *Config) any { return &c.WebSocket.MaxMessageSize }},
+	{"pong-wait", "time allowed to read the next pong from the peer", func(c *Config) any { return &c.WebSocket.PongWait }},
+	{"write-wait", "time allowed to write a message to the peer", func(c *Config) any { return &c.WebSocket.WriteWait }},
+	{"read-buffer-size", "websocket read buffer size in bytes", func(c *Config) any { return &c.WebSocket.ReadBufferSize }},
+	{"write-buffer-size", "websocket write buffer size in bytes", func(c *Config) any { return &c.WebSocket.WriteBufferSize }},
+	{"send-buffer-size", "outbound messages queued per client", func(c *Config) any { return &c.WebSocket.SendBufferSize }},
+	{"hub-shards", "goroutines the clients are spread over, 0 for one per CPU", func(c *Config) any { return &c.Hub.Shards }},
+	{"backpressure-policy", "what to do with a client whose send buffer is full: disconnect, drop-oldest or spill", func(c *Config) any { return &c.Backpressure.Policy }},
+	{"backpressure-grace", "how long a full client is kept before it is disconnected", func(c *Config) any { return &c.Backpressure.Grace }},
+	{"broadcast-buffer", "messages queued for the hub before senders wait", func(c *Config) any { return &c.Backpressure.BroadcastBuffer }},
+	{"offline-driver", "where messages for disconnected clients are kept, redis or memory", func(c *Config) any { return &c.Offline.Driver }},
+	{"offline-limit", "messages kept per disconnected client", func(c *Config) any { return &c.Offline.Limit }},
+	{"offline-ttl", "how long messages for disconnected clients are kept", func(c *Config) any { return &c.Offline.TTL }},
+	{"history-driver", "where room history is kept, redis or memory", func(c *Config) any { return &c.History.Driver }},
+	{"history-limit", "messages kept per room", func(c *Config) any { return &c.History.Limit }},
+	{"history-sweep", "how often expired messages are purged from history", func(c *Config) any { return &c.History.Sweep }},
+	{"files-driver", "where uploaded files are kept, disk or memory", func(c *Config) any { return &c.Files.Driver }},
+	{"files-dir", "directory the disk files driver keeps uploads in", func(c *Config) any { return &c.Files.Dir }},
+	{"files-chunk-size", "largest upload chunk accepted, in bytes", func(c *Config) any { return &c.Files.ChunkSize }},
+	{"files-max-chunks", "chunks per uploaded file", func(c *Config) any { return &c.Files.MaxChunks }},
+	{"files-quota", "chunks a session may start uploads for within files-ttl", func(c *Config) any { return &c.Files.Quota }},
+	{"files-ttl", "how long uploaded files are kept", func(c *Config) any { return &c.Files.TTL }},
+	{"presence-heartbeat", "how often each instance re-announces its users", func(c *Config) any { return &c.Presence.Heartbeat }},
+	{"typing-interval", "minimum time between typing frames relayed per connection", func(c *Config) any { return &c.Presence.TypingInterval }},
+	{"message-rate", "frames per second per connection, 0 for no limit", func(c *Config) any { return &c.Limits.Messages.Rate }},
+	{"message-burst", "frames a connection may send at once", func(c *Config) any { return &c.Limits.Messages.Burst }},
+	{"user-rate", "frames per second per user, 0 for no limit", func(c *Config) any { return &c.Limits.Users.Rate }},
+	{"user-burst", "frames a user may send at once", func(c *Config) any { return &c.Limits.Users.Burst }},
+	{"handshake-rate", "handshakes per second per IP, 0 for no limit", func(c *Config) any { return &c.Limits.Handshakes.Rate }},
+	{"handshake-burst", "handshakes an IP may make at once", func(c *Config) any { return &c.Limits.Handshakes.Burst }},
+	{"connect-rate", "websocket connections per second per IP, 0 for no limit", func(c *Config) any { return &c.Limits.Connects.Rate }},
+	{"connect-burst", "websocket connections an IP may open at once", func(c *Config) any { return &c.Limits.Connects.Burst }},
+	{"upload-rate", "upload starts and chunks per second per session, 0 for no limit", func(c *Config) any { return &c.Limits.Uploads.Rate }},
+	{"upload-burst", "upload starts and chunks a session may send at once", func(c *Config) any { return &c.Limits.Uploads.Burst }},
+	{"verbosity", "log verbosity, 0: error to 3: minutia", func(c *Config) any { return &c.Log.Verbosity }},
+	{"admin-token", "bearer token for the admin API", func(c *Config) any { return &c.Admin.Token }},
+	{"log-format", "log output, json or text", func(c *Config) any { return &c.Log.Format }},
+	{"log-levels", "comma separated component=level overrides, such as hub=debug", func(c *Config) any { return &c.Log.Levels }},
+	{"rooms-driver", "where rooms made through the API are kept, redis or memory", func(c *Config) any { return &c.Rooms.Driver }},
+	{"signed-rooms", "comma separated rooms that only accept validly signed messages", func(c *Config) any { return &c.Rooms.Signed }},
+	{"room-ttl", "comma separated room=duration after which the room's messages disappear", func(c *Config) any { return &c.Rooms.TTL }},
+	{"keyed-rooms", "comma separated rooms whose broadcasts are encrypted once under a room key", func(c *Config) any { return &c.Rooms.Keyed }},
+}
+
+func (s setting) env() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(s.flag, "-", "_"))
+}
+
+// Parse a flag or environment value into the setting's field
+func (s setting) set(c *Config, value string) error {
+	var err error
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *int:
+		*field, err = strconv.Atoi(value)
+	case *int64:
+		*field, err = strconv.ParseInt(value, 10, 64)
+	case *float64:
+		*field, err = strconv.ParseFloat(value, 64)
+	case *time.Duration:
+		*field, err = time.ParseDuration(value)
+	case *[]string:
+		*field = nil
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*field = append(*field, v)
+			}
+		}
+	case *map[string]string:
+		*field = make(map[string]string)
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(v, "=")
+			if !ok {
+				return fmt.Errorf("%s: %q is not key=value", s.flag, v)
+			}
+			(*field)[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	case *map[string]time.Duration:
+		*field = make(map[string]time.Duration)
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(v, "=")
+			if !ok {
+				return fmt.Errorf("%s: %q is not key=duration", s.flag, v)
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("%s: %w", s.flag, err)
+			}
+			(*field)[strings.TrimSpace(k)] = d
+		}
+	default:
+		err = fmt.Errorf("unsupported type %T", field)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.flag, err)
+	}
+	return nil
+}
+
+// Load the configuration, later sources override earlier ones:
+// defaults, the YAML file (-config or SECURECHAT_CONFIG), environment, flags.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "YAML configuration file")
+
+	// Flags are recorded and applied last, after the file and environment
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagValues []flagValue
+	for _, s := range settings {
+		s := s
+		fs.Func(s.flag, s.usage+" (env "+s.env()+")", func(v string) error {
+			flagValues = append(flagValues, flagValue{s, v})
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env()); ok {
+			if err := s.set(cfg, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, fv := range flagValues {
+		if err := fv.setting.set(cfg, fv.value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, msg string) {
+		if !ok {
+			errs = append(errs, errors.New(msg))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr must be set")
+	check(c.Server.SchnorrParams != "", "server.schnorr_params must be set")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check((c.Server.TLS.CertFile == "") == (c.Server.TLS.KeyFile == ""), "server.tls.cert_file and server.tls.key_file must be set together")
+	check(c.Server.TLS.ClientCAFile == "" || c.Server.TLS.Enabled(), "server.tls.client_ca_file needs server.tls.cert_file")
+	check(c.Server.TLS.ReloadInterval >= 0, "server.tls.reload_interval must not be negative")
+	for _, origin := range c.Server.AllowedOrigins {
+		check(origin == "*" || (strings.Contains(origin, "://") && strings.Count(origin, "*") <= 1), "server.allowed_origins: "+origin+" is not an origin or a pattern with a single *")
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		_, prefixErr := netip.ParsePrefix(proxy)
+		_, addrErr := netip.ParseAddr(proxy)
+		check(prefixErr == nil || addrErr == nil, "server.trusted_proxies: "+proxy+" is not a CIDR or an IP")
+	}
+
+	u, err := url.Parse(c.Redis.URL)
+	check(err == nil && (u.Scheme == "redis" || u.Scheme == "rediss"), "redis.url must be a redis:// or rediss:// URL")
+	check(c.Redis.MaxIdle >= 0, "redis.max_idle must not be negative")
+	check(c.Redis.IdleTimeout >= 0, "redis.idle_timeout must not be negative")
+
+	check(c.Bus.Driver == "redis" || c.Bus.Driver == "memory", "bus.driver must be redis or memory")
+	check(c.Bus.Channel != "", "bus.channel must be set")
+
+	check(c.WebSocket.MaxMessageSize > 0, "websocket.max_message_size must be positive")
+	check(c.WebSocket.PongWait > 0, "websocket.pong_wait must be positive")
+	check(c.WebSocket.PingPeriod() > 0, "websocket.pong_wait is too short to derive a ping period")
+	check(c.WebSocket.WriteWait > 0, "websocket.write_wait must be positive")
+	check(c.WebSocket.ReadBufferSize > 0, "websocket.read_buffer_size must be positive")
+	check(c.WebSocket.WriteBufferSize > 0, "websocket.write_buffer_size must be positive")
+	check(c.WebSocket.SendBufferSize > 0, "websocket.send_buffer_size must be positive")
+
+	check(c.Hub.Shards >= 0, "hub.shards must not be negative")
+
+	switch c.Backpressure.Policy {
+	case PolicyDisconnect, PolicyDropOldest, PolicySpill:
+	default:
+		check(false, "backpressure.policy must be disconnect, drop-oldest or spill")
+	}
+	check(c.Backpressure.Grace >= 0, "backpressure.grace must not be negative")
+	check(c.Backpressure.BroadcastBuffer > 0, "backpressure.broadcast_buffer must be positive")
+	check(c.Backpressure.Policy != PolicyDropOldest || c.WebSocket.SendBufferSize > 1, "websocket.send_buffer_size must leave room for a gap notice with drop-oldest")
+
+	check(c.Offline.Driver == "redis" || c.Offline.Driver == "memory", "offline.driver must be redis or memory")
+	check(c.Offline.Limit > 0, "offline.limit must be positive")
+	check(c.Offline.TTL > 0, "offline.ttl must be positive")
+
+	check(c.History.Driver == "redis" || c.History.Driver == "memory", "history.driver must be redis or memory")
+	check(c.History.Limit > 0, "history.limit must be positive")
+	check(c.History.Sweep > 0, "history.sweep must be positive")
+	check(c.Rooms.Driver == "redis" || c.Rooms.Driver == "memory", "rooms.driver must be redis or memory")
+	for room, ttl := range c.Rooms.TTL {
+		check(ttl > 0, "rooms.ttl."+room+" must be positive")
+	}
+
+	check(c.Files.Driver == "disk" || c.Files.Driver == "memory", "files.driver must be disk or memory")
+	check(c.Files.Driver != "disk" || c.Files.Dir != "", "files.dir is required with the disk driver")
+	check(c.Files.ChunkSize > 0, "files.chunk_size must be positive")
+	check(c.Files.MaxChunks > 0, "files.max_chunks must be positive")
+	check(c.Files.Quota >= c.Files.MaxChunks, "files.quota must allow at least one file of files.max_chunks")
+	check(c.Files.TTL > 0, "files.ttl must be positive")
+
+	check(c.Presence.Heartbeat > 0, "presence.heartbeat must be positive")
+	check(c.Presence.TypingInterval >= 0, "presence.typing_interval must not be negative")
+
+	checkLimit := func(name string, l Limit) {
+		check(l.Rate >= 0, "limits."+name+".rate must not be negative")
+		check(!l.Enabled() || l.Burst > 0, "limits."+name+".burst must be positive when a rate is set")
+	}
+	checkLimit("messages", c.Limits.Messages)
+	checkLimit("users", c.Limits.Users)
+	checkLimit("handshakes", c.Limits.Handshakes)
+	checkLimit("connects", c.Limits.Connects)
+	checkLimit("uploads", c.Limits.Uploads)
+
+	check(c.Admin.Token == "" || len(c.Admin.Token) >= 16, "admin.token must be at least 16 characters")
+
+	check(c.Log.Verbosity >= 0 && c.Log.Verbosity <= 3, "log.verbosity must be between 0 and 3")
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format must be json or text")
+	for component, level := range c.Log.Levels {
+		switch strings.ToLower(level) {
+		case "error", "warn", "info", "debug", "minutia":
+		default:
+			check(false, "log.levels."+component+" must be error, warn, info, debug or minutia")
+		}
+	}
+
+	return errors.Join(errs...)
+}
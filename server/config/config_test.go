@@ -0,0 +1,73 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`
+server:
+  addr: ":9000"
+websocket:
+  pong_wait: 30s
+  send_buffer_size: 64
+rooms:
+  signed: [ops]
+  ttl:
+    secret: 1h
+`), 0o600)
+
+	t.Setenv("SECURECHAT_SEND_BUFFER_SIZE", "128")
+	t.Setenv("SECURECHAT_ADDR", ":9100")
+
+	cfg, err := config.Load([]string{"-config", path, "-addr", ":9200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.Addr != ":9200" {
+		t.Errorf("Flag should win over env and file, got %s", cfg.Server.Addr)
+	}
+	if cfg.WebSocket.SendBufferSize != 128 {
+		t.Errorf("Env should win over file, got %d", cfg.WebSocket.SendBufferSize)
+	}
+	if cfg.WebSocket.PongWait != 30*time.Second {
+		t.Errorf("File should win over defaults, got %s", cfg.WebSocket.PongWait)
+	}
+	if cfg.WebSocket.MaxMessageSize != config.Default().WebSocket.MaxMessageSize {
+		t.Errorf("Unset values should keep their default, got %d", cfg.WebSocket.MaxMessageSize)
+	}
+	if len(cfg.Rooms.Signed) != 1 || cfg.Rooms.Signed[0] != "ops" {
+		t.Errorf("Unexpected signed rooms %v", cfg.Rooms.Signed)
+	}
+	if cfg.Rooms.TTL["secret"] != time.Hour {
+		t.Errorf("Unexpected room ttls %v", cfg.Rooms.TTL)
+	}
+
+	cfg, err = config.Load([]string{"-room-ttl", "secret=5m, ops=1h"})
+	if err != nil || cfg.Rooms.TTL["secret"] != 5*time.Minute || cfg.Rooms.TTL["ops"] != time.Hour {
+		t.Errorf("Unexpected room ttls from flags %v %v", cfg.Rooms.TTL, err)
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	for _, args := range [][]string{
+		{"-send-buffer-size", "0"},
+		{"-redis-url", "http://cache:6379"},
+		{"-verbosity", "7"},
+		{"-pong-wait", "soon"},
+		{"-room-ttl", "secret=soon"},
+		{"-room-ttl", "secret=-1m"},
+		{"-rooms-driver", "postgres"},
+	} {
+		if _, err := config.Load(args); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
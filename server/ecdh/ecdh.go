@@ -7,38 +7,66 @@ import (
 	"github.com/FelineJTD/secure-chat-kripto/server/logger"
 )
 
-// Define the Point structure
+// Define the Point structure, X and Y are meaningless when Infinity is set
 type Point struct {
-	X *big.Int
-	Y *big.Int
+	X        *big.Int
+	Y        *big.Int
+	Infinity bool
 }
 
-// Define the Curve structure
+// The identity element of the group
+func PointAtInfinity() *Point {
+	return &Point{Infinity: true}
+}
+
+func (p *Point) IsInfinity() bool {
+	return p.Infinity
+}
+
+// Points are equal if both are infinity or their coordinates match
+func (p *Point) Equal(q *Point) bool {
+	if p.Infinity || q.Infinity {
+		return p.Infinity == q.Infinity
+	}
+	return p.X.Cmp(q.X) == 0 && p.Y.Cmp(q.Y) == 0
+}
+
+// Define the Curve structure, n is the order of g and h the cofactor
 type Curve struct {
-	a  *big.Int
-	b  *big.Int
-	p  *big.Int
-	g  Point
+	a *big.Int
+	b *big.Int
+	p *big.Int
+	g Point
+	n *big.Int
+	h *big.Int
 }
 
-// Initialize the curve parameters
+// Initialize the curve parameters. This is NIST P-521 (FIPS 186-4, D.1.2.5):
+// its order n is prime and published with the curve, so keys can be drawn
+// below n and Verify checks every parameter, cmd/curvecheck included.
 func NewCurve() *Curve {
 	p := new(big.Int)
-	p.SetString("501093B9D01F6A995131F06A99E971704FBED42E0260730567E466958EAF21A5ED4B8458626AFFC325C1172017291D86E8E6818AED1BC6D59AD1E773DD9F2401B577263802C21D82870008D37DB9C72122F4E190EBEA973382E5C18EB3DBFB565EAAB90B98EE880104767", 16)
+	p.SetString("1FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", 16)
 
+	// a = -3 mod p
 	a := new(big.Int)
-	a.SetString("4EB5DF9B1A22357A539C1F8EE0DBD02F8F5373C1F3DE064A2547D8DF185A0B9411BE82EB93FB61BA51C1EA46A35141B5BBC8083CD642B1F6419BD0263C61C6BA128EE64B224BCCE25A1794C30E20DBEEF8B163DC9662EC0739455849AD2AEAE67CCCDBC84968674D299BF", 16)
-	b := big.NewInt(0)
+	a.SetString("1FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFC", 16)
+	// b is not used by the group law, but point validation needs it
+	b := new(big.Int)
+	b.SetString("51953EB9618E1C9A1F929A21A0B68540EEA2DA725B99B315F3B8B489918EF109E156193951EC7E937B1652C0BD3BB1BF073573DF883D2C34F1EF451FD46B503F00", 16)
 
 	gx := new(big.Int)
-	gx.SetString("1471CFA725EB7FB877EC8F8DE8B3DD9E6F3B880BDD984289BB180E372968D6CDA1A667AF0B859FFC1A2700B8853541FF0416AC5D3C7B00EFDD550614B1956618413453C90E06ED4EC0060204CDC287F140B3153E161D078452734A03510532E3EABAE6E105FFFE2656D59", 16)
+	gx.SetString("C6858E06B70404E9CD9E3ECB662395B4429C648139053FB521F828AF606B4D3DBAA14B5E77EFE75928FE1DC127A2FFA8DE3348B3C1856A429BF97E7E31C2E5BD66", 16)
 
 	gy := new(big.Int)
-	gy.SetString("190AE1E86693B1EE024FE0811766A67437F43AE62FE6E431A83EC7ACE5BB5A58AB8C9D296A08622C8ED6572BC9F38B5FCF8FB883C8A8E673C483A978ED3C4A4D9D7CE8F0B7A732107EB4AF7EA85D99B9BDF7C465831A3FB76C8451AF68756E9E6B8FA95EF5A317EF4011F", 16)
+	gy.SetString("11839296A789A3BC0045C8A5FB42C7D1BD998F54449579B446817AFBD17273E662C97EE72995EF42640C550B9013FAD0761353C7086A272C24088BE94769FD16650", 16)
+
+	g := Point{X: gx, Y: gy}
 
-	g := Point{gx, gy}
+	n := new(big.Int)
+	n.SetString("1FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFA51868783BF2F966B7FCC0148F709A5D03BB5C9B8899C47AEBB6FB71E91386409", 16)
 
-	return &Curve{a, b, p, g}
+	return &Curve{a: a, b: b, p: p, g: g, n: n, h: big.NewInt(1)}
 }
 
 // Modular inverse: returns x such that (x * k) % p == 1
@@ -46,44 +74,53 @@ func modInverse(k, p *big.Int) *big.Int {
 	return new(big.Int).ModInverse(k, p)
 }
 
+// Point negation: R = -P
+func (curve *Curve) Neg(p *Point) *Point {
+	if p.Infinity {
+		return PointAtInfinity()
+	}
+	ry := new(big.Int).Neg(p.Y)
+	ry.Mod(ry, curve.p)
+	return &Point{X: new(big.Int).Set(p.X), Y: ry}
+}
+
 // Point addition: R = P + Q
 func (curve *Curve) Add(p, q *Point) *Point {
-	if p.X == nil && p.Y == nil {
+	if p.Infinity {
 		return q
 	}
-	if q.X == nil && q.Y == nil {
+	if q.Infinity {
 		return p
 	}
 
-	if p.X.Cmp(q.X) == 0 && p.Y.Cmp(new(big.Int).Neg(q.Y)) == 0 {
-		return &Point{nil, nil}
-	}
+	var slope *big.Int
+	if p.X.Cmp(q.X) == 0 {
+		// Same x means Q is either P or -P, P + (-P) and doubling with y = 0 give infinity
+		sumY := new(big.Int).Add(p.Y, q.Y)
+		if sumY.Mod(sumY, curve.p).Sign() == 0 {
+			return PointAtInfinity()
+		}
 
-	if p.X.Cmp(q.X) == 0 && p.Y.Cmp(q.Y) == 0 {
-		// Point doubling
+		// Point doubling: slope = (3x^2 + a) / 2y
 		dX := new(big.Int).Add(new(big.Int).Mul(big.NewInt(3), new(big.Int).Mul(p.X, p.X)), curve.a)
 		dY := new(big.Int).Mul(big.NewInt(2), p.Y)
-		inv := modInverse(dY, curve.p)
-		slope := new(big.Int).Mul(dX, inv)
-		slope_mod := new(big.Int).Mod(slope, curve.p)
-		rx := new(big.Int).Sub(new(big.Int).Mul(slope_mod, slope_mod), new(big.Int).Mul(big.NewInt(2), p.X))
-		rx.Mod(rx, curve.p)
-		ry := new(big.Int).Sub(new(big.Int).Mul(slope_mod, new(big.Int).Sub(p.X, rx)), p.Y)
-		ry.Mod(ry, curve.p)
-		return &Point{rx, ry}
+		slope = new(big.Int).Mul(dX, modInverse(dY.Mod(dY, curve.p), curve.p))
 	} else {
+		// slope = (y2 - y1) / (x2 - x1)
 		dX := new(big.Int).Sub(q.X, p.X)
 		dY := new(big.Int).Sub(q.Y, p.Y)
-		if dX.Cmp(big.NewInt(0)) == -1 {
-			dX.Neg(dX)
-			dY.Neg(dY)
-		}
-		inv := modInverse(dX, curve.p)
-		slope := new(big.Int).Mod(new(big.Int).Mul(dY, inv), curve.p)
-		rx := new(big.Int).Mod(new(big.Int).Sub(new(big.Int).Mul(slope, slope), new(big.Int).Add(p.X, q.X)), curve.p)
-		ry := new(big.Int).Mod(new(big.Int).Sub(new(big.Int).Mul(slope, new(big.Int).Sub(p.X, rx)), p.Y), curve.p)
-		return &Point{rx, ry}
+		slope = new(big.Int).Mul(dY, modInverse(dX.Mod(dX, curve.p), curve.p))
 	}
+	slope.Mod(slope, curve.p)
+
+	rx := new(big.Int).Mod(new(big.Int).Sub(new(big.Int).Mul(slope, slope), new(big.Int).Add(p.X, q.X)), curve.p)
+	ry := new(big.Int).Mod(new(big.Int).Sub(new(big.Int).Mul(slope, new(big.Int).Sub(p.X, rx)), p.Y), curve.p)
+	return &Point{X: rx, Y: ry}
+}
+
+// Point subtraction: R = P - Q
+func (curve *Curve) Sub(p, q *Point) *Point {
+	return curve.Add(p, curve.Neg(q))
 }
 
 // Point doubling: R = 2P
@@ -91,30 +128,34 @@ func (curve *Curve) Double(p *Point) *Point {
 	return curve.Add(p, p)
 }
 
-// Scalar multiplication: R = kP
+// Scalar multiplication: R = kP, negative k multiplies -P, k is left untouched
 func (curve *Curve) ScalarMult(k *big.Int, p *Point) *Point {
-	res := &Point{nil, nil}
+	res := PointAtInfinity()
 	addend := p
+	if k.Sign() < 0 {
+		k = new(big.Int).Neg(k)
+		addend = curve.Neg(p)
+	}
 
-	for k.Cmp(big.NewInt(0)) != 0 {
-		if new(big.Int).And(k, big.NewInt(1)).Cmp(big.NewInt(0)) != 0 {
+	for i := 0; i < k.BitLen(); i++ {
+		if k.Bit(i) != 0 {
 			res = curve.Add(res, addend)
 		}
 		addend = curve.Double(addend)
-		k.Rsh(k, 1)
 	}
 
 	return res
 }
 
-// Generate a private key
+// Generate a private key in [1, n-1]
 func GeneratePrivateKey(curve *Curve) *big.Int {
-	p := curve.p
-	d, err := rand.Int(rand.Reader, p)
+	max := new(big.Int).Sub(curve.n, big.NewInt(1))
+	d, err := rand.Int(rand.Reader, max)
 	if err != nil {
 		logger.HandleError(err)
+		return nil
 	}
-	return d
+	return d.Add(d, big.NewInt(1))
 }
 
 // Generate a public key
@@ -137,4 +178,4 @@ func GenerateSharedKey(privKey *big.Int, pubKey *Point) *big.Int {
 	copy := new(big.Int).Set(privKey)
 	sharedKey := curve.ScalarMult(copy, pubKey)
 	return sharedKey.X
-}
\ No newline at end of file
+}
@@ -0,0 +1,103 @@
+package ecdh_test
+
+import (
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/ecdh"
+)
+
+var curve = ecdh.NewCurve()
+
+// Random scalar for property tests, kept small so the tests stay fast
+type scalar struct {
+	k *big.Int
+}
+
+func (scalar) Generate(r *rand.Rand, size int) reflect.Value {
+	k := new(big.Int).Lsh(big.NewInt(r.Int63()), 64)
+	k.Add(k, new(big.Int).SetUint64(r.Uint64()))
+	return reflect.ValueOf(scalar{k})
+}
+
+// kG, a random point in the generator's subgroup
+func (s scalar) point() *ecdh.Point {
+	return ecdh.GeneratePublicKey(curve, s.k)
+}
+
+var quickConfig = &quick.Config{MaxCount: 20}
+
+func check(t *testing.T, f any) {
+	t.Helper()
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	check(t, func(a scalar) bool {
+		p := a.point()
+		inf := ecdh.PointAtInfinity()
+		return curve.Add(p, inf).Equal(p) && curve.Add(inf, p).Equal(p)
+	})
+}
+
+func TestInverse(t *testing.T) {
+	check(t, func(a scalar) bool {
+		p := a.point()
+		return curve.Add(p, curve.Neg(p)).IsInfinity() && curve.Sub(p, p).IsInfinity()
+	})
+}
+
+func TestCommutativity(t *testing.T) {
+	check(t, func(a, b scalar) bool {
+		p, q := a.point(), b.point()
+		return curve.Add(p, q).Equal(curve.Add(q, p))
+	})
+}
+
+func TestAssociativity(t *testing.T) {
+	check(t, func(a, b, c scalar) bool {
+		p, q, r := a.point(), b.point(), c.point()
+		return curve.Add(curve.Add(p, q), r).Equal(curve.Add(p, curve.Add(q, r)))
+	})
+}
+
+func TestScalarDistributivity(t *testing.T) {
+	check(t, func(a, b scalar) bool {
+		sum := new(big.Int).Add(a.k, b.k)
+		return scalar{sum}.point().Equal(curve.Add(a.point(), b.point()))
+	})
+
+	check(t, func(k, a, b scalar) bool {
+		p, q := a.point(), b.point()
+		lhs := curve.ScalarMult(k.k, curve.Add(p, q))
+		rhs := curve.Add(curve.ScalarMult(k.k, p), curve.ScalarMult(k.k, q))
+		return lhs.Equal(rhs)
+	})
+}
+
+func TestSubtraction(t *testing.T) {
+	check(t, func(a, b scalar) bool {
+		diff := new(big.Int).Sub(a.k, b.k)
+		return scalar{diff}.point().Equal(curve.Sub(a.point(), b.point()))
+	})
+}
+
+func TestResultsOnCurve(t *testing.T) {
+	check(t, func(a, b scalar) bool {
+		p, q := a.point(), b.point()
+		return curve.IsOnCurve(curve.Add(p, q)) && curve.IsOnCurve(curve.Double(p))
+	})
+}
+
+func TestScalarMultKeepsScalar(t *testing.T) {
+	k := big.NewInt(12345)
+	curve.ScalarMult(k, ecdh.GeneratePublicKey(curve, big.NewInt(1)))
+	if k.Cmp(big.NewInt(12345)) != 0 {
+		t.Error("ScalarMult modified its scalar")
+	}
+}
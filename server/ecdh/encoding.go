@@ -0,0 +1,222 @@
+package ecdh
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+// SEC1 point encoding prefixes
+const (
+	prefixInfinity     = 0x00
+	prefixEven         = 0x02
+	prefixOdd          = 0x03
+	prefixUncompressed = 0x04
+)
+
+var (
+	ErrInvalidEncoding = errors.New("ecdh: invalid point encoding")
+	ErrNotOnCurve      = errors.New("ecdh: point is not on the curve")
+	ErrInfinity        = errors.New("ecdh: point at infinity is not a valid key")
+)
+
+// The curve used by the encoding methods on Point
+var projectCurve = NewCurve()
+
+// Legacy JSON form of a point, coordinates as decimal strings
+type jsonPoint struct {
+	X string `json:"x"`
+	Y string `json:"y"`
+}
+
+// Size in bytes of a single encoded coordinate
+func (curve *Curve) byteLen() int {
+	return (curve.p.BitLen() + 7) / 8
+}
+
+// Check y^2 = x^3 + ax + b (mod p), coordinates must already be reduced
+func (curve *Curve) IsOnCurve(p *Point) bool {
+	if p.Infinity || p.X == nil || p.Y == nil {
+		return false
+	}
+	if p.X.Sign() < 0 || p.X.Cmp(curve.p) >= 0 || p.Y.Sign() < 0 || p.Y.Cmp(curve.p) >= 0 {
+		return false
+	}
+
+	lhs := new(big.Int).Mul(p.Y, p.Y)
+	lhs.Mod(lhs, curve.p)
+
+	return lhs.Cmp(curve.rhs(p.X)) == 0
+}
+
+// Right hand side of the curve equation: x^3 + ax + b (mod p)
+func (curve *Curve) rhs(x *big.Int) *big.Int {
+	r := new(big.Int).Mul(x, x)
+	r.Mul(r, x)
+	r.Add(r, new(big.Int).Mul(curve.a, x))
+	r.Add(r, curve.b)
+	return r.Mod(r, curve.p)
+}
+
+// Uncompressed SEC1 encoding: 0x04 || X || Y
+func (curve *Curve) Marshal(p *Point) []byte {
+	if p.Infinity {
+		return []byte{prefixInfinity}
+	}
+
+	size := curve.byteLen()
+	out := make([]byte, 1+2*size)
+	out[0] = prefixUncompressed
+	p.X.FillBytes(out[1 : 1+size])
+	p.Y.FillBytes(out[1+size:])
+	return out
+}
+
+// Compressed SEC1 encoding: 0x02/0x03 (parity of Y) || X
+func (curve *Curve) MarshalCompressed(p *Point) []byte {
+	if p.Infinity {
+		return []byte{prefixInfinity}
+	}
+
+	size := curve.byteLen()
+	out := make([]byte, 1+size)
+	out[0] = byte(prefixEven + p.Y.Bit(0))
+	p.X.FillBytes(out[1:])
+	return out
+}
+
+// Decode either SEC1 form, the result is always checked against the curve
+func (curve *Curve) Unmarshal(data []byte) (*Point, error) {
+	size := curve.byteLen()
+	if len(data) == 0 {
+		return nil, ErrInvalidEncoding
+	}
+
+	switch data[0] {
+	case prefixInfinity:
+		if len(data) != 1 {
+			return nil, ErrInvalidEncoding
+		}
+		return PointAtInfinity(), nil
+	case prefixUncompressed:
+		if len(data) != 1+2*size {
+			return nil, ErrInvalidEncoding
+		}
+		p := &Point{
+			X: new(big.Int).SetBytes(data[1 : 1+size]),
+			Y: new(big.Int).SetBytes(data[1+size:]),
+		}
+		if !curve.IsOnCurve(p) {
+			return nil, ErrNotOnCurve
+		}
+		return p, nil
+	case prefixEven, prefixOdd:
+		if len(data) != 1+size {
+			return nil, ErrInvalidEncoding
+		}
+		x := new(big.Int).SetBytes(data[1:])
+		if x.Cmp(curve.p) >= 0 {
+			return nil, ErrNotOnCurve
+		}
+		y := new(big.Int).ModSqrt(curve.rhs(x), curve.p)
+		if y == nil {
+			return nil, ErrNotOnCurve
+		}
+		if y.Bit(0) != uint(data[0]-prefixEven) {
+			y.Sub(curve.p, y)
+		}
+		return &Point{X: x, Y: y}, nil
+	default:
+		return nil, ErrInvalidEncoding
+	}
+}
+
+// Parse the legacy {"x": "...", "y": "..."} form with decimal coordinates
+func (curve *Curve) unmarshalLegacy(data []byte) (*Point, error) {
+	var jp jsonPoint
+	if err := json.Unmarshal(data, &jp); err != nil {
+		return nil, err
+	}
+
+	x, ok := new(big.Int).SetString(jp.X, 10)
+	if !ok {
+		return nil, ErrInvalidEncoding
+	}
+	y, ok := new(big.Int).SetString(jp.Y, 10)
+	if !ok {
+		return nil, ErrInvalidEncoding
+	}
+
+	// The TypeScript client writes infinity as (0, 0)
+	if x.Sign() == 0 && y.Sign() == 0 {
+		return PointAtInfinity(), nil
+	}
+
+	p := &Point{X: x, Y: y}
+	if !curve.IsOnCurve(p) {
+		return nil, ErrNotOnCurve
+	}
+	return p, nil
+}
+
+// Compressed SEC1 encoding on the project curve
+func (p Point) MarshalBinary() ([]byte, error) {
+	return projectCurve.MarshalCompressed(&p), nil
+}
+
+// Accepts both compressed and uncompressed SEC1 encodings
+func (p *Point) UnmarshalBinary(data []byte) error {
+	decoded, err := projectCurve.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	*p = *decoded
+	return nil
+}
+
+// Hex of the compressed encoding
+func (p Point) MarshalText() ([]byte, error) {
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, hex.EncodedLen(len(b)))
+	hex.Encode(out, b)
+	return out, nil
+}
+
+func (p *Point) UnmarshalText(text []byte) error {
+	b := make([]byte, hex.DecodedLen(len(text)))
+	if _, err := hex.Decode(b, text); err != nil {
+		return ErrInvalidEncoding
+	}
+	return p.UnmarshalBinary(b)
+}
+
+// Encoded as a JSON string holding the hex text form
+func (p Point) MarshalJSON() ([]byte, error) {
+	text, err := p.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// Takes the hex text form, or the legacy {"x", "y"} object
+func (p *Point) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		decoded, err := projectCurve.unmarshalLegacy(data)
+		if err != nil {
+			return err
+		}
+		*p = *decoded
+		return nil
+	}
+
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	return p.UnmarshalText([]byte(text))
+}
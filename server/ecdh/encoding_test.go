@@ -0,0 +1,61 @@
+package ecdh_test
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/ecdh"
+)
+
+func TestPointEncodingRoundTrip(t *testing.T) {
+	curve := ecdh.NewCurve()
+	_, pub := ecdh.GenerateKeyPair()
+
+	if !curve.IsOnCurve(pub) {
+		t.Fatal("Generated public key is not on the curve")
+	}
+
+	for name, encoded := range map[string][]byte{
+		"compressed":   curve.MarshalCompressed(pub),
+		"uncompressed": curve.Marshal(pub),
+	} {
+		decoded := &ecdh.Point{}
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if decoded.X.Cmp(pub.X) != 0 || decoded.Y.Cmp(pub.Y) != 0 {
+			t.Errorf("%s: decoded point does not match", name)
+		}
+	}
+
+	text, err := json.Marshal(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &ecdh.Point{}
+	if err := json.Unmarshal(text, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.X.Cmp(pub.X) != 0 || decoded.Y.Cmp(pub.Y) != 0 {
+		t.Error("JSON round trip does not match")
+	}
+}
+
+func TestPointLegacyJSON(t *testing.T) {
+	_, pub := ecdh.GenerateKeyPair()
+
+	legacy := `{"x": "` + pub.X.String() + `", "y": "` + pub.Y.String() + `"}`
+	decoded := &ecdh.Point{}
+	if err := json.Unmarshal([]byte(legacy), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.X.Cmp(pub.X) != 0 || decoded.Y.Cmp(pub.Y) != 0 {
+		t.Error("Legacy JSON does not match")
+	}
+
+	bad := `{"x": "` + pub.X.String() + `", "y": "` + new(big.Int).Add(pub.Y, big.NewInt(1)).String() + `"}`
+	if err := json.Unmarshal([]byte(bad), &ecdh.Point{}); err == nil {
+		t.Error("Point off the curve was accepted")
+	}
+}
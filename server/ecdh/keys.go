@@ -0,0 +1,58 @@
+package ecdh
+
+import (
+	"errors"
+	"log/slog"
+	"math/big"
+)
+
+var ErrInvalidPrivateKey = errors.New("ecdh: private key is outside [1, n-1]")
+
+// Key pair used for key agreement
+type PrivateKey struct {
+	D      *big.Int
+	Public *Point
+	curve  *Curve
+}
+
+// Generate a fresh key pair on the given curve
+func GenerateKey(curve *Curve) (*PrivateKey, error) {
+	d := GeneratePrivateKey(curve)
+	if d == nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	return &PrivateKey{D: d, Public: GeneratePublicKey(curve, d), curve: curve}, nil
+}
+
+// Rebuild a key pair from a stored private scalar
+func NewPrivateKey(curve *Curve, d *big.Int) (*PrivateKey, error) {
+	if d.Sign() <= 0 || d.Cmp(curve.n) >= 0 {
+		return nil, ErrInvalidPrivateKey
+	}
+	return &PrivateKey{D: new(big.Int).Set(d), Public: GeneratePublicKey(curve, d), curve: curve}, nil
+}
+
+// Only the public half ever reaches a log
+func (k *PrivateKey) LogValue() slog.Value {
+	return slog.GroupValue(slog.Any("public", k.Public))
+}
+
+func (k *PrivateKey) Curve() *Curve {
+	return k.curve
+}
+
+// ECDH: x coordinate of dQ, the peer's key is validated first
+func (k *PrivateKey) ECDH(pub *Point) (*big.Int, error) {
+	if pub.IsInfinity() {
+		return nil, ErrInfinity
+	}
+	if !k.curve.IsOnCurve(pub) {
+		return nil, ErrNotOnCurve
+	}
+
+	shared := k.curve.ScalarMult(k.D, pub)
+	if shared.IsInfinity() {
+		return nil, ErrInfinity
+	}
+	return shared.X, nil
+}
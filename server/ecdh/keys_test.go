@@ -0,0 +1,24 @@
+package ecdh
+
+import "testing"
+
+func TestECDHAgreement(t *testing.T) {
+	alice, _ := GenerateKey(projectCurve)
+	bob, _ := GenerateKey(projectCurve)
+
+	ab, err := alice.ECDH(bob.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, err := bob.ECDH(alice.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ab.Cmp(ba) != 0 {
+		t.Error("Shared secrets do not match")
+	}
+
+	if _, err := alice.ECDH(PointAtInfinity()); err == nil {
+		t.Error("Infinity accepted as a peer key")
+	}
+}
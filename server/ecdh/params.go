@@ -0,0 +1,79 @@
+package ecdh
+
+import (
+	"errors"
+	"math/big"
+)
+
+var (
+	ErrFieldNotPrime     = errors.New("ecdh: field modulus is not prime")
+	ErrSingularCurve     = errors.New("ecdh: curve discriminant is zero")
+	ErrCoefficientRange  = errors.New("ecdh: curve coefficient is not reduced mod p")
+	ErrGeneratorOffCurve = errors.New("ecdh: generator is not on the curve")
+	ErrOrderNotPrime     = errors.New("ecdh: group order is not prime")
+	ErrGeneratorOrder    = errors.New("ecdh: generator does not have order n")
+	ErrHasseBound        = errors.New("ecdh: h * n is outside the Hasse interval")
+)
+
+// Order n of the generator
+func (curve *Curve) Order() *big.Int {
+	return curve.n
+}
+
+// Cofactor h = #E / n
+func (curve *Curve) Cofactor() *big.Int {
+	return curve.h
+}
+
+// Copy of the curve with the given order and cofactor recorded, used to check candidates
+func (curve *Curve) WithOrder(n, h *big.Int) *Curve {
+	c := *curve
+	c.n = n
+	c.h = h
+	return &c
+}
+
+// Discriminant of the curve: -16(4a^3 + 27b^2) mod p
+func (curve *Curve) Discriminant() *big.Int {
+	a3 := new(big.Int).Exp(curve.a, big.NewInt(3), curve.p)
+	b2 := new(big.Int).Exp(curve.b, big.NewInt(2), curve.p)
+
+	d := new(big.Int).Add(a3.Mul(a3, big.NewInt(4)), b2.Mul(b2, big.NewInt(27)))
+	d.Mul(d, big.NewInt(-16))
+	return d.Mod(d, curve.p)
+}
+
+// Verify the domain parameters, returns the first check that fails
+func (curve *Curve) Verify() error {
+	if !curve.p.ProbablyPrime(32) {
+		return ErrFieldNotPrime
+	}
+	for _, c := range []*big.Int{curve.a, curve.b} {
+		if c.Sign() < 0 || c.Cmp(curve.p) >= 0 {
+			return ErrCoefficientRange
+		}
+	}
+	if curve.Discriminant().Sign() == 0 {
+		return ErrSingularCurve
+	}
+	if !curve.IsOnCurve(&curve.g) {
+		return ErrGeneratorOffCurve
+	}
+
+	if !curve.n.ProbablyPrime(32) {
+		return ErrOrderNotPrime
+	}
+	if !curve.ScalarMult(curve.n, &curve.g).IsInfinity() {
+		return ErrGeneratorOrder
+	}
+
+	// Hasse: |p + 1 - hn| <= 2 sqrt(p), compared squared to stay in integers
+	t := new(big.Int).Add(curve.p, big.NewInt(1))
+	t.Sub(t, new(big.Int).Mul(curve.h, curve.n))
+	t.Mul(t, t)
+	if t.Cmp(new(big.Int).Mul(curve.p, big.NewInt(4))) > 0 {
+		return ErrHasseBound
+	}
+
+	return nil
+}
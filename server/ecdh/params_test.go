@@ -0,0 +1,86 @@
+package ecdh
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// y^2 = x^3 + 2x + 11 over F_10007 has 10174 = 2 * 5087 points
+func toyCurve() *Curve {
+	return &Curve{
+		a: big.NewInt(2),
+		b: big.NewInt(11),
+		p: big.NewInt(10007),
+		g: Point{X: big.NewInt(5514), Y: big.NewInt(6230)},
+		n: big.NewInt(5087),
+		h: big.NewInt(2),
+	}
+}
+
+func TestVerifyToyCurve(t *testing.T) {
+	if err := toyCurve().Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[error]*Curve{
+		ErrGeneratorOrder: toyCurve().WithOrder(big.NewInt(5081), big.NewInt(2)),
+		ErrOrderNotPrime:  toyCurve().WithOrder(big.NewInt(10174), big.NewInt(1)),
+	}
+
+	singular := toyCurve()
+	singular.a, singular.b = big.NewInt(0), big.NewInt(0)
+	cases[ErrSingularCurve] = singular
+
+	offCurve := toyCurve()
+	offCurve.g.Y = big.NewInt(6231)
+	cases[ErrGeneratorOffCurve] = offCurve
+
+	for want, curve := range cases {
+		if err := curve.Verify(); !errors.Is(err, want) {
+			t.Errorf("Expected %v, got %v", want, err)
+		}
+	}
+}
+
+func TestVerifyHasseBound(t *testing.T) {
+	// 5087 is the right order for g, but a cofactor of 4 overshoots #E
+	if err := toyCurve().WithOrder(big.NewInt(5087), big.NewInt(4)).Verify(); !errors.Is(err, ErrHasseBound) {
+		t.Errorf("Expected %v, got %v", ErrHasseBound, err)
+	}
+}
+
+func TestVerifyProjectCurve(t *testing.T) {
+	curve := NewCurve()
+
+	if curve.Discriminant().Sign() == 0 {
+		t.Error("Project curve is singular")
+	}
+
+	if err := curve.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if curve.Order() == nil || curve.Cofactor().Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("Expected a recorded prime order and cofactor 1, got n=%v h=%v", curve.Order(), curve.Cofactor())
+	}
+}
+
+func TestProjectKeyRange(t *testing.T) {
+	curve := NewCurve()
+	for i := 0; i < 100; i++ {
+		d := GeneratePrivateKey(curve)
+		if d.Sign() <= 0 || d.Cmp(curve.Order()) >= 0 {
+			t.Fatalf("Private key %v outside [1, n-1]", d)
+		}
+	}
+}
+
+func TestPrivateKeyRange(t *testing.T) {
+	curve := toyCurve()
+	for i := 0; i < 1000; i++ {
+		d := GeneratePrivateKey(curve)
+		if d.Sign() <= 0 || d.Cmp(curve.n) >= 0 {
+			t.Fatalf("Private key %v outside [1, n-1]", d)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+)
+
+// Envelope types
+const (
+	envelopeMessage  = "message"
+	envelopeError    = "error"
+	envelopeFile     = "file"     // A chat message carrying an uploaded File
+	envelopeTyping   = "typing"   // Sender is typing, relayed to the room
+	envelopeStatus   = "status"   // Client sets its own status, online or away
+	envelopePresence = "presence" // Server reports Sender joined, left, went away or came back
+	envelopeGap      = "gap"      // Server dropped Missed messages the client was too slow to take
+	envelopeRoomKey  = "room_key" // Server hands over the Key the room's broadcasts are sealed with
+	envelopeEdit     = "edit"     // Sender replaces the Message of the message Ref
+	envelopeDelete   = "delete"   // Sender removes the message Ref, leaving a tombstone
+	envelopeReact    = "react"    // Sender adds the emoji Reaction to the message Ref
+	envelopeUnreact  = "unreact"  // Sender takes its Reaction back
+)
+
+// Frame exchanged with the clients once the session encryption is removed.
+// Message is end-to-end encrypted, the server only ever relays it.
+type Envelope struct {
+	Type     string `json:"type,omitempty"`
+	ID       string `json:"id,omitempty"`  // Set by the server on chat messages it keeps
+	Ref      string `json:"ref,omitempty"` // Message an edit, delete or reaction applies to
+	Reaction string `json:"reaction,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Sign     string `json:"sign,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Missed   int    `json:"missed,omitempty"`
+	Key      string `json:"key,omitempty"`
+	File     *File  `json:"file,omitempty"`
+
+	// Seconds the sender wants a message kept, at most the room's ttl
+	TTL int `json:"ttl,omitempty"`
+
+	// When the message disappears, clients should drop their copies then
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// An uploaded file, as sent to the room. The server only reads ID, Key has to
+// be end-to-end encrypted for the recipients like Message is.
+type File struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Type string `json:"type,omitempty"` // MIME type
+	Size int64  `json:"size,omitempty"` // Bytes before encryption
+	Hash string `json:"hash,omitempty"` // SHA-256 of the plaintext, hex encoded, for recipients to check
+	Key  string `json:"key,omitempty"`  // Per file key the chunks are encrypted under
+}
+
+func parseEnvelope(data []byte) (*Envelope, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, err
+	}
+	if env.Type == "" {
+		env.Type = envelopeMessage
+	}
+	return env, nil
+}
+
+func errorFrame(err error) []byte {
+	frame, _ := json.Marshal(Envelope{Type: envelopeError, Error: err.Error()})
+	return frame
+}
+
+func gapFrame(missed int) []byte {
+	frame, _ := json.Marshal(Envelope{Type: envelopeGap, Missed: missed})
+	return frame
+}
+
+func roomKeyFrame(key logger.Secret) []byte {
+	frame, _ := json.Marshal(Envelope{Type: envelopeRoomKey, Key: key.Reveal()})
+	return frame
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/history"
+)
+
+// Time as the sweeper sees it, so tests can move it along
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Purge expired messages from history every interval until ctx is done
+func sweepHistory(ctx context.Context, store history.Store, interval time.Duration, clk clock) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(interval):
+		}
+
+		n, err := store.Expire(ctx, clk.Now())
+		if err != nil {
+			hubLog.Error("history sweep failed", "err", err)
+		} else if n > 0 {
+			hubLog.Debug("expired messages purged", "count", n)
+		}
+	}
+}
+
+// Leave out messages that expired while they waited in an offline queue
+func unexpired(messages [][]byte, now time.Time) [][]byte {
+	var kept [][]byte
+	for _, message := range messages {
+		var env Envelope
+		if json.Unmarshal(message, &env) == nil && env.Expires != nil && !now.Before(*env.Expires) {
+			continue
+		}
+		kept = append(kept, message)
+	}
+	return kept
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/history"
+)
+
+// A clock that only moves when told to
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan struct{} // Signalled whenever someone starts waiting
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now(), waiting: make(chan struct{}, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	t := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.mu.Unlock()
+	c.waiting <- struct{}{}
+	return t.c
+}
+
+// Move the clock on, firing every timer that came due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// Block until the sweeper waits for its next tick, done with the last one
+func (c *fakeClock) sleeping(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sweeper never waited")
+	}
+}
+
+func TestSweepHistory(t *testing.T) {
+	store := history.NewMemory(10)
+	clk := newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, _ := store.Append(ctx, history.Message{Room: "secret", ExpiresAt: clk.Now().Add(time.Minute)})
+	kept, _ := store.Append(ctx, history.Message{Room: "secret"})
+
+	go sweepHistory(ctx, store, 10*time.Second, clk)
+	clk.sleeping(t)
+
+	clk.Advance(30 * time.Second)
+	clk.sleeping(t)
+	if _, err := store.Get(ctx, "secret", m.ID); err != nil {
+		t.Fatalf("Message purged before it expired: %v", err)
+	}
+
+	clk.Advance(40 * time.Second)
+	clk.sleeping(t)
+	if _, err := store.Get(ctx, "secret", m.ID); !errors.Is(err, history.ErrNotFound) {
+		t.Errorf("Expected the message to be purged once expired, got %v", err)
+	}
+	if _, err := store.Get(ctx, "secret", kept.ID); err != nil {
+		t.Errorf("Message without a ttl was purged: %v", err)
+	}
+}
+
+func TestRecordExpiry(t *testing.T) {
+	cfg := config.Default()
+	cfg.Rooms.TTL = map[string]time.Duration{"secret": time.Hour}
+	hub := newTestHub(cfg, bus.NewMemory())
+
+	cases := []struct {
+		room string
+		ttl  int
+		want time.Duration
+	}{
+		{"secret", 0, time.Hour},
+		{"secret", 60, time.Minute},
+		{"secret", 7200, time.Hour}, // Senders cannot keep it longer than the room does
+		{defaultRoom, 60, time.Minute},
+		{defaultRoom, 0, 0},
+	}
+	for _, tc := range cases {
+		c := &Client{hub: hub, address: "test:alice", id: "alice", room: tc.room}
+		before := time.Now()
+		var env Envelope
+		json.Unmarshal(c.record(&Envelope{Type: envelopeMessage, Message: "hi", TTL: tc.ttl}), &env)
+
+		if env.TTL != 0 {
+			t.Errorf("%s/%d: ttl relayed", tc.room, tc.ttl)
+		}
+		if tc.want == 0 {
+			if env.Expires != nil {
+				t.Errorf("%s/%d: expected no expiry, got %v", tc.room, tc.ttl, env.Expires)
+			}
+			continue
+		}
+		if env.Expires == nil || env.Expires.Before(before.Add(tc.want)) || env.Expires.After(time.Now().Add(tc.want)) {
+			t.Errorf("%s/%d: expected expiry in %v, got %v", tc.room, tc.ttl, tc.want, env.Expires)
+		}
+		m, err := hub.history.Get(context.Background(), tc.room, env.ID)
+		if err != nil || !m.ExpiresAt.Equal(*env.Expires) {
+			t.Errorf("%s/%d: history expiry %v, %v", tc.room, tc.ttl, m.ExpiresAt, err)
+		}
+	}
+}
+
+func TestUnexpired(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Second), now.Add(time.Minute)
+	gone, _ := json.Marshal(Envelope{Message: "gone", Expires: &past})
+	kept, _ := json.Marshal(Envelope{Message: "kept", Expires: &future})
+
+	got := unexpired([][]byte{gone, kept, []byte("not an envelope")}, now)
+	if len(got) != 2 || string(got[0]) != string(kept) {
+		t.Errorf("Expected only the expired message left out, got %q", got)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/blob"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+	"github.com/FelineJTD/secure-chat-kripto/server/ratelimit"
+)
+
+// How often uploads past files.ttl are looked for
+const filesSweepInterval = time.Hour
+
+var (
+	errNoFile         = errors.New("file message needs an uploaded file")
+	errIncompleteFile = errors.New("file upload is not complete")
+)
+
+// Counts chunks a session starts uploading against quota for ttl, false once
+// they would go over it
+type UploadQuota func(address string, chunks, quota int, ttl time.Duration) (bool, error)
+
+// An upload as reported to the uploader and recipients. Missing lists the
+// chunks still to upload, a resumed upload only sends those.
+type fileStatus struct {
+	blob.Manifest
+	ChunkSize int   `json:"chunk_size"`
+	Missing   []int `json:"missing"`
+	Complete  bool  `json:"complete"`
+}
+
+func status(m blob.Manifest, stored []bool, chunkSize int) fileStatus {
+	s := fileStatus{Manifest: m, ChunkSize: chunkSize, Missing: []int{}, Complete: blob.Complete(stored)}
+	for i, ok := range stored {
+		if !ok {
+			s.Missing = append(s.Missing, i)
+		}
+	}
+	return s
+}
+
+// Uploads in a local directory unless a single instance is enough
+func newFiles(cfg config.Files) (blob.Store, error) {
+	if cfg.Driver == "memory" {
+		return blob.NewMemory(), nil
+	}
+	return blob.NewDisk(cfg.Dir)
+}
+
+// Delete uploads older than ttl until ctx is done
+func expireFiles(ctx context.Context, store blob.Store, ttl time.Duration) {
+	ticker := time.NewTicker(filesSweepInterval)
+	defer ticker.Stop()
+	for {
+		n, err := store.Expire(ctx, time.Now().Add(-ttl))
+		if err != nil {
+			httpLog.Error("expiring files failed", "err", err)
+		} else if n > 0 {
+			httpLog.Info("expired files", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// A file message is only relayed once the recipients can fetch all of it.
+func (c *Client) checkFile(env *Envelope) error {
+	if env.File == nil || !blob.ValidID(env.File.ID) || c.hub.files == nil {
+		return errNoFile
+	}
+	_, stored, err := c.hub.files.Stat(context.Background(), env.File.ID)
+	if err != nil {
+		return errNoFile
+	}
+	if !blob.Complete(stored) {
+		return errIncompleteFile
+	}
+	return nil
+}
+
+// Who uploads are counted against, the session or, outside one, the IP
+func uploader(r *http.Request) string {
+	if address, _ := middlewares.Session(r.Context()); address != "" {
+		return address
+	}
+	return middlewares.ClientIP(r)
+}
+
+func fileError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, blob.ErrNotFound), errors.Is(err, blob.ErrNoChunk):
+		middlewares.WriteError(w, r, http.StatusNotFound, "file_not_found", "no such file or chunk")
+	case errors.Is(err, blob.ErrExists):
+		middlewares.WriteError(w, r, http.StatusConflict, "chunk_exists", "chunk already uploaded")
+	default:
+		httpLog.Error("file store failed", "request_id", middleware.GetReqID(r.Context()), "err", err)
+		middlewares.WriteError(w, r, http.StatusInternalServerError, "internal", "internal server error")
+	}
+}
+
+// Routes under /files. Chunks are encrypted by the sender with a key only the
+// recipients get, the id is all it takes to upload to or fetch a file.
+// Uploading is rate limited per session, which may only start uploads for
+// cfg.Quota chunks within cfg.TTL.
+func fileRoutes(store blob.Store, cfg config.Files, limit *ratelimit.Keyed, reserve UploadQuota) http.Handler {
+	r := chi.NewRouter()
+	limited := r.With(middlewares.RateLimitBy(limit, "uploads", uploader))
+
+	// Start an upload of {"chunks": n}
+	limited.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Chunks int `json:"chunks"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil || req.Chunks < 1 {
+			middlewares.WriteError(w, r, http.StatusBadRequest, "bad_request", `body must be {"chunks": n} with n at least 1`)
+			return
+		}
+		if req.Chunks > cfg.MaxChunks {
+			middlewares.WriteError(w, r, http.StatusRequestEntityTooLarge, "too_many_chunks", fmt.Sprintf("files are at most %d chunks", cfg.MaxChunks))
+			return
+		}
+		ok, err := reserve(uploader(r), req.Chunks, cfg.Quota, cfg.TTL)
+		if err != nil {
+			fileError(w, r, err)
+			return
+		}
+		if !ok {
+			middlewares.WriteError(w, r, http.StatusTooManyRequests, "quota_exceeded", fmt.Sprintf("upload quota of %d chunks used up, try again later", cfg.Quota))
+			return
+		}
+
+		m := blob.Manifest{ID: blob.NewID(), Chunks: req.Chunks, CreatedAt: time.Now().UTC()}
+		if err := store.Create(r.Context(), m); err != nil {
+			fileError(w, r, err)
+			return
+		}
+		httpLog.Info("upload started", "file", m.ID, "chunks", m.Chunks, "remote", r.RemoteAddr)
+		writeJSON(w, http.StatusCreated, status(m, make([]bool, m.Chunks), cfg.ChunkSize))
+	})
+
+	r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		m, stored, err := store.Stat(r.Context(), chi.URLParam(r, "id"))
+		if err != nil {
+			fileError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status(m, stored, cfg.ChunkSize))
+	})
+
+	limited.Put("/{id}/chunks/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(chi.URLParam(r, "n"))
+		if err != nil {
+			fileError(w, r, blob.ErrNoChunk)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(cfg.ChunkSize)))
+		if err != nil {
+			middlewares.WriteError(w, r, http.StatusRequestEntityTooLarge, "chunk_too_large", fmt.Sprintf("chunks are at most %d bytes", cfg.ChunkSize))
+			return
+		}
+
+		if err := store.Put(r.Context(), chi.URLParam(r, "id"), n, data); err != nil {
+			fileError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Get("/{id}/chunks/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(chi.URLParam(r, "n"))
+		if err != nil {
+			fileError(w, r, blob.ErrNoChunk)
+			return
+		}
+		data, err := store.Get(r.Context(), chi.URLParam(r, "id"), n)
+		if err != nil {
+			fileError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	})
+
+	return r
+}
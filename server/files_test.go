@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/blob"
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+	"github.com/FelineJTD/secure-chat-kripto/server/providers"
+	"github.com/FelineJTD/secure-chat-kripto/server/ratelimit"
+)
+
+// Serves h for the test, do sends a request to it with header name, value pairs
+func serveFiles(t *testing.T, h http.Handler) (do func(method, path, body string, header ...string) *http.Response) {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	return func(method, path, body string, header ...string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+}
+
+// Errors come as JSON with a code
+func errorCode(resp *http.Response) string {
+	var e middlewares.ErrorBody
+	json.NewDecoder(resp.Body).Decode(&e)
+	return e.Code
+}
+
+// Quota that always has room
+func unlimited(string, int, int, time.Duration) (bool, error) { return true, nil }
+
+func TestFileUploadAndResume(t *testing.T) {
+	cfg := config.Default().Files
+	cfg.ChunkSize = 8
+	cfg.MaxChunks = 4
+	do := serveFiles(t, fileRoutes(blob.NewMemory(), cfg, ratelimit.NewKeyed(config.Limit{}), unlimited))
+
+	if resp := do("POST", "/", `{"chunks": 5}`); resp.StatusCode != http.StatusRequestEntityTooLarge || errorCode(resp) != "too_many_chunks" {
+		t.Errorf("Expected too many chunks to be refused, got %d", resp.StatusCode)
+	}
+	resp := do("POST", "/", `{"chunks": 2}`)
+	var created fileStatus
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload not started: %d %v", resp.StatusCode, err)
+	}
+	base := "/" + created.ID
+
+	if resp := do("PUT", base+"/chunks/1", "world"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Chunk not stored: %d", resp.StatusCode)
+	}
+	if resp := do("PUT", base+"/chunks/1", "again"); resp.StatusCode != http.StatusConflict || errorCode(resp) != "chunk_exists" {
+		t.Errorf("Expected a stored chunk to stay as it is, got %d", resp.StatusCode)
+	}
+	if resp := do("PUT", base+"/chunks/0", "much too long"); resp.StatusCode != http.StatusRequestEntityTooLarge || errorCode(resp) != "chunk_too_large" {
+		t.Errorf("Expected an oversized chunk to be refused, got %d", resp.StatusCode)
+	}
+
+	// What an interrupted upload sees when it comes back
+	var s fileStatus
+	json.NewDecoder(do("GET", base, "").Body).Decode(&s)
+	if s.Complete || len(s.Missing) != 1 || s.Missing[0] != 0 || s.ChunkSize != 8 {
+		t.Fatalf("Unexpected status %+v", s)
+	}
+	do("PUT", base+"/chunks/0", "hello")
+	json.NewDecoder(do("GET", base, "").Body).Decode(&s)
+	if !s.Complete {
+		t.Fatalf("Expected the upload to be complete, got %+v", s)
+	}
+
+	resp = do("GET", base+"/chunks/0", "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("Expected the chunk, got %d %q", resp.StatusCode, body)
+	}
+	if resp := do("GET", base+"/chunks/2", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a chunk past the end to be missing, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/0123", ""); resp.StatusCode != http.StatusNotFound || errorCode(resp) != "file_not_found" {
+		t.Errorf("Expected an unknown upload to be missing, got %d", resp.StatusCode)
+	}
+}
+
+func TestFileUploadLimits(t *testing.T) {
+	providers.Setup(config.Redis{URL: "redis://" + miniredis.RunT(t).Addr()})
+	cfg := config.Default().Files
+	cfg.MaxChunks = 4
+	cfg.Quota = 4
+	limit := ratelimit.NewKeyed(config.Limit{Rate: 0.001, Burst: 4})
+	do := serveFiles(t, fileRoutes(blob.NewMemory(), cfg, limit, handlers.ReserveUploads))
+
+	var created fileStatus
+	json.NewDecoder(do("POST", "/", `{"chunks": 3}`).Body).Decode(&created)
+	if resp := do("POST", "/", `{"chunks": 2}`); resp.StatusCode != http.StatusTooManyRequests || errorCode(resp) != "quota_exceeded" {
+		t.Errorf("Expected the quota to be used up, got %d", resp.StatusCode)
+	}
+	if resp := do("POST", "/", `{"chunks": 1}`); resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected what is left of the quota to be usable, got %d", resp.StatusCode)
+	}
+
+	// Every upload request takes a token, fetching does not
+	if resp := do("PUT", "/"+created.ID+"/chunks/0", "hello"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Chunk not stored: %d", resp.StatusCode)
+	}
+	if resp := do("PUT", "/"+created.ID+"/chunks/1", "world"); resp.StatusCode != http.StatusTooManyRequests || errorCode(resp) != "rate_limited" {
+		t.Errorf("Expected uploads to be rate limited, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/"+created.ID+"/chunks/0", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected downloads to go on, got %d", resp.StatusCode)
+	}
+}
+
+func TestFileMessageNeedsCompleteUpload(t *testing.T) {
+	hub := newTestHub(config.Default(), bus.NewMemory())
+	c := &Client{hub: hub, id: "alice", room: defaultRoom}
+	ctx := context.Background()
+
+	m := blob.Manifest{ID: blob.NewID(), Chunks: 2}
+	hub.files.Create(ctx, m)
+	hub.files.Put(ctx, m.ID, 0, []byte("half"))
+
+	cases := []struct {
+		name string
+		file *File
+		want error
+	}{
+		{"no file", nil, errNoFile},
+		{"unknown", &File{ID: blob.NewID()}, errNoFile},
+		{"incomplete", &File{ID: m.ID}, errIncompleteFile},
+	}
+	for _, tc := range cases {
+		if err := c.checkFile(&Envelope{Type: envelopeFile, File: tc.file}); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	hub.files.Put(ctx, m.ID, 1, []byte("rest"))
+	if err := c.checkFile(&Envelope{Type: envelopeFile, File: &File{ID: m.ID}}); err != nil {
+		t.Errorf("Complete upload refused: %v", err)
+	}
+}
+
+func TestFullChunkThroughEncrypted(t *testing.T) {
+	hub, mr, _ := newAdminHub(t)
+	hub.cfg.Files.ChunkSize = 1024
+	alice := apiClient{t, setupRoutes(hub, hub.cfg), login(mr, "alice")}
+
+	code, data := alice.send("POST", "/files/", []byte(`{"chunks": 1}`))
+	var started fileStatus
+	if err := json.Unmarshal(data, &started); code != http.StatusCreated || err != nil {
+		t.Fatalf("Upload not started: %d %s", code, data)
+	}
+
+	chunk := []byte(strings.Repeat("x", hub.cfg.Files.ChunkSize))
+	if code, data := alice.send("PUT", "/files/"+started.ID+"/chunks/0", chunk); code != http.StatusNoContent {
+		t.Fatalf("Expected a chunk of chunk_size to be taken, got %d %s", code, data)
+	}
+	if code, data := alice.send("GET", "/files/"+started.ID+"/chunks/0", nil); code != http.StatusOK || string(data) != string(chunk) {
+		t.Errorf("Expected the chunk back, got %d with %d bytes", code, len(data))
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/nart4hire/goblockc"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+)
+
+// Session ciphers kept across connections, an arbitrary one is evicted past this
+const cachedCiphers = 16384
+
+var (
+	errShortKey        = errors.New("key shorter than 16 bytes")
+	errShortCiphertext = errors.New("ciphertext shorter than its nonce")
+)
+
+// A session's cipher, built once from the hex encoded key instead of per message.
+// Every message is encrypted with CTR from a fresh random nonce, sent in front of
+// the ciphertext, so no two messages under a key share keystream. Safe for
+// concurrent use.
+type Cipher struct {
+	block cipher.Block
+	mac   []byte // HMAC key, derived so the key itself never authenticates anything
+}
+
+func NewCipher(key logger.Secret) (*Cipher, error) {
+	k, err := hex.DecodeString(key.Reveal())
+	if err != nil {
+		return nil, err
+	}
+	if len(k) < 16 {
+		return nil, errShortKey
+	}
+
+	block, err := goblockc.NewBlock(k[:16])
+	if err != nil {
+		return nil, err
+	}
+	mac := sha256.Sum256(append([]byte("mac:"), k...))
+	return &Cipher{block: block, mac: mac[:]}, nil
+}
+
+// XOR data with the keystream CTR yields from nonce
+func (c *Cipher) xor(nonce, data []byte) ([]byte, error) {
+	ctr, err := goblockc.NewCTR(c.block, nonce)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	ctr.XORKeyStream(out, data)
+	return out, nil
+}
+
+// Ciphertext is the hex encoded nonce followed by the encrypted plaintext
+func (c *Cipher) Encrypt(plaintext []byte) (string, error) {
+	nonce := make([]byte, c.block.BlockSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	ciphertext, err := c.xor(nonce, plaintext)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(append(nonce, ciphertext...)), nil
+}
+
+func (c *Cipher) Decrypt(ciphertext string) ([]byte, error) {
+	data, err := hex.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	n := c.block.BlockSize()
+	if len(data) < n {
+		return nil, errShortCiphertext
+	}
+	return c.xor(data[:n], data[n:])
+}
+
+// CTR alone lets anyone flip bits of a ciphertext, Sign tags what was sent
+// so the other side can tell. The tag is hex encoded.
+func (c *Cipher) Sign(data []byte) string {
+	h := hmac.New(sha256.New, c.mac)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cipher) Verify(data []byte, tag string) bool {
+	given, err := hex.DecodeString(tag)
+	if err != nil {
+		return false
+	}
+	h := hmac.New(sha256.New, c.mac)
+	h.Write(data)
+	return hmac.Equal(h.Sum(nil), given)
+}
+
+// Keep the key schedule out of logs
+func (*Cipher) LogValue() slog.Value {
+	return slog.StringValue("[REDACTED]")
+}
+
+func (*Cipher) String() string {
+	return "[REDACTED]"
+}
+
+func (c *Cipher) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, c.String())
+}
+
+// Ciphers by address, with the key each was built from so a new handshake replaces it
+type cachedCipher struct {
+	key    logger.Secret
+	cipher *Cipher
+}
+
+var (
+	ciphersMu sync.Mutex
+	ciphers   = map[string]cachedCipher{}
+)
+
+// Cached cipher for address and key, built when the handshake stored a different one
+func cipherFor(address string, key logger.Secret) (*Cipher, error) {
+	ciphersMu.Lock()
+	defer ciphersMu.Unlock()
+	if cached, ok := ciphers[address]; ok && cached.key == key {
+		return cached.cipher, nil
+	}
+
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphers) >= cachedCiphers {
+		for evict := range ciphers {
+			delete(ciphers, evict)
+			break
+		}
+	}
+	ciphers[address] = cachedCipher{key: key, cipher: c}
+	return c, nil
+}
+
+func forgetCipher(address string) {
+	ciphersMu.Lock()
+	defer ciphersMu.Unlock()
+	delete(ciphers, address)
+}
+
+// Cipher for the session key stored at handshake. The key is looked up every
+// time so a revoked or renewed session is noticed, the cipher is reused.
+func SessionCipher(address string) (*Cipher, error) {
+	key, err := GetSharedKey(address)
+	if err != nil {
+		return nil, err
+	}
+	return cipherFor(address, key)
+}
+
+// Cipher and user of the session at address. The user is only given for
+// sessions that signed their handshake with the key bound to the name, the
+// name alone proves nothing.
+func SessionOf(address string) (*Cipher, string, error) {
+	c, err := SessionCipher(address)
+	if err != nil {
+		return nil, "", err
+	}
+	user, err := GetSessionUser(address)
+	if err != nil {
+		return nil, "", err
+	}
+	verifyKey, err := GetVerifyKey(address)
+	if err != nil || verifyKey == "" {
+		return c, "", err
+	}
+	return c, user, nil
+}
@@ -0,0 +1,136 @@
+package handlers_test
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nart4hire/goblockc"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+)
+
+const testKey logger.Secret = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// The construction clients use: a random nonce, then CTR from it over the message
+func reference(t testing.TB, ciphertext string) string {
+	k, _ := hex.DecodeString(testKey.Reveal())
+	block, err := goblockc.NewBlock(k[:16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hex.DecodeString(ciphertext)
+	if err != nil || len(data) < block.BlockSize() {
+		t.Fatalf("Malformed ciphertext %q", ciphertext)
+	}
+	ctr, err := goblockc.NewCTR(block, data[:block.BlockSize()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := data[block.BlockSize():]
+	ctr.XORKeyStream(out, out)
+	return string(out)
+}
+
+func TestCipherMatchesProtocol(t *testing.T) {
+	c, err := handlers.NewCipher(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{0, 1, 15, 16, 17, 1000, 70_000, 5} {
+		plaintext := strings.Repeat("x", n)
+
+		got, err := c.Encrypt([]byte(plaintext))
+		if err != nil || reference(t, got) != plaintext {
+			t.Fatalf("Length %d does not open as clients open it, err %v", n, err)
+		}
+		if old, _ := handlers.Encrypt(testKey, plaintext); reference(t, old) != plaintext {
+			t.Fatalf("Length %d does not open as clients open it when encrypted by Encrypt", n)
+		}
+
+		decrypted, err := c.Decrypt(got)
+		if err != nil || string(decrypted) != plaintext {
+			t.Fatalf("Length %d did not round trip, err %v", n, err)
+		}
+	}
+
+	if _, err := c.Decrypt("00ff"); err == nil {
+		t.Error("Decrypted a ciphertext shorter than a nonce")
+	}
+}
+
+// The same message twice must not be XORed with the same keystream
+func TestCipherFreshNonce(t *testing.T) {
+	c, _ := handlers.NewCipher(testKey)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		ciphertext, _ := c.Encrypt([]byte("same message"))
+		if seen[ciphertext[:32]] {
+			t.Fatal("Nonce reused")
+		}
+		seen[ciphertext[:32]] = true
+	}
+}
+
+func TestCipherConcurrent(t *testing.T) {
+	c, _ := handlers.NewCipher(testKey)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		plaintext := strings.Repeat("y", i*300)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				got, _ := c.Encrypt([]byte(plaintext))
+				if decrypted, err := c.Decrypt(got); err != nil || string(decrypted) != plaintext {
+					t.Errorf("Length %d did not round trip", len(plaintext))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCipherSign(t *testing.T) {
+	c, _ := handlers.NewCipher(testKey)
+	other, _ := handlers.NewCipher(logger.Secret(strings.Repeat("ff", 32)))
+	tag := c.Sign([]byte("body"))
+
+	if !c.Verify([]byte("body"), tag) {
+		t.Error("Tag does not verify")
+	}
+	if c.Verify([]byte("bodY"), tag) || other.Verify([]byte("body"), tag) || c.Verify([]byte("body"), "zz") {
+		t.Error("Tag verified what it was not made for")
+	}
+}
+
+func TestCipherRedacted(t *testing.T) {
+	c, _ := handlers.NewCipher(testKey)
+	var b strings.Builder
+	slog.New(slog.NewTextHandler(&b, nil)).Info("cipher", "cipher", c)
+	fmt.Fprintf(&b, "%v %+v %#v", c, c, c)
+	if got := strings.ReplaceAll(b.String(), "[REDACTED]", ""); strings.ContainsAny(got, "{}[]") {
+		t.Errorf("Cipher state leaked: %s", b.String())
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	message := strings.Repeat("m", 256)
+	b.Run("per-call", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			handlers.Encrypt(testKey, message)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		c, _ := handlers.NewCipher(testKey)
+		for i := 0; i < b.N; i++ {
+			c.Encrypt([]byte(message))
+		}
+	})
+}
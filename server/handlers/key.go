@@ -1,37 +1,43 @@
 package handlers
 
 import (
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"math/big"
+	"errors"
+	"fmt"
+	"time"
 
-	"github.com/nart4hire/goblockc"
 	"github.com/nart4hire/goschnorr"
 
 	"github.com/gomodule/redigo/redis"
 
 	"github.com/FelineJTD/secure-chat-kripto/server/ecdh"
 	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
 	"github.com/FelineJTD/secure-chat-kripto/server/providers"
 )
 
+var log = logger.For("handlers")
+
+// Why a handshake failed, errors are wrapped in one of these along with their cause
 var (
-	PrivKey *big.Int
-	PubKey *ecdh.Point
-	Schnorr schnorr.Schnorr
+	ErrInvalidKey       = errors.New("invalid key")               // The client's key cannot be used
+	ErrStoreUnavailable = errors.New("session store unavailable") // Redis failed, the handshake may be tried again
 )
 
-func init() {
-	priv, pub := ecdh.GenerateKeyPair()
-	PrivKey = priv
-	PubKey = pub
+var (
+	Key     *ecdh.PrivateKey // Server key pair for key agreement
+	PubKey  *ecdh.Point
+	Schnorr schnorr.Schnorr // Set by LoadSchnorr
+)
 
-	if schnorr, err := schnorr.NewSchnorr(rand.Reader, sha256.New()); err != nil {
-		logger.HandleFatal(err) // Fatal, because always needed
-	} else {
-		Schnorr = schnorr
+func init() {
+	key, err := ecdh.GenerateKey(ecdh.NewCurve())
+	if err != nil {
+		logger.HandleFatal(err)
 	}
+	Key = key
+	PubKey = key.Public
 }
 
 // func StringToPubKey(pubkey string) (*ecdh.PublicKey, error) {
@@ -60,26 +66,48 @@ func init() {
 // 		})), nil
 // }
 
-// Generate Using Hash function and PRNG
-func GenerateKey(address string, pubkey *ecdh.Point) (string, error) {
+// Generate Using Hash function and PRNG, stored with the user the session is for
+func GenerateKey(address, user string, pubkey *ecdh.Point) (logger.Secret, error) {
 	conn := providers.Pool.Get()
-	defer logger.HandleError(conn.Err())
 	defer conn.Close()
+	if err := conn.Err(); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+
+	start := time.Now()
+	key, err := Key.ECDH(pubkey)
+	metrics.ScalarMultDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
 
-	key := ecdh.GenerateSharedKey(PrivKey, pubkey)
 	keyHash, err := Hash(key.Text(16))
 	if err != nil {
 		return "", err
 	}
 
 	// Store Key in Cache
-	if _, err := conn.Do("SET", address, keyHash); err != nil {
+	if _, err := do(conn, "MSET", address, keyHash, address+":user", user); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+
+	log.Debug("session key stored", "address", address)
+
+	// Built now so the connection that follows finds it ready
+	if _, err := cipherFor(address, logger.Secret(keyHash)); err != nil {
 		return "", err
 	}
 
-	logger.Debug("Key Generated for: " + address + " => " + keyHash)
+	return logger.Secret(keyHash), nil
+}
 
-	return keyHash, nil
+// Run a Redis command, counting failures
+func do(conn redis.Conn, command string, args ...any) (any, error) {
+	reply, err := conn.Do(command, args...)
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues(command).Inc()
+	}
+	return reply, err
 }
 
 // Get Server's Public Key, for client to generate shared key
@@ -88,75 +116,160 @@ func GetPubKey() (*ecdh.Point, error) {
 }
 
 // Get Shared Key from cache, key is Hex encoded
-func GetSharedKey(address string) (string, error) {
+func GetSharedKey(address string) (logger.Secret, error) {
 	conn := providers.Pool.Get()
-	defer logger.HandleError(conn.Err())
 	defer conn.Close()
+	if err := conn.Err(); err != nil {
+		return "", err
+	}
 
-	key, err := redis.String(conn.Do("GET", address))
+	key, err := redis.String(do(conn, "GET", address))
 	if err != nil {
 		return "", err
 	}
 
-	return key, nil
+	return logger.Secret(key), nil
 }
 
-// Key is always hex encoded, String is UTF-8, converted plainly
-func Encrypt(key, plaintext string) (string, error) {
-	k, err := hex.DecodeString(key)
-	if err != nil {
-		return "", err
+// User the session at address was made for
+func GetSessionUser(address string) (string, error) {
+	conn := providers.Pool.Get()
+	defer conn.Close()
+
+	return redis.String(do(conn, "GET", address+":user"))
+}
+
+// Register the Schnorr key the session at address signs with, once the
+// handshake proved it holds the key bound to its user
+func SetVerifyKey(address, pubkey string) error {
+	conn := providers.Pool.Get()
+	defer conn.Close()
+
+	if _, err := do(conn, "SET", address+":verify", pubkey); err != nil {
+		return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
 	}
+	return nil
+}
 
-	gbc, err := goblockc.NewBlock(k[:16])
+// Bind user to pubkey unless another key was bound first, returning the key
+// the name is bound to. An empty pubkey binds nothing. A name belongs to
+// whoever registered a key for it first, others can no longer sign as it.
+func BindVerifyKey(user, pubkey string) (string, error) {
+	conn := providers.Pool.Get()
+	defer conn.Close()
+
+	if pubkey != "" {
+		if _, err := do(conn, "SETNX", "verify:"+user, pubkey); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+		}
+	}
+	key, err := redis.String(do(conn, "GET", "verify:"+user))
+	if err == redis.ErrNil {
+		return "", nil
+	}
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
 	}
+	return key, nil
+}
 
-	iv := make([]byte, gbc.BlockSize())
+// The key bound to user, empty if they never registered one
+func GetUserVerifyKey(user string) (string, error) {
+	conn := providers.Pool.Get()
+	defer conn.Close()
+
+	key, err := redis.String(do(conn, "GET", "verify:"+user))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return key, err
+}
 
-    ctr, err := goblockc.NewCTR(gbc, iv)
+// Record a request nonce of the session at address for ttl, false if it was
+// already recorded
+func ClaimNonce(address, nonce string, ttl time.Duration) (bool, error) {
+	conn := providers.Pool.Get()
+	defer conn.Close()
+
+	_, err := redis.String(do(conn, "SET", address+":nonce:"+nonce, 1, "NX", "PX", ttl.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Count chunks against a quota, refusing them whole when they would go over.
+// The count starts over ttl after the first chunks were counted.
+var reserveScript = redis.NewScript(1, `
+local used = redis.call("INCRBY", KEYS[1], ARGV[1])
+if used > tonumber(ARGV[2]) then
+	redis.call("DECRBY", KEYS[1], ARGV[1])
+	return 0
+end
+if used == tonumber(ARGV[1]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// Count chunks the session at address starts uploading against quota, false
+// if they do not fit in what is left of it for ttl
+func ReserveUploads(address string, chunks, quota int, ttl time.Duration) (bool, error) {
+	conn := providers.Pool.Get()
+	defer conn.Close()
 
+	ok, err := redis.Bool(reserveScript.Do(conn, address+":uploads", chunks, quota, ttl.Milliseconds()))
 	if err != nil {
-		return "", err
+		metrics.RedisErrors.WithLabelValues("EVALSHA").Inc()
 	}
+	return ok, err
+}
 
-	ciphertext := make([]byte, len(plaintext))
-	copy(ciphertext, []byte(plaintext))
-    ctr.XORKeyStream(ciphertext, ciphertext)
+// Forget the session of address, it has to handshake again before it can connect
+func RevokeSession(address string) error {
+	conn := providers.Pool.Get()
+	defer conn.Close()
 
-	return hex.EncodeToString(ciphertext), nil
+	forgetCipher(address)
+	_, err := do(conn, "DEL", address, address+":user", address+":verify")
+	return err
 }
 
-// Key is always hex encoded, ciphertext is also hex encoded to preserve data
-func Decrypt(key, ciphertext string) (string, error) {
-	k, err := hex.DecodeString(key)
-	if err != nil {
-		return "", err
+// Get the registered Schnorr key, empty if the client never registered one
+func GetVerifyKey(address string) (string, error) {
+	conn := providers.Pool.Get()
+	defer conn.Close()
+
+	key, err := redis.String(do(conn, "GET", address+":verify"))
+	if err == redis.ErrNil {
+		return "", nil
 	}
+	return key, err
+}
 
-	gbc, err := goblockc.NewBlock(k[:16])
+// Key is always hex encoded, String is UTF-8, converted plainly.
+// Builds the cipher every call, connections use a Cipher instead
+func Encrypt(key logger.Secret, plaintext string) (string, error) {
+	c, err := NewCipher(key)
 	if err != nil {
 		return "", err
 	}
 
-	iv := make([]byte, gbc.BlockSize())
-
-    ctr, err := goblockc.NewCTR(gbc, iv)
+	return c.Encrypt([]byte(plaintext))
+}
 
+// Key is always hex encoded, ciphertext is also hex encoded to preserve data
+func Decrypt(key logger.Secret, ciphertext string) (string, error) {
+	c, err := NewCipher(key)
 	if err != nil {
 		return "", err
 	}
 
-	c, err := hex.DecodeString(ciphertext)
+	plaintext, err := c.Decrypt(ciphertext)
 	if err != nil {
 		return "", err
 	}
 
-	plaintext := make([]byte, len(c))
-	copy(plaintext, c)
-    ctr.XORKeyStream(plaintext, plaintext)
-
 	return string(plaintext), nil
 }
 
@@ -167,7 +280,7 @@ func GetSchnorr() ([]byte, []byte, []byte) {
 }
 
 func Hash(hexString string) (string, error) {
-	if len(hexString) % 2 != 0 {
+	if len(hexString)%2 != 0 {
 		hexString = "0" + hexString
 	}
 
@@ -179,4 +292,4 @@ func Hash(hexString string) (string, error) {
 	hash := sha256.Sum256(bytes)
 
 	return hex.EncodeToString(hash[:]), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nart4hire/goschnorr"
+)
+
+// Format version of the parameter file
+const schnorrParamsVersion = 1
+
+var ErrInvalidSchnorrParams = errors.New("invalid schnorr parameters")
+
+// Schnorr domain parameters as persisted on disk, all numbers hex encoded.
+// ID is a fingerprint of p, q and gen that clients pin.
+type SchnorrParams struct {
+	Version   int       `json:"version"`
+	ID        string    `json:"id"`
+	P         string    `json:"p"`
+	Q         string    `json:"q"`
+	Gen       string    `json:"gen"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var SchnorrParamsID string
+
+// Fingerprint of the parameters, changes whenever any of them does
+func schnorrFingerprint(p, q, gen *big.Int) string {
+	h := sha256.New()
+	for _, v := range []*big.Int{p, q, gen} {
+		b := v.Bytes()
+		h.Write([]byte{byte(len(b) >> 8), byte(len(b))})
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func newSchnorrParams(p, q, gen *big.Int) *SchnorrParams {
+	return &SchnorrParams{
+		Version:   schnorrParamsVersion,
+		ID:        schnorrFingerprint(p, q, gen),
+		P:         p.Text(16),
+		Q:         q.Text(16),
+		Gen:       gen.Text(16),
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// Parse and check the parameters: p and q prime, q | p - 1, gen of order q, and a matching ID
+func (params *SchnorrParams) Validate() (p, q, gen *big.Int, err error) {
+	if params.Version != schnorrParamsVersion {
+		return nil, nil, nil, errors.Join(ErrInvalidSchnorrParams, errors.New("unsupported version"))
+	}
+
+	p, okP := new(big.Int).SetString(params.P, 16)
+	q, okQ := new(big.Int).SetString(params.Q, 16)
+	gen, okG := new(big.Int).SetString(params.Gen, 16)
+	if !okP || !okQ || !okG {
+		return nil, nil, nil, errors.Join(ErrInvalidSchnorrParams, errors.New("malformed number"))
+	}
+
+	one := big.NewInt(1)
+	switch {
+	case q.BitLen() < 256:
+		err = errors.New("q is shorter than 256 bits")
+	case !p.ProbablyPrime(32) || !q.ProbablyPrime(32):
+		err = errors.New("p or q is not prime")
+	case new(big.Int).Mod(new(big.Int).Sub(p, one), q).Sign() != 0:
+		err = errors.New("q does not divide p - 1")
+	case gen.Cmp(one) <= 0 || gen.Cmp(p) >= 0:
+		err = errors.New("gen is out of range")
+	case new(big.Int).Exp(gen, q, p).Cmp(one) != 0:
+		err = errors.New("gen does not have order q")
+	case params.ID != schnorrFingerprint(p, q, gen):
+		err = errors.New("id does not match the parameters")
+	}
+	if err != nil {
+		return nil, nil, nil, errors.Join(ErrInvalidSchnorrParams, err)
+	}
+
+	return p, q, gen, nil
+}
+
+// Load the parameters from path, generating and persisting them on first start.
+// A file that exists but fails validation is an error, never silently replaced.
+func LoadSchnorr(path string) error {
+	params, err := readSchnorrParams(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Info("no Schnorr parameters, generating", "path", path)
+		if params, err = generateSchnorrParams(path); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	p, q, gen, err := params.Validate()
+	if err != nil {
+		return err
+	}
+
+	Schnorr = schnorr.NewSchnorrFromParam(p, q, gen, rand.Reader, sha256.New())
+	SchnorrParamsID = params.ID
+	log.Info("loaded Schnorr parameters", "id", params.ID)
+	return nil
+}
+
+func readSchnorrParams(path string) (*SchnorrParams, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &SchnorrParams{}
+	if err := json.Unmarshal(data, params); err != nil {
+		return nil, errors.Join(ErrInvalidSchnorrParams, err)
+	}
+	return params, nil
+}
+
+func generateSchnorrParams(path string) (*SchnorrParams, error) {
+	s, err := schnorr.NewSchnorr(rand.Reader, sha256.New())
+	if err != nil {
+		return nil, err
+	}
+	params := newSchnorrParams(s.GetParams())
+
+	data, err := json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	// Write then rename so a crash never leaves a half written file behind
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+
+	return params, nil
+}
+
+// Fresh verifier per call, goschnorr keeps hash state inside the instance
+func newSchnorrVerifier() (schnorr.Schnorr, error) {
+	if Schnorr == nil {
+		return nil, errors.New("schnorr parameters not loaded")
+	}
+	p, q, gen := Schnorr.GetParams()
+	return schnorr.NewSchnorrFromParam(p, q, gen, rand.Reader, sha256.New()), nil
+}
+
+// Check that a hex encoded verification key is an element of the group
+func ValidateVerifyKey(pubkey string) error {
+	s, err := newSchnorrVerifier()
+	if err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+	p, q, _ := s.GetParams()
+
+	y := new(big.Int).SetBytes(b)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(p) >= 0 || new(big.Int).Exp(y, q, p).Cmp(big.NewInt(1)) != 0 {
+		return fmt.Errorf("%w: verification key is not in the schnorr group", ErrInvalidKey)
+	}
+	return nil
+}
+
+// Verify a client signature, all values are hex encoded as produced by the client
+func VerifySignature(pubkey, sign, hash, message string) (bool, error) {
+	s, err := newSchnorrVerifier()
+	if err != nil {
+		return false, err
+	}
+
+	pub, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return false, err
+	}
+	sig, err := hex.DecodeString(sign)
+	if err != nil {
+		return false, err
+	}
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		return false, err
+	}
+
+	return s.Verify(pub, sig, h, message), nil
+}
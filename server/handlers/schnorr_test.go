@@ -0,0 +1,41 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+)
+
+func TestLoadSchnorrPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schnorr.json")
+
+	if err := handlers.LoadSchnorr(path); err != nil {
+		t.Fatal(err)
+	}
+	first := handlers.SchnorrParamsID
+
+	if err := handlers.LoadSchnorr(path); err != nil {
+		t.Fatal(err)
+	}
+	if handlers.SchnorrParamsID != first {
+		t.Errorf("Parameters changed across loads: %s => %s", first, handlers.SchnorrParamsID)
+	}
+
+	// Tamper with the generator, the server must refuse these
+	data, _ := os.ReadFile(path)
+	params := handlers.SchnorrParams{}
+	if err := json.Unmarshal(data, &params); err != nil {
+		t.Fatal(err)
+	}
+	params.Gen = "2"
+	data, _ = json.Marshal(params)
+	os.WriteFile(path, data, 0o600)
+
+	if err := handlers.LoadSchnorr(path); !errors.Is(err, handlers.ErrInvalidSchnorrParams) {
+		t.Errorf("Expected %v, got %v", handlers.ErrInvalidSchnorrParams, err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nart4hire/goschnorr"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/ecdh"
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+)
+
+func handshakeRequest(h http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, "/key", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func clientKey(t *testing.T) string {
+	t.Helper()
+	key, err := ecdh.GenerateKey(ecdh.NewCurve())
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := key.Public.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(text)
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	if err := handlers.LoadSchnorr(filepath.Join(t.TempDir(), "schnorr.json")); err != nil {
+		t.Fatal(err)
+	}
+	hub, mr, _ := newAdminHub(t)
+	hub.limits = newLimits(config.RateLimits{})
+	routes := setupRoutes(hub, hub.cfg)
+
+	rec := handshakeRequest(routes, `{"port":"alice","public_key":"`+clientKey(t)+`"}`)
+	var res HandshakeResponse
+	if json.Unmarshal(rec.Body.Bytes(), &res); rec.Code != http.StatusOK || !middlewares.ValidSessionID(res.Session) {
+		t.Fatalf("Expected the handshake to succeed with a session id, got %d %s", rec.Code, rec.Body)
+	}
+	if user, _ := mr.Get("session:" + res.Session + ":user"); !mr.Exists("session:"+res.Session) || user != "alice" {
+		t.Error("Session key not stored")
+	}
+
+	// Every handshake makes a session of its own, whatever name it claims
+	again := handshakeRequest(routes, `{"port":"alice","public_key":"`+clientKey(t)+`"}`)
+	var other HandshakeResponse
+	if json.Unmarshal(again.Body.Bytes(), &other); other.Session == res.Session || !mr.Exists("session:"+res.Session) {
+		t.Errorf("Expected a second session beside the first, got %s", again.Body)
+	}
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"malformed JSON", `{"port":`, http.StatusBadRequest, "bad_request"},
+		{"missing key", `{"port":"alice"}`, http.StatusBadRequest, "bad_request"},
+		{"key off the curve", `{"port":"alice","public_key":"02ff"}`, http.StatusUnprocessableEntity, "invalid_key"},
+		{"bad verify key", `{"port":"alice","public_key":"` + clientKey(t) + `","verify_key":"zz"}`, http.StatusUnprocessableEntity, "invalid_verify_key"},
+		{"too large", `{"port":"` + strings.Repeat("a", maxHandshakeSize) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large"},
+	}
+	for _, c := range cases {
+		rec := handshakeRequest(routes, c.body)
+		var e middlewares.ErrorBody
+		if json.Unmarshal(rec.Body.Bytes(), &e); rec.Code != c.status || e.Code != c.code || e.RequestID == "" {
+			t.Errorf("%s: expected %d %s with a request id, got %d %s", c.name, c.status, c.code, rec.Code, rec.Body)
+		}
+	}
+
+	// Redis down is the server's fault and worth retrying
+	mr.Close()
+	rec = handshakeRequest(routes, `{"port":"bob","public_key":"`+clientKey(t)+`"}`)
+	var e middlewares.ErrorBody
+	if json.Unmarshal(rec.Body.Bytes(), &e); rec.Code != http.StatusServiceUnavailable || e.Code != "store_unavailable" {
+		t.Errorf("Expected 503 store_unavailable, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestHandshakeRateLimited(t *testing.T) {
+	hub, _, _ := newAdminHub(t)
+	hub.cfg.Limits.Handshakes.Burst = 1
+	hub.limits = newLimits(hub.cfg.Limits)
+	routes := setupRoutes(hub, hub.cfg)
+
+	handshakeRequest(routes, `{"port":"alice","public_key":"`+clientKey(t)+`"}`)
+	rec := handshakeRequest(routes, `{"port":"alice","public_key":"`+clientKey(t)+`"}`)
+	var e middlewares.ErrorBody
+	if json.Unmarshal(rec.Body.Bytes(), &e); rec.Code != http.StatusTooManyRequests || e.Code != "rate_limited" {
+		t.Errorf("Expected 429 rate_limited, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// Handshake body for user signed with priv, whose public half is verifyKey
+func signedHandshake(t *testing.T, s schnorr.Schnorr, priv []byte, user, verifyKey string) string {
+	t.Helper()
+	publicKey := clientKey(t)
+	sign, hash, err := s.Sign(priv, handshakeMessage(user, publicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(Handshake{Port: user, PublicKey: publicKey, VerifyKey: verifyKey, Sign: hex.EncodeToString(sign), Hash: hex.EncodeToString(hash)})
+	return string(body)
+}
+
+func TestHandshakeIdentity(t *testing.T) {
+	if err := handlers.LoadSchnorr(filepath.Join(t.TempDir(), "schnorr.json")); err != nil {
+		t.Fatal(err)
+	}
+	p, q, g := handlers.Schnorr.GetParams()
+	s := schnorr.NewSchnorrFromParam(p, q, g, rand.Reader, sha256.New())
+	priv, pub, _ := s.GenKeyPair()
+	otherPriv, otherPub, _ := s.GenKeyPair()
+	key, otherKey := hex.EncodeToString(pub), hex.EncodeToString(otherPub)
+
+	hub, mr, _ := newAdminHub(t)
+	hub.limits = newLimits(config.RateLimits{})
+	routes := setupRoutes(hub, hub.cfg)
+
+	// The first key registered for a name binds it
+	rec := handshakeRequest(routes, signedHandshake(t, s, priv, "alice", key))
+	var res HandshakeResponse
+	if json.Unmarshal(rec.Body.Bytes(), &res); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the handshake to succeed, got %d %s", rec.Code, rec.Body)
+	}
+	if bound, _ := mr.Get("verify:alice"); bound != key {
+		t.Errorf("Expected alice bound to her key, got %q", bound)
+	}
+	if _, user, err := handlers.SessionOf(middlewares.SessionAddress(res.Session)); err != nil || user != "alice" {
+		t.Errorf("Expected a session of alice, got %q %v", user, err)
+	}
+
+	// Names nobody bound may still be used, as nobody in particular
+	rec = handshakeRequest(routes, `{"port":"carol","public_key":"`+clientKey(t)+`"}`)
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	if _, user, err := handlers.SessionOf(middlewares.SessionAddress(res.Session)); rec.Code != http.StatusOK || err != nil || user != "" {
+		t.Errorf("Expected an anonymous session, got %d %q %v", rec.Code, user, err)
+	}
+
+	forged := signedHandshake(t, s, otherPriv, "alice", key)
+	cases := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"bound name without a signature", `{"port":"alice","public_key":"` + clientKey(t) + `"}`, http.StatusUnauthorized, "signature_required"},
+		{"bound name with another key", signedHandshake(t, s, otherPriv, "alice", otherKey), http.StatusConflict, "name_taken"},
+		{"signed with another key", forged, http.StatusUnauthorized, "bad_signature"},
+		{"signature for another name", strings.Replace(signedHandshake(t, s, priv, "alice", key), `"port":"alice"`, `"port":"bob"`, 1), http.StatusUnauthorized, "bad_signature"},
+	}
+	for _, c := range cases {
+		rec := handshakeRequest(routes, c.body)
+		var e middlewares.ErrorBody
+		if json.Unmarshal(rec.Body.Bytes(), &e); rec.Code != c.status || e.Code != c.code {
+			t.Errorf("%s: expected %d %s, got %d %s", c.name, c.status, c.code, rec.Code, rec.Body)
+		}
+	}
+	if mr.Exists("verify:bob") {
+		t.Error("A refused handshake bound a name")
+	}
+}
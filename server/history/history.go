@@ -0,0 +1,67 @@
+// Package history keeps the messages sent to each room, so they can be edited,
+// deleted and reacted to later. Messages are kept as relayed, their content is
+// end-to-end encrypted and never read here.
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("history: no such message")
+	ErrBadCursor = errors.New("history: cursor must be a message id")
+)
+
+type Message struct {
+	ID        string              `json:"id"` // Assigned by the store, growing with every message in the room
+	Room      string              `json:"room"`
+	Author    string              `json:"author"`   // Identity of the sender, the only one who may change it
+	Sender    string              `json:"sender"`   // Name the sender went by
+	Envelope  json.RawMessage     `json:"envelope"` // As relayed, empty once deleted
+	SentAt    time.Time           `json:"sent_at"`
+	EditedAt  time.Time           `json:"edited_at"`  // Zero unless edited
+	ExpiresAt time.Time           `json:"expires_at"` // Zero unless it disappears
+	Deleted   bool                `json:"deleted,omitempty"`
+	Reactions map[string][]string `json:"reactions,omitempty"` // Users by emoji
+}
+
+type Store interface {
+	// Keep a message, returning it with its ID. The oldest of the room go past the store's limit.
+	Append(ctx context.Context, m Message) (Message, error)
+
+	Get(ctx context.Context, room, id string) (Message, error)
+
+	// Change a message with f, which is handed the latest version and may be
+	// called more than once. Nothing changes when f fails, its error is returned as is.
+	Update(ctx context.Context, room, id string, f func(*Message) error) (Message, error)
+
+	// Up to limit messages sent before the one with id before, or the newest
+	// when before is empty, newest first. next is where the following page
+	// starts, empty once there is nothing older.
+	Page(ctx context.Context, room, before string, limit int) (page []Message, next string, err error)
+
+	// Purge the messages that expired by now, returning how many went
+	Expire(ctx context.Context, now time.Time) (int, error)
+}
+
+// Expired messages count as gone even before they are purged
+func (m Message) expiredBy(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// Sequence number of a cursor, math.MaxInt64 for the newest messages
+func cursor(before string) (int64, error) {
+	if before == "" {
+		return math.MaxInt64, nil
+	}
+	seq, err := strconv.ParseInt(before, 10, 64)
+	if err != nil || seq < 1 {
+		return 0, ErrBadCursor
+	}
+	return seq, nil
+}
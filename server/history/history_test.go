@@ -0,0 +1,148 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 4; i++ {
+		m, err := s.Append(ctx, Message{Room: "general", Author: "alice", Envelope: json.RawMessage(`{"message":"hi"}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.ID)
+	}
+	other, _ := s.Append(ctx, Message{Room: "other", Author: "bob"})
+
+	if ids[0] == ids[1] || ids[3] != "4" || other.ID != "1" {
+		t.Errorf("Expected ids counting up per room, got %v and %s", ids, other.ID)
+	}
+
+	// Only the newest three are kept
+	if _, err := s.Get(ctx, "general", ids[0]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the oldest message to be gone, got %v", err)
+	}
+	if m, err := s.Get(ctx, "general", ids[1]); err != nil || m.Author != "alice" || string(m.Envelope) != `{"message":"hi"}` {
+		t.Errorf("Unexpected message %+v %v", m, err)
+	}
+
+	refused := errors.New("refused")
+	if _, err := s.Update(ctx, "general", ids[3], func(m *Message) error {
+		m.Deleted = true
+		return refused
+	}); !errors.Is(err, refused) {
+		t.Errorf("Expected the update's error, got %v", err)
+	}
+	if m, _ := s.Get(ctx, "general", ids[3]); m.Deleted {
+		t.Error("A failed update changed the message")
+	}
+
+	m, err := s.Update(ctx, "general", ids[3], func(m *Message) error {
+		m.Reactions = map[string][]string{"👍": {"bob"}}
+		return nil
+	})
+	if err != nil || len(m.Reactions["👍"]) != 1 {
+		t.Fatalf("Update failed: %+v %v", m, err)
+	}
+	if m, _ := s.Get(ctx, "general", ids[3]); len(m.Reactions["👍"]) != 1 {
+		t.Errorf("Update was not kept, got %+v", m)
+	}
+	if _, err := s.Update(ctx, "other", ids[3], func(*Message) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ids to be per room, got %v", err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory(3))
+	testExpire(t, NewMemory(10))
+	testPage(t, NewMemory(10))
+}
+
+func TestRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) }}
+	testStore(t, NewRedis(pool, 3))
+	testExpire(t, NewRedis(pool, 10))
+	testPage(t, NewRedis(pool, 10))
+
+	// Each kind of key is tagged after the room, whatever the room is called
+	for _, key := range []string{"history:{general}:msgs", "history:{general}:ids", "history:{general}:seq"} {
+		if !mr.Exists(key) {
+			t.Errorf("Expected %s", key)
+		}
+	}
+}
+
+func testExpire(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := time.Now()
+	soon, _ := s.Append(ctx, Message{Room: "secret", ExpiresAt: now.Add(time.Minute)})
+	later, _ := s.Append(ctx, Message{Room: "secret", ExpiresAt: now.Add(time.Hour)})
+	// Named like the set of expiring messages, which must stay apart from rooms
+	kept, _ := s.Append(ctx, Message{Room: "expiring"})
+
+	if n, err := s.Expire(ctx, now); err != nil || n != 0 {
+		t.Errorf("Expected nothing to expire yet, got %d %v", n, err)
+	}
+	if n, err := s.Expire(ctx, now.Add(2*time.Minute)); err != nil || n != 1 {
+		t.Errorf("Expected one message to expire, got %d %v", n, err)
+	}
+	if _, err := s.Get(ctx, "secret", soon.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the expired message to be purged, got %v", err)
+	}
+	if _, err := s.Get(ctx, "secret", later.ID); err != nil {
+		t.Errorf("Expected the later message to be kept, got %v", err)
+	}
+	if _, err := s.Get(ctx, "expiring", kept.ID); err != nil {
+		t.Errorf("Expected the lasting message to be kept, got %v", err)
+	}
+
+	// Past its expiry a message is gone before any purge
+	gone, _ := s.Append(ctx, Message{Room: "secret", ExpiresAt: now.Add(-time.Second)})
+	if _, err := s.Get(ctx, "secret", gone.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an expired message to be hidden, got %v", err)
+	}
+}
+
+func testPage(t *testing.T, s Store) {
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		s.Append(ctx, Message{Room: "paged"})
+	}
+
+	var got []string
+	before := ""
+	for pages := 0; pages < 5; pages++ {
+		page, next, err := s.Page(ctx, "paged", before, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range page {
+			got = append(got, m.ID)
+		}
+		if next == "" {
+			break
+		}
+		before = next
+	}
+	if want := []string{"5", "4", "3", "2", "1"}; !slices.Equal(got, want) {
+		t.Errorf("Expected %v newest first, got %v", want, got)
+	}
+
+	if page, next, err := s.Page(ctx, "empty", "", 2); err != nil || len(page) != 0 || next != "" {
+		t.Errorf("Expected an empty room to have an empty page, got %v %q %v", page, next, err)
+	}
+	if _, _, err := s.Page(ctx, "paged", "newest", 2); !errors.Is(err, ErrBadCursor) {
+		t.Errorf("Expected a bad cursor to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package history
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type room struct {
+	seq      int64
+	messages []Message // Oldest first
+}
+
+// Rooms in process memory, lost on restart and only seen by this node
+type Memory struct {
+	mu    sync.Mutex
+	limit int
+	rooms map[string]*room
+}
+
+func NewMemory(limit int) *Memory {
+	return &Memory{limit: limit, rooms: make(map[string]*room)}
+}
+
+func (s *Memory) Append(ctx context.Context, m Message) (Message, error) {
+	if err := ctx.Err(); err != nil {
+		return Message{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[m.Room]
+	if !ok {
+		r = &room{}
+		s.rooms[m.Room] = r
+	}
+	r.seq++
+	m.ID = strconv.FormatInt(r.seq, 10)
+	r.messages = append(r.messages, m)
+	if len(r.messages) > s.limit {
+		r.messages = r.messages[len(r.messages)-s.limit:]
+	}
+	return m, nil
+}
+
+// Position of a message in its room, only called with mu held
+func (s *Memory) find(room, id string) (*Message, bool) {
+	r, ok := s.rooms[room]
+	if !ok {
+		return nil, false
+	}
+	for i := range r.messages {
+		if r.messages[i].ID == id {
+			return &r.messages[i], !r.messages[i].expiredBy(time.Now())
+		}
+	}
+	return nil, false
+}
+
+func (s *Memory) Get(ctx context.Context, room, id string) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.find(room, id)
+	if !ok {
+		return Message{}, ErrNotFound
+	}
+	return clone(*m), nil
+}
+
+func (s *Memory) Update(ctx context.Context, room, id string, f func(*Message) error) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.find(room, id)
+	if !ok {
+		return Message{}, ErrNotFound
+	}
+
+	// f works on a copy so a failure leaves the message as it was
+	changed := clone(*m)
+	if err := f(&changed); err != nil {
+		return Message{}, err
+	}
+	*m = changed
+	return clone(changed), nil
+}
+
+func (s *Memory) Page(ctx context.Context, room, before string, limit int) ([]Message, string, error) {
+	end, err := cursor(before)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	page := []Message{}
+	r, ok := s.rooms[room]
+	if !ok {
+		return page, "", nil
+	}
+
+	now := time.Now()
+	for i := len(r.messages) - 1; i >= 0; i-- {
+		m := r.messages[i]
+		if seq, _ := strconv.ParseInt(m.ID, 10, 64); seq >= end || m.expiredBy(now) {
+			continue
+		}
+		if len(page) == limit {
+			return page, page[len(page)-1].ID, nil
+		}
+		page = append(page, clone(m))
+	}
+	return page, "", nil
+}
+
+func (s *Memory) Expire(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, r := range s.rooms {
+		before := len(r.messages)
+		r.messages = slices.DeleteFunc(r.messages, func(m Message) bool { return m.expiredBy(now) })
+		n += before - len(r.messages)
+	}
+	return n, nil
+}
+
+// Copy of a message sharing nothing with it
+func clone(m Message) Message {
+	if m.Reactions != nil {
+		reactions := make(map[string][]string, len(m.Reactions))
+		for emoji, users := range m.Reactions {
+			reactions[emoji] = append([]string(nil), users...)
+		}
+		m.Reactions = reactions
+	}
+	return m
+}
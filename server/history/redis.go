@@ -0,0 +1,256 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+)
+
+const (
+	// Prefix of the Redis keys of a room, kept apart from the session keys
+	keyPrefix = "history:"
+
+	// Sorted set of the messages that disappear, as id:room, by expiry in
+	// milliseconds. Outside keyPrefix, which only holds rooms.
+	expiringKey = "history-expiring"
+
+	// Updates racing another node are tried this many times
+	updateAttempts = 10
+)
+
+var errContended = errors.New("history: message changed too often to update")
+
+// Rooms in Redis, shared by every node. Each has a hash of messages by id, a
+// sorted set of ids by sequence and the sequence counter, tagged by kind after
+// the room name in braces so no room's keys can run into another's. Messages
+// that disappear are also in one sorted set for every room.
+type Redis struct {
+	pool  *redis.Pool
+	limit int
+}
+
+func NewRedis(pool *redis.Pool, limit int) *Redis {
+	return &Redis{pool: pool, limit: limit}
+}
+
+func roomKey(room, kind string) string { return keyPrefix + "{" + room + "}:" + kind }
+
+func messagesKey(room string) string { return roomKey(room, "msgs") }
+func idsKey(room string) string      { return roomKey(room, "ids") }
+func seqKey(room string) string      { return roomKey(room, "seq") }
+
+// Run a command, counting failures
+func do(ctx context.Context, conn redis.Conn, command string, args ...any) (any, error) {
+	reply, err := redis.DoContext(conn, ctx, command, args...)
+	if err != nil && err != redis.ErrNil {
+		metrics.RedisErrors.WithLabelValues(command).Inc()
+	}
+	return reply, err
+}
+
+// Run a transaction, counting a failure against its first command. The reply
+// is nil when a watched key changed.
+func multi(ctx context.Context, conn redis.Conn, commands ...[]any) ([]any, error) {
+	conn.Send("MULTI")
+	for _, c := range commands {
+		conn.Send(c[0].(string), c[1:]...)
+	}
+	replies, err := redis.Values(redis.DoContext(conn, ctx, "EXEC"))
+	if err != nil && err != redis.ErrNil {
+		metrics.RedisErrors.WithLabelValues(commands[0][0].(string)).Inc()
+	}
+	return replies, err
+}
+
+func (s *Redis) Append(ctx context.Context, m Message) (Message, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	defer conn.Close()
+
+	seq, err := redis.Int64(do(ctx, conn, "INCR", seqKey(m.Room)))
+	if err != nil {
+		return Message{}, err
+	}
+	m.ID = strconv.FormatInt(seq, 10)
+	data, err := json.Marshal(m)
+	if err != nil {
+		return Message{}, err
+	}
+
+	commands := [][]any{
+		{"HSET", messagesKey(m.Room), m.ID, data},
+		{"ZADD", idsKey(m.Room), seq, m.ID},
+		{"ZRANGE", idsKey(m.Room), 0, -s.limit - 1},
+	}
+	if !m.ExpiresAt.IsZero() {
+		commands = append(commands, []any{"ZADD", expiringKey, m.ExpiresAt.UnixMilli(), m.ID + ":" + m.Room})
+	}
+	replies, err := multi(ctx, conn, commands...)
+	if err != nil {
+		return Message{}, err
+	}
+
+	// Past the limit, the oldest go
+	old, err := redis.Strings(replies[2], nil)
+	if err != nil || len(old) == 0 {
+		return m, err
+	}
+	_, err = multi(ctx, conn,
+		append([]any{"ZREM", idsKey(m.Room)}, args(old)...),
+		append([]any{"HDEL", messagesKey(m.Room)}, args(old)...),
+	)
+	return m, err
+}
+
+func args(s []string) []any {
+	out := make([]any, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+func get(ctx context.Context, conn redis.Conn, room, id string) (Message, error) {
+	var m Message
+	data, err := redis.Bytes(do(ctx, conn, "HGET", messagesKey(room), id))
+	if err == redis.ErrNil {
+		return m, ErrNotFound
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, err
+	}
+	if m.expiredBy(time.Now()) {
+		return Message{}, ErrNotFound
+	}
+	return m, nil
+}
+
+func (s *Redis) Get(ctx context.Context, room, id string) (Message, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	defer conn.Close()
+	return get(ctx, conn, room, id)
+}
+
+// Optimistic, the write is dropped and f run again if another node changed
+// the room in between
+func (s *Redis) Update(ctx context.Context, room, id string, f func(*Message) error) (Message, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	defer conn.Close()
+	defer do(ctx, conn, "UNWATCH")
+
+	for i := 0; i < updateAttempts; i++ {
+		if _, err := do(ctx, conn, "WATCH", messagesKey(room)); err != nil {
+			return Message{}, err
+		}
+		m, err := get(ctx, conn, room, id)
+		if err != nil {
+			return Message{}, err
+		}
+		if err := f(&m); err != nil {
+			return Message{}, err
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return Message{}, err
+		}
+
+		_, err = multi(ctx, conn, []any{"HSET", messagesKey(room), id, data})
+		if err == nil {
+			return m, nil
+		}
+		if err != redis.ErrNil {
+			return Message{}, err
+		}
+	}
+	return Message{}, errContended
+}
+
+// One more id than asked for is read to tell whether there is a next page
+func (s *Redis) Page(ctx context.Context, room, before string, limit int) ([]Message, string, error) {
+	end, err := cursor(before)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+
+	ids, err := redis.Strings(do(ctx, conn, "ZREVRANGEBYSCORE", idsKey(room), "("+strconv.FormatInt(end, 10), "-inf", "LIMIT", 0, limit+1))
+	if err != nil || len(ids) == 0 {
+		return []Message{}, "", err
+	}
+	next := ""
+	if len(ids) > limit {
+		ids = ids[:limit]
+		next = ids[limit-1]
+	}
+
+	values, err := redis.ByteSlices(do(ctx, conn, "HMGET", append([]any{messagesKey(room)}, args(ids)...)...))
+	if err != nil {
+		return nil, "", err
+	}
+	page := make([]Message, 0, len(values))
+	now := time.Now()
+	for _, data := range values {
+		// Trimmed or purged since the ids were read
+		if data == nil {
+			continue
+		}
+		var m Message
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, "", err
+		}
+		if !m.expiredBy(now) {
+			page = append(page, m)
+		}
+	}
+	return page, next, nil
+}
+
+// Messages trimmed past the limit may still be listed as expiring, removing
+// them again does no harm
+func (s *Redis) Expire(ctx context.Context, now time.Time) (int, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	members, err := redis.Strings(do(ctx, conn, "ZRANGEBYSCORE", expiringKey, "-inf", now.UnixMilli()))
+	if err != nil || len(members) == 0 {
+		return 0, err
+	}
+
+	commands := [][]any{append([]any{"ZREM", expiringKey}, args(members)...)}
+	for _, member := range members {
+		id, room, _ := strings.Cut(member, ":")
+		commands = append(commands,
+			[]any{"HDEL", messagesKey(room), id},
+			[]any{"ZREM", idsKey(room), id},
+		)
+	}
+	if _, err := multi(ctx, conn, commands...); err != nil {
+		return 0, err
+	}
+	return len(members), nil
+}
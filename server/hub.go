@@ -4,50 +4,593 @@
 
 package main
 
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/blob"
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/history"
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+	"github.com/FelineJTD/secure-chat-kripto/server/offline"
+	"github.com/FelineJTD/secure-chat-kripto/server/rooms"
+)
+
+// A message for every client in a room.
+type roomMessage struct {
+	room string
+	data []byte
+
+	// Not kept for spilled clients, such as presence changes.
+	transient bool
+
+	// Data encrypted under the room key, set by fanOut for rooms with one.
+	sealed []byte
+}
+
+// A message for a single client, or for every connection of an address when client is nil.
+type directMessage struct {
+	client  *Client
+	address string
+	data    []byte
+}
+
+// A message for a client disconnected by the spill policy, on its way to the offline queue.
+type spilledMessage struct {
+	address string
+	data    []byte
+}
+
+// A client disconnected by the spill policy, whose messages are spilled until it comes back.
+type spilledClient struct {
+	room  string
+	since time.Time
+}
+
+// What travels over the bus, exactly one of Room, Address, Presence, Disconnect, Resumed, Evict and RoomKey is set.
+type busFrame struct {
+	Room       string          `json:"room,omitempty"`
+	Address    string          `json:"address,omitempty"`
+	Data       []byte          `json:"data,omitempty"`
+	Presence   *presenceUpdate `json:"presence,omitempty"`
+	Disconnect string          `json:"disconnect,omitempty"` // Address to drop, on whichever node it is
+	Resumed    string          `json:"resumed,omitempty"`    // Spilled address that reconnected, to stop spilling on every node
+	Evict      *eviction       `json:"evict,omitempty"`      // User removed from a room, dropped from it on every node
+	RoomKey    string          `json:"room_key,omitempty"`   // Room whose key was rotated, reloaded on every node
+}
+
+type eviction struct {
+	Room string `json:"room"`
+	User string `json:"user"`
+}
+
+// Returned by do once run has returned.
+var errHubStopped = errors.New("hub stopped")
+
 // Hub maintains the set of active clients and broadcasts messages to the
-// clients.
+// clients. The clients themselves live in shards, run routes messages to the
+// shards and keeps track of presence.
 type Hub struct {
-	// Registered clients.
-	clients map[*Client]bool
+	// Clients, partitioned by address.
+	shards []*shard
+
+	// Room messages to deliver to the clients on this node.
+	broadcast chan roomMessage
+
+	// Messages addressed to one client, such as error frames.
+	direct chan directMessage
+
+	// Fans messages out to every node, this one included.
+	bus bus.Bus
+
+	// Presence changes reported by the shards.
+	members chan memberDelta
+
+	// Presence announcements from every node, this one included.
+	presenceUpdates chan presenceUpdate
+
+	// Functions to run on the hub goroutine, for reads and changes from outside it.
+	calls chan func()
+
+	// Identifies this node in presence announcements.
+	node string
+
+	// Users connected to this node, per room.
+	local map[memberKey]*localMember
+
+	// Presence across every node.
+	presence *presenceTracker
+
+	// Per room policies.
+	policies *roomPolicies
+
+	// Keys of the rooms whose broadcasts are sealed once for every member.
+	roomKeys *roomKeys
+
+	// Rate limits shared across connections.
+	limits *limits
+
+	// Where the spill policy keeps messages for the clients it disconnected.
+	offline offline.Queue
+
+	// Uploaded files, checked before a file message is relayed.
+	files blob.Store
+
+	// Chat messages per room, for edits, deletes and reactions.
+	history history.Store
+
+	// Rooms made through the API, private ones only let their members in.
+	rooms rooms.Store
+
+	// Messages to push to the offline queue, written off the hub goroutine.
+	spills chan spilledMessage
+
+	// Closed once run has returned, after which nothing reads the channels above.
+	done chan struct{}
+
+	startedAt time.Time
+
+	cfg *config.Config
+}
+
+func newHub(cfg *config.Config, b bus.Bus, q offline.Queue) *Hub {
+	policies := newRoomPolicies()
+	for _, room := range cfg.Rooms.Signed {
+		policies.set(room, RoomPolicy{RequireSignature: true})
+	}
+	for _, room := range cfg.Rooms.Keyed {
+		policy := policies.get(room)
+		policy.SharedKey = true
+		policies.set(room, policy)
+	}
+	for room, ttl := range cfg.Rooms.TTL {
+		policy := policies.get(room)
+		policy.TTL = ttl
+		policies.set(room, policy)
+	}
+
+	node := make([]byte, 8)
+	rand.Read(node)
 
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	h := &Hub{
+		broadcast:       make(chan roomMessage, cfg.Backpressure.BroadcastBuffer),
+		direct:          make(chan directMessage, cfg.Backpressure.BroadcastBuffer),
+		bus:             b,
+		members:         make(chan memberDelta),
+		presenceUpdates: make(chan presenceUpdate),
+		calls:           make(chan func()),
+		node:            hex.EncodeToString(node),
+		local:           make(map[memberKey]*localMember),
+		presence:        newPresenceTracker(cfg.Presence.TTL()),
+		policies:        policies,
+		roomKeys:        newRoomKeys(),
+		limits:          newLimits(cfg.Limits),
+		offline:         q,
+		spills:          make(chan spilledMessage, cfg.Backpressure.BroadcastBuffer),
+		done:            make(chan struct{}),
+		startedAt:       time.Now(),
+		cfg:             cfg,
+	}
+
+	n := cfg.Hub.Shards
+	if n == 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	for i := 0; i < n; i++ {
+		h.shards = append(h.shards, newShard(h))
+	}
+	return h
+}
+
+func (h *Hub) shardFor(address string) *shard {
+	return h.shards[shardIndex(address, len(h.shards))]
+}
+
+// Hand a client to its shard and wait until it is registered, false once the hub has stopped.
+func (h *Hub) join(client *Client) bool {
+	h.loadKey(context.Background(), client.room)
+	client.shard = h.shardFor(client.address)
+	return client.shard.do(context.Background(), func() { client.shard.add(client) }) == nil
+}
+
+func (h *Hub) leave(client *Client) {
+	client.shard.inbox.push(func() { client.shard.remove(client) })
+}
 
-	// Register requests from the clients.
-	register chan *Client
+// Set a client away or back online, false once the hub has stopped.
+func (h *Hub) setAway(client *Client, away bool) bool {
+	return client.shard.inbox.push(func() { client.shard.setAway(client, away) })
+}
 
-	// Unregister requests from clients.
-	unregister chan *Client
+// Queue a message for one client, false once the hub has stopped.
+func (h *Hub) sendClient(client *Client, message []byte) bool {
+	return client.shard.inbox.push(func() { client.shard.direct(directMessage{client: client, data: message}) })
 }
 
-func newHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+// Hand a room message to every shard with someone in the room. Shards work
+// through it in parallel, nothing here waits on them.
+func (h *Hub) fanOut(message roomMessage) {
+	if h.policies.get(message.room).SharedKey {
+		message.sealed = h.seal(message.room, message.data)
+	}
+	for _, s := range h.shards {
+		if s.wants(message.room) {
+			s.inbox.push(func() { s.broadcast(message) })
+		}
 	}
 }
 
-func (h *Hub) run() {
+// Encrypt a broadcast once for the whole room. On failure the members get it
+// under their session keys as in any other room.
+func (h *Hub) seal(room string, data []byte) []byte {
+	key := h.roomKeys.get(room)
+	if key == nil {
+		return nil
+	}
+	ciphertext, err := key.cipher.Encrypt(data)
+	if err != nil {
+		hubLog.Error("sealing failed", "room", room, "err", err)
+		return nil
+	}
+	return []byte(sealedPrefix + ciphertext)
+}
+
+func (h *Hub) route(message directMessage) {
+	s := h.shardFor(message.address)
+	if message.client != nil {
+		s = message.client.shard
+	}
+	s.inbox.push(func() { s.direct(message) })
+}
+
+// Queue a message for the offline queue without waiting on it.
+func (h *Hub) spill(address string, message []byte) {
+	select {
+	case h.spills <- spilledMessage{address: address, data: message}:
+		metrics.SpilledMessages.Inc()
+	default:
+		metrics.DroppedMessages.Inc()
+		hubLog.Warn("offline queue backed up, dropping message", "address", address)
+	}
+}
+
+// Push spilled messages to the offline queue until ctx is done. Runs beside
+// run since the queue may be in Redis.
+func (h *Hub) writeOffline(ctx context.Context) {
 	for {
 		select {
-		case client := <-h.register:
-			h.clients[client] = true
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+		case <-ctx.Done():
+			return
+		case m := <-h.spills:
+			if err := h.offline.Push(ctx, m.address, m.data); err != nil {
+				hubLog.Error("offline queue push failed", "address", m.address, "err", err)
+			}
+		}
+	}
+}
+
+// Hand a reconnected client what was spilled while it was away. Messages still
+// on their way to the queue wait there for its next connection.
+func (h *Hub) redeliver(client *Client) {
+	messages, err := h.offline.Drain(context.Background(), client.address)
+	if err != nil {
+		hubLog.Error("offline queue drain failed", "address", client.address, "err", err)
+		return
+	}
+	for _, message := range unexpired(messages, time.Now()) {
+		if !h.sendClient(client, message) {
+			return
+		}
+	}
+}
+
+// Have every node stop spilling for an address that reconnected here
+func (h *Hub) resume(address string) {
+	data, err := json.Marshal(busFrame{Resumed: address})
+	if err == nil {
+		err = h.bus.Publish(context.Background(), h.cfg.Bus.Channel, data)
+	}
+	if err != nil {
+		hubLog.Warn("publish failed, other nodes keep spilling until the offline ttl", "address", address, "err", err)
+	}
+}
+
+// Run the hub and its shards until ctx is done.
+func (h *Hub) run(ctx context.Context) {
+	defer close(h.done)
+
+	for _, s := range h.shards {
+		go s.run(ctx)
+	}
+
+	heartbeat := time.NewTicker(h.cfg.Presence.Heartbeat)
+	defer heartbeat.Stop()
+	h.announce(presenceUpdate{Full: true, Sync: true})
+
+	if h.cfg.Backpressure.Policy == config.PolicySpill {
+		go h.writeOffline(ctx)
+	}
+
+	for {
+		metrics.BroadcastQueueDepth.Set(float64(len(h.broadcast)))
+
+		select {
+		case <-ctx.Done():
+			h.shutdown()
+			return
+		case d := <-h.members:
+			h.track(d.key, d.conns, d.away)
+		case update := <-h.presenceUpdates:
+			h.notify(h.presence.apply(update, time.Now()))
+			if update.Sync && update.Node != h.node {
+				h.announce(h.snapshot())
+			}
+		case f := <-h.calls:
+			f()
+		case <-heartbeat.C:
+			h.announce(h.snapshot())
+			h.notify(h.presence.expire(time.Now()))
+			now := time.Now()
+			for _, s := range h.shards {
+				s.inbox.push(func() { s.expireSpilled(now) })
 			}
 		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+			h.fanOut(message)
+		case message := <-h.direct:
+			h.route(message)
+		}
+	}
+}
+
+// Subscribe to the bus, messages from every node are then handed to run until ctx is done.
+func (h *Hub) listen(ctx context.Context) error {
+	return h.bus.Subscribe(ctx, h.cfg.Bus.Channel, h.receive)
+}
+
+func (h *Hub) receive(data []byte) {
+	var frame busFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		hubLog.Error("malformed bus frame", "err", err)
+		return
+	}
+
+	if frame.Room != "" {
+		select {
+		case h.broadcast <- roomMessage{room: frame.Room, data: frame.Data}:
+		case <-h.done:
+		}
+	} else if frame.Address != "" {
+		select {
+		case h.direct <- directMessage{address: frame.Address, data: frame.Data}:
+		case <-h.done:
+		}
+	} else if frame.Presence != nil {
+		select {
+		case h.presenceUpdates <- *frame.Presence:
+		case <-h.done:
+		}
+	} else if frame.Disconnect != "" {
+		h.disconnect(context.Background(), frame.Disconnect)
+	} else if frame.Evict != nil {
+		h.evict(*frame.Evict)
+	} else if frame.RoomKey != "" {
+		h.reloadKey(context.Background(), frame.RoomKey)
+	} else if frame.Resumed != "" {
+		s := h.shardFor(frame.Resumed)
+		s.inbox.push(func() { s.resume(frame.Resumed) })
+	}
+}
+
+// Run f on the hub goroutine and wait for it, so f may use the hub's state.
+func (h *Hub) do(ctx context.Context, f func()) error {
+	finished := make(chan struct{})
+	call := func() {
+		defer close(finished)
+		f()
+	}
+
+	select {
+	case h.calls <- call:
+	case <-h.done:
+		return errHubStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-finished
+	return nil
+}
+
+// Check run and every shard are still taking work
+func (h *Hub) ping(ctx context.Context) error {
+	if err := h.do(ctx, func() {}); err != nil {
+		return err
+	}
+	for _, s := range h.shards {
+		if err := s.do(ctx, func() {}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close every connection of an address on this node.
+func (h *Hub) disconnect(ctx context.Context, address string) (int, error) {
+	var n int
+	s := h.shardFor(address)
+	err := s.do(ctx, func() { n = s.disconnect(address) })
+	return n, err
+}
+
+// Drop an address from every node. When the bus is down only this node's connections go.
+func (h *Hub) disconnectAll(ctx context.Context, address string) error {
+	data, err := json.Marshal(busFrame{Disconnect: address})
+	if err == nil {
+		err = h.bus.Publish(ctx, h.cfg.Bus.Channel, data)
+	}
+	if err == nil {
+		return nil
+	}
+	hubLog.Warn("publish failed, disconnecting locally", "err", err)
+	_, err = h.disconnect(ctx, address)
+	return err
+}
+
+// Close a user's connections to a room on this node. The user may be on any shard.
+func (h *Hub) evict(e eviction) {
+	for _, s := range h.shards {
+		s.inbox.push(func() { s.evict(e.Room, e.User) })
+	}
+}
+
+// Drop a user from a room on every node. When the bus is down only this node's connections go.
+func (h *Hub) evictAll(ctx context.Context, room, user string) {
+	e := eviction{Room: room, User: user}
+	data, err := json.Marshal(busFrame{Evict: &e})
+	if err == nil {
+		err = h.bus.Publish(ctx, h.cfg.Bus.Channel, data)
+	}
+	if err != nil {
+		hubLog.Warn("publish failed, evicting locally", "err", err)
+		h.evict(e)
+	}
+
+	// They may hold the key from an earlier visit even if not connected now
+	if h.policies.get(room).SharedKey {
+		h.rotateKey(ctx, room)
+	}
+}
+
+// Publish to every node. If the bus is down the message still reaches this
+// node's clients. False once the hub has stopped.
+func (h *Hub) publish(frame busFrame) bool {
+	data, err := json.Marshal(frame)
+	if err == nil {
+		err = h.bus.Publish(context.Background(), h.cfg.Bus.Channel, data)
+	}
+	if err == nil {
+		select {
+		case <-h.done:
+			return false
+		default:
+			return true
+		}
+	}
+	hubLog.Warn("publish failed, delivering locally", "err", err)
+
+	if frame.Room != "" {
+		select {
+		case h.broadcast <- roomMessage{room: frame.Room, data: frame.Data}:
+			return true
+		case <-h.done:
+			return false
+		}
+	}
+	select {
+	case h.direct <- directMessage{address: frame.Address, data: frame.Data}:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Send to every client in a room, on every node.
+func (h *Hub) broadcastRoom(room string, message []byte) bool {
+	return h.publish(busFrame{Room: room, Data: message})
+}
+
+// Send to every connection of an address, on whichever node it is.
+func (h *Hub) sendTo(address string, message []byte) bool {
+	return h.publish(busFrame{Address: address, Data: message})
+}
+
+// Adjust a user's connection counts in a room, announcing any change to their
+// presence. Only called from run.
+func (h *Hub) track(key memberKey, conns, away int) {
+	m, ok := h.local[key]
+	if !ok {
+		m = &localMember{}
+		h.local[key] = m
+	}
+
+	before := m.entry(key)
+	m.conns += conns
+	m.away += away
+	after := m.entry(key)
+
+	if after.Gone {
+		delete(h.local, key)
+	}
+	if after != before {
+		h.announce(presenceUpdate{Entries: []presenceEntry{after}})
+	}
+}
+
+// Everything this node has, for heartbeats and nodes asking to sync
+func (h *Hub) snapshot() presenceUpdate {
+	update := presenceUpdate{Full: true}
+	for key, m := range h.local {
+		update.Entries = append(update.Entries, m.entry(key))
+	}
+	return update
+}
+
+// Publish this node's presence. Called from run, so when the bus is down the
+// update is applied here directly instead of waiting for it to come back.
+func (h *Hub) announce(update presenceUpdate) {
+	update.Node = h.node
+	data, err := json.Marshal(busFrame{Presence: &update})
+	if err == nil {
+		err = h.bus.Publish(context.Background(), h.cfg.Bus.Channel, data)
+	}
+	if err != nil {
+		hubLog.Warn("presence announcement failed, applying locally", "err", err)
+		h.notify(h.presence.apply(update, time.Now()))
+	}
+}
+
+// Push presence changes to the clients in the affected rooms
+func (h *Hub) notify(events []presenceEvent) {
+	for _, event := range events {
+		frame, _ := json.Marshal(Envelope{Type: envelopePresence, Sender: event.key.user, Status: event.status})
+		h.fanOut(roomMessage{room: event.key.room, data: frame, transient: true})
+	}
+}
+
+// Let the other nodes drop our users now rather than after the heartbeat
+// times out. The shards send going away to their clients themselves.
+func (h *Hub) shutdown() {
+	clear(h.local)
+	h.announce(presenceUpdate{Full: true})
+}
+
+// Wait for the shards to stop and their clients to drain after run returned,
+// or for ctx to expire.
+func (h *Hub) wait(ctx context.Context) error {
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, s := range h.shards {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		for _, client := range s.draining {
+			select {
+			case <-client.writeDone:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
 	}
+	return nil
 }
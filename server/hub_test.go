@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/blob"
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+	"github.com/FelineJTD/secure-chat-kripto/server/history"
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+	"github.com/FelineJTD/secure-chat-kripto/server/offline"
+	"github.com/FelineJTD/secure-chat-kripto/server/rooms"
+)
+
+const testSharedKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+var testCipher, _ = handlers.NewCipher(testSharedKey)
+
+// Hub with an in-memory offline queue, file store and history
+func newTestHub(cfg *config.Config, b bus.Bus) *Hub {
+	hub := newHub(cfg, b, offline.NewMemory(cfg.Offline.Limit, cfg.Offline.TTL))
+	hub.files = blob.NewMemory()
+	hub.history = history.NewMemory(cfg.History.Limit)
+	hub.rooms = rooms.NewMemory()
+	return hub
+}
+
+// Serve the hub over a test server, skipping the handshake and Redis lookups
+func newTestServer(t *testing.T, hub *Hub) *httptest.Server {
+	t.Helper()
+	upgrader := newUpgrader(hub.cfg.WebSocket, nil)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		id, room := r.URL.Query().Get("id"), r.URL.Query().Get("room")
+		if room == "" {
+			room = defaultRoom
+		}
+
+		client := &Client{hub: hub, conn: conn, send: make(chan outbound, hub.cfg.WebSocket.SendBufferSize), writeDone: make(chan struct{}), address: "test:" + id, id: id, user: id, room: room, cipher: testCipher, connectedAt: time.Now()}
+		go client.writePump()
+		go client.readPump()
+		hub.join(client)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func dial(t *testing.T, srv *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Read and decrypt the next frame, queued messages arrive newline separated
+func readFrame(t *testing.T, conn *websocket.Conn) []string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var plaintexts []string
+	for _, part := range strings.Split(string(data), "\n") {
+		plaintext, err := handlers.Decrypt(testSharedKey, part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintexts = append(plaintexts, plaintext)
+	}
+	return plaintexts
+}
+
+func TestHubShutdownSendsGoingAway(t *testing.T) {
+	hub := newTestHub(config.Default(), bus.NewMemory())
+	ctx, cancel := context.WithCancel(context.Background())
+	go hub.run(ctx)
+
+	srv := newTestServer(t, hub)
+	conn := dial(t, srv, "id=alice")
+
+	// Make sure the client is registered before shutting down
+	hub.broadcast <- roomMessage{room: defaultRoom, data: []byte("before shutdown")}
+	if got := readFrame(t, conn); got[0] != "before shutdown" {
+		t.Fatalf("Unexpected message %q", got)
+	}
+
+	cancel()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Fatalf("Expected a going away close frame, got %v", err)
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	if err := hub.wait(waitCtx); err != nil {
+		t.Errorf("Clients did not drain: %v", err)
+	}
+}
+
+// Send an encrypted chat message the way a client would
+func send(t *testing.T, conn *websocket.Conn, message string) {
+	t.Helper()
+	encrypted, err := handlers.Encrypt(testSharedKey, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(encrypted)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHubFanOutAcrossNodes(t *testing.T) {
+	b := bus.NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var hubs []*Hub
+	for i := 0; i < 2; i++ {
+		hub := newTestHub(config.Default(), b)
+		if err := hub.listen(ctx); err != nil {
+			t.Fatal(err)
+		}
+		go hub.run(ctx)
+		hubs = append(hubs, hub)
+	}
+
+	alice := dial(t, newTestServer(t, hubs[0]), "id=alice")
+	bob := dial(t, newTestServer(t, hubs[1]), "id=bob")
+	carol := dial(t, newTestServer(t, hubs[1]), "id=carol&room=other")
+
+	// Both clients are registered once each sees its own addressed message
+	hubs[0].sendTo("test:alice", []byte("hello alice"))
+	hubs[0].sendTo("test:bob", []byte("hello bob"))
+	hubs[0].sendTo("test:carol", []byte("hello carol"))
+	expectMessage(t, alice, "hello alice")
+	expectMessage(t, bob, "hello bob")
+	expectMessage(t, carol, "hello carol")
+
+	send(t, alice, "from node 0")
+	expectMessage(t, alice, "from node 0")
+	expectMessage(t, bob, "from node 0")
+
+	// Rooms still separate clients across nodes
+	hubs[1].broadcastRoom("other", []byte("to other"))
+	if got := expectMessage(t, carol, "to other"); slices.Contains(got, "from node 0") {
+		t.Error("Message leaked into another room")
+	}
+}
+
+// Read until a frame carries want, returning everything read on the way
+func expectMessage(t *testing.T, conn *websocket.Conn, want string) []string {
+	t.Helper()
+	var seen []string
+	for {
+		parts := readFrame(t, conn)
+		seen = append(seen, parts...)
+		if slices.Contains(parts, want) {
+			return seen
+		}
+	}
+}
+
+func TestHubMetrics(t *testing.T) {
+	cfg := config.Default()
+	cfg.Admin.Token = testAdminToken
+	hub := newTestHub(cfg, bus.NewMemory())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := hub.listen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go hub.run(ctx)
+
+	in, out := testutil.ToFloat64(metrics.MessagesIn), testutil.ToFloat64(metrics.MessagesOut)
+
+	conn := dial(t, newTestServer(t, hub), "id=alice")
+	send(t, conn, "counted")
+	expectMessage(t, conn, "counted")
+
+	// Hubs of earlier tests may still be shutting down, so only a lower bound holds
+	if got := testutil.ToFloat64(metrics.ConnectedClients); got < 1 {
+		t.Errorf("Expected at least 1 connected client, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.MessagesIn); got != in+1 {
+		t.Errorf("Expected %v messages in, got %v", in+1, got)
+	}
+	// The presence join and the message itself
+	if got := testutil.ToFloat64(metrics.MessagesOut); got < out+2 {
+		t.Errorf("Expected at least %v messages out, got %v", out+2, got)
+	}
+
+	routes := setupRoutes(hub, hub.cfg)
+	if rec := request(routes, http.MethodGet, "/metrics", testAdminToken); !strings.Contains(rec.Body.String(), "securechat_connected_clients") {
+		t.Error("Metrics endpoint does not expose the hub metrics")
+	}
+	if rec := request(routes, http.MethodGet, "/metrics", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected metrics to need the admin token, got %d", rec.Code)
+	}
+}
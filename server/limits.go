@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+	"github.com/FelineJTD/secure-chat-kripto/server/ratelimit"
+)
+
+// Rate limits shared by every connection to this node
+type limits struct {
+	handshakes *ratelimit.Keyed // Per IP
+	connects   *ratelimit.Keyed // Per IP
+	users      *ratelimit.Keyed // Per verified user, or per session without one
+	uploads    *ratelimit.Keyed // Per session
+}
+
+func newLimits(cfg config.RateLimits) *limits {
+	return &limits{
+		handshakes: ratelimit.NewKeyed(cfg.Handshakes),
+		connects:   ratelimit.NewKeyed(cfg.Connects),
+		users:      ratelimit.NewKeyed(cfg.Users),
+		uploads:    ratelimit.NewKeyed(cfg.Uploads),
+	}
+}
+
+// Close a connection that went over a limit with a policy violation. Control
+// frames may be written alongside writePump.
+func closeRateLimited(conn *websocket.Conn, limit string, writeWait time.Duration) {
+	metrics.RateLimited.WithLabelValues(limit).Inc()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"), time.Now().Add(writeWait))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+	"github.com/FelineJTD/secure-chat-kripto/server/ratelimit"
+)
+
+func TestMessageRateLimitClosesSocket(t *testing.T) {
+	cfg := config.Default()
+	cfg.Limits.Messages = config.Limit{Rate: 0.001, Burst: 2}
+
+	hub := newTestHub(cfg, bus.NewMemory())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.run(ctx)
+
+	conn := dial(t, newTestServer(t, hub), "id=alice")
+	for i := 0; i < 3; i++ {
+		send(t, conn, "flood")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+			t.Fatalf("Expected a policy violation close frame, got %v", err)
+		}
+		return
+	}
+}
+
+// Frames are counted per verified user across their sessions, a session that
+// only claimed the name has a bucket of its own
+func TestUserRateLimit(t *testing.T) {
+	hub, mr, _ := newAdminHub(t)
+	hub.limits.users = ratelimit.NewKeyed(config.Limit{Rate: 0.001, Burst: 1})
+	srv := httptest.NewServer(setupRoutes(hub, hub.cfg))
+	t.Cleanup(srv.Close)
+	chat := func(session string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/chat/?session="+session, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	// Another session claiming to be alice
+	impostor := strings.Repeat("ab", 16)
+	mr.Set(middlewares.SessionAddress(impostor), testSharedKey)
+	mr.Set(middlewares.SessionAddress(impostor)+":user", "alice")
+	claimed := chat(impostor)
+	send(t, claimed, "claimed")
+	expectMessage(t, claimed, "claimed")
+
+	first := chat(login(mr, "alice"))
+	send(t, first, "still heard")
+	expectMessage(t, first, "still heard")
+
+	second := dial(t, newTestServer(t, hub), "id=alice")
+	send(t, second, "one too many")
+	expectClosed(t, second, websocket.ClosePolicyViolation)
+}
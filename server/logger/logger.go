@@ -1,92 +1,213 @@
 package logger
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
 )
 
+// Below debug, for per frame tracing
+const LevelMinutia = slog.Level(-8)
+
+// Component of the records logged through the package level helpers
+const defaultComponent = "server"
+
 var (
-	verbosity int = 1 // Default at info
-	// 3: Minutia, 2: Debug, 1: Info, 0: Error
+	// Where every component logger ends up, replaced by Setup
+	root atomic.Pointer[slog.Handler]
+
+	mu           sync.Mutex
+	levels       = map[string]*slog.LevelVar{}
+	defaultLevel = slog.LevelInfo
+
+	// Redacted by key too, for values that are not typed as a Secret
+	sensitiveKeys = map[string]bool{
+		"key":         true,
+		"shared_key":  true,
+		"private_key": true,
+		"plaintext":   true,
+		"secret":      true,
+		"password":    true,
+	}
 )
 
-func SetVerbosity(v int) {
-	verbosity = v
+func init() {
+	setRoot(os.Stderr, "json")
 }
 
-func HandleError(err error) {
-	if err != nil {
-		_, file, line, ok := runtime.Caller(1)
-
-		if !ok {
-			log.Println("Error retrieving details of error") // God Help Us
-			return
-		}
+func setRoot(w io.Writer, format string) {
+	opts := &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       LevelMinutia, // Components filter before records get here
+		ReplaceAttr: replaceAttr,
+	}
 
-		errorMsg := fmt.Sprintf("[ERROR => %s:%d ]: %s", file, line, err)
-		log.Println(errorMsg)
+	var h slog.Handler
+	if format == "text" {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
 	}
+	root.Store(&h)
 }
 
-func HandleFatal(err error) {
-	if err != nil {
-		_, file, line, ok := runtime.Caller(1)
-
-		if !ok {
-			log.Println("Error retrieving details of fatal error") // God Help Us
-			return
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok && level <= LevelMinutia {
+			return slog.String(slog.LevelKey, "MINUTIA")
 		}
+	}
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
 
-		errorMsg := fmt.Sprintf("[FATAL => %s:%d ]: %s", file, line, err)
-		log.Fatalln(errorMsg)
+// 3: Minutia, 2: Debug, 1: Info, 0: Error
+func levelForVerbosity(v int) slog.Level {
+	switch {
+	case v <= 0:
+		return slog.LevelError
+	case v == 1:
+		return slog.LevelInfo
+	case v == 2:
+		return slog.LevelDebug
+	default:
+		return LevelMinutia
 	}
 }
 
-func Info(info string) {
-	if verbosity < 1 {
-		return
+func parseLevel(s string) (slog.Level, error) {
+	if strings.EqualFold(s, "minutia") {
+		return LevelMinutia, nil
 	}
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
 
-	_, file, line, ok := runtime.Caller(1)
+func levelFor(component string) *slog.LevelVar {
+	mu.Lock()
+	defer mu.Unlock()
 
+	level, ok := levels[component]
 	if !ok {
-		log.Println("Error retrieving details of info") // God Help Us, But Kinda Less
-		return
+		level = &slog.LevelVar{}
+		level.Set(defaultLevel)
+		levels[component] = level
 	}
-
-	infoMsg := fmt.Sprintf("[INFO => %s:%d ]: %s", file, line, info)
-	log.Println(infoMsg)
+	return level
 }
 
-func Debug(info string) {
-	if verbosity < 2 {
-		return
+// Write to w in the configured format and apply the per component levels.
+// Components without a level of their own follow Verbosity.
+func Setup(cfg config.Log, w io.Writer) error {
+	overrides := make(map[string]slog.Level, len(cfg.Levels))
+	for component, s := range cfg.Levels {
+		level, err := parseLevel(s)
+		if err != nil {
+			return fmt.Errorf("log level for %s: %w", component, err)
+		}
+		overrides[component] = level
 	}
 
-	_, file, line, ok := runtime.Caller(1)
+	setRoot(w, cfg.Format)
 
-	if !ok {
-		log.Println("Error retrieving details of debug") // God Help Us, But Kinda Less
-		return
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLevel = levelForVerbosity(cfg.Verbosity)
+	for component, level := range overrides {
+		if _, ok := levels[component]; !ok {
+			levels[component] = &slog.LevelVar{}
+		}
+		levels[component].Set(level)
 	}
+	for component, level := range levels {
+		if _, ok := overrides[component]; !ok {
+			level.Set(defaultLevel)
+		}
+	}
+	return nil
+}
 
-	infoMsg := fmt.Sprintf("[DEBUG => %s:%d ]: %s", file, line, info)
-	log.Println(infoMsg)
+// Logger for one component, usable before Setup and following it afterwards
+func For(component string) *slog.Logger {
+	return slog.New(&componentHandler{level: levelFor(component)}).With("component", component)
 }
 
-func Minute(info string) {
-	if verbosity < 3 {
-		return
+// WithAttrs or WithGroup, replayed on the root handler for each record
+type handlerOp struct {
+	attrs []slog.Attr
+	group string
+}
+
+// Filters by the component's level and hands records to whatever root is current
+type componentHandler struct {
+	level *slog.LevelVar
+	ops   []handlerOp
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	handler := *root.Load()
+	for _, op := range h.ops {
+		if op.group != "" {
+			handler = handler.WithGroup(op.group)
+		} else {
+			handler = handler.WithAttrs(op.attrs)
+		}
 	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *componentHandler) with(op handlerOp) *componentHandler {
+	return &componentHandler{level: h.level, ops: append(h.ops[:len(h.ops):len(h.ops)], op)}
+}
 
-	_, file, line, ok := runtime.Caller(1)
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(handlerOp{attrs: attrs})
+}
 
-	if !ok {
-		log.Println("Error retrieving details of minutia") // God Help Us, But Kinda Less
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.with(handlerOp{group: name})
+}
+
+var defaultLogger = For(defaultComponent)
+
+// Log at the caller's position, skip counts the frames between it and log
+func log(level slog.Level, skip int, msg string, args ...any) {
+	ctx := context.Background()
+	if !defaultLogger.Enabled(ctx, level) {
 		return
 	}
+	var pcs [1]uintptr
+	runtime.Callers(skip+2, pcs[:])
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	r.Add(args...)
+	defaultLogger.Handler().Handle(ctx, r)
+}
 
-	infoMsg := fmt.Sprintf("[MINUTIA => %s:%d ]: %s", file, line, info)
-	log.Println(infoMsg)
-}
\ No newline at end of file
+func HandleError(err error) {
+	if err != nil {
+		log(slog.LevelError, 1, "error", "err", err)
+	}
+}
+
+func HandleFatal(err error) {
+	if err != nil {
+		log(slog.LevelError, 1, "fatal", "err", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,56 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+)
+
+func TestSecretRedacted(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Setup(config.Log{Verbosity: 1, Format: "json"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Setup(config.Log{Verbosity: 1, Format: "json"}, os.Stderr) })
+
+	key := Secret("00112233445566778899aabbccddeeff")
+	log := For("test")
+	log.Info("typed", "session", key)
+	log.Info("by key", "shared_key", "00112233445566778899aabbccddeeff")
+	log.Info(fmt.Sprintf("formatted %v %s %#v", key, key, key))
+
+	if strings.Contains(buf.String(), key.Reveal()) {
+		t.Errorf("Secret leaked into the log:\n%s", buf.String())
+	}
+	if b, _ := json.Marshal(map[string]Secret{"key": key}); strings.Contains(string(b), key.Reveal()) {
+		t.Errorf("Secret leaked into JSON: %s", b)
+	}
+}
+
+func TestComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Setup(config.Log{Verbosity: 0, Format: "json", Levels: map[string]string{"chatty": "debug"}}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Setup(config.Log{Verbosity: 1, Format: "json"}, os.Stderr) })
+
+	For("quiet").Info("dropped")
+	For("chatty").Debug("kept")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected exactly one JSON record, got %q", buf.String())
+	}
+	if record["msg"] != "kept" || record["component"] != "chatty" {
+		t.Errorf("Unexpected record %v", record)
+	}
+
+	if err := Setup(config.Log{Levels: map[string]string{"x": "loud"}}, &buf); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,36 @@
+package logger
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+const redacted = "[REDACTED]"
+
+// Key material or plaintext. Every way of printing it, slog, fmt or JSON,
+// yields a placeholder, Reveal is the only way to the value.
+type Secret string
+
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+func (Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+func (Secret) String() string {
+	return redacted
+}
+
+func (Secret) GoString() string {
+	return redacted
+}
+
+func (Secret) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, redacted)
+}
+
+func (Secret) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}
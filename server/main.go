@@ -1,148 +1,415 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"io"
-	"math/big"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/certs"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
 	"github.com/FelineJTD/secure-chat-kripto/server/ecdh"
 	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+	"github.com/FelineJTD/secure-chat-kripto/server/history"
 	"github.com/FelineJTD/secure-chat-kripto/server/logger"
-	// "github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+	"github.com/FelineJTD/secure-chat-kripto/server/offline"
+	"github.com/FelineJTD/secure-chat-kripto/server/providers"
+	"github.com/FelineJTD/secure-chat-kripto/server/rooms"
 )
 
-type Message struct {
-	Sender  int    `json:"sender"`
-	Message string `json:"message"`
-}
+var (
+	httpLog = logger.For("http")
+	hubLog  = logger.For("hub")
+	wsLog   = logger.For("ws")
+)
 
 type PublicKey struct {
-	Port string `json:"port"`
+	Port      string `json:"port"`
 	PublicKey string `json:"public_key"`
 }
 
 type Handshake struct {
-	Port string `json:"port"`
+	Port      string `json:"port"`
 	PublicKey string `json:"public_key"`
+	VerifyKey string `json:"verify_key,omitempty"` // Optional Schnorr key the client will sign with
+	// Schnorr signature of "handshake <port> <public_key>" under VerifyKey, as
+	// produced by the client. Required with a verification key.
+	Sign string `json:"sign,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// What a client signs to prove it holds its verification key. The ECDH key
+// is fresh every handshake, so a signature overheard once opens nothing.
+func handshakeMessage(user, publicKey string) string {
+	return "handshake " + user + " " + publicKey
+}
+
+// Server's reply to the handshake, x and y are kept for older clients
+type HandshakeResponse struct {
+	X         string      `json:"x"`
+	Y         string      `json:"y"`
+	PublicKey *ecdh.Point `json:"public_key"`
+	Session   string      `json:"session"` // Sent as X-Session-Id and ?session= from now on
+}
+
+// The public key is either the compact hex encoding or the legacy nested JSON {"x", "y"}
+func parsePublicKey(s string) (*ecdh.Point, error) {
+	pubKey := &ecdh.Point{}
+
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		err = pubKey.UnmarshalJSON([]byte(s))
+	} else {
+		err = pubKey.UnmarshalText([]byte(strings.TrimSpace(s)))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if pubKey.IsInfinity() {
+		return nil, ecdh.ErrInfinity
+	}
+	return pubKey, nil
 }
 
 func homePage(w http.ResponseWriter, r *http.Request) {
-	logger.Info(r.RemoteAddr)
+	httpLog.Debug("home page", "remote", r.RemoteAddr)
 	w.Write([]byte("Home Page"))
 }
 
+// Handshake bodies are a few hundred bytes, anything past this is not one
+const maxHandshakeSize = 16 << 10
+
+// Why a handshake failed, as the client is told
+var (
+	errBadHandshake     = &apiError{http.StatusBadRequest, "bad_request", "body must be JSON with a port and a public_key"}
+	errBodyTooLarge     = &apiError{http.StatusRequestEntityTooLarge, "body_too_large", "request body too large"}
+	errInvalidPublicKey = &apiError{http.StatusUnprocessableEntity, "invalid_key", "public key is not a point on the curve"}
+	errInvalidVerifyKey = &apiError{http.StatusUnprocessableEntity, "invalid_verify_key", "verification key is not in the schnorr group"}
+	errBadSignature     = &apiError{http.StatusUnauthorized, "bad_signature", "sign must be a signature of \"handshake <port> <public_key>\" under verify_key"}
+	errSignatureNeeded  = &apiError{http.StatusUnauthorized, "signature_required", "the name is registered, sign the handshake with its verification key"}
+	errNameTaken        = &apiError{http.StatusConflict, "name_taken", "the name is bound to another verification key"}
+	errStoreUnavailable = &apiError{http.StatusServiceUnavailable, "store_unavailable", "session store unavailable, try again"}
+	errHandshakeFailed  = &apiError{http.StatusInternalServerError, "internal", "handshake failed"}
+)
+
 // Since the spec requested a handshake, It might be better to emulate it using a websocket, but this will do for now
 // In essence the client makes a PUT request sending its public key, the server then generates a shared key and sends back its public key
 // The client then calculates the shared key and can now send encrypted messages
 func keyEndpoint(w http.ResponseWriter, r *http.Request) {
-	var err error = nil
-	defer logger.HandleError(err)
+	start, result := time.Now(), errHandshakeFailed.code
+	defer func() {
+		metrics.Handshakes.WithLabelValues(result).Inc()
+		metrics.HandshakeDuration.Observe(time.Since(start).Seconds())
+	}()
 
-	body, err := io.ReadAll(r.Body)
+	id, err := handshake(r)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		result = handshakeFailed(w, r, err)
 		return
 	}
 
-	msgJSON := Handshake{}
-	if err = json.Unmarshal(body, &msgJSON); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// // Send the public key to the client as string
+	// pubKeyX := pubKey.X.String()
+	// pubKeyY := pubKey.Y.String()
+	pubKeyJSON, err := json.Marshal(HandshakeResponse{
+		X:         handlers.PubKey.X.String(),
+		Y:         handlers.PubKey.Y.String(),
+		PublicKey: handlers.PubKey,
+		Session:   id,
+	})
+	if err != nil {
+		result = handshakeFailed(w, r, errHandshakeFailed.because(err))
 		return
 	}
 
-	pubKeyClientTemp := PubKeyClient{}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(pubKeyJSON)
+	result = "ok"
+
+	httpLog.Info("handshake complete", "address", middlewares.SessionAddress(id), "request_id", middleware.GetReqID(r.Context()))
+}
 
-	if err = json.Unmarshal([]byte(msgJSON.PublicKey), &pubKeyClientTemp); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+// Store the session key agreed with the client, returning the id of the new session
+func handshake(r *http.Request) (string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxHandshakeSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "", errBodyTooLarge.because(err)
 	}
-
-	X, ok := new(big.Int).SetString(pubKeyClientTemp.X, 10)
-	if !ok {
-		err = errors.New("error parsing X from client public key")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	if err != nil {
+		return "", errBadHandshake.because(err)
 	}
 
-	Y, ok := new(big.Int).SetString(pubKeyClientTemp.Y, 10)
-	if !ok {
-		err = errors.New("error parsing Y from client public key")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	msgJSON := Handshake{}
+	if err := json.Unmarshal(body, &msgJSON); err != nil {
+		return "", errBadHandshake.because(err)
+	}
+	if msgJSON.Port == "" || msgJSON.PublicKey == "" {
+		return "", errBadHandshake
 	}
 
-	pubKeyClient := ecdh.Point{X: X, Y: Y}
-
-	address := strings.Split(r.RemoteAddr, ":")[0] + ":" + msgJSON.Port
-	logger.Info("Shaking Hands With: " + address)
+	pubKeyClient, err := parsePublicKey(msgJSON.PublicKey)
+	if err != nil {
+		return "", errInvalidPublicKey.because(err)
+	}
+	// Checked before anything is stored
+	if msgJSON.VerifyKey != "" {
+		if err := handlers.ValidateVerifyKey(msgJSON.VerifyKey); err != nil {
+			return "", classify(err, errInvalidVerifyKey)
+		}
+		ok, err := handlers.VerifySignature(msgJSON.VerifyKey, msgJSON.Sign, msgJSON.Hash, handshakeMessage(msgJSON.Port, msgJSON.PublicKey))
+		if err != nil {
+			return "", errBadSignature.because(err)
+		}
+		if !ok {
+			return "", errBadSignature
+		}
+	}
+	bound, err := handlers.BindVerifyKey(msgJSON.Port, msgJSON.VerifyKey)
+	if err != nil {
+		return "", classify(err, errHandshakeFailed)
+	}
+	// Names nobody registered a key for stay usable, just not as an identity
+	switch {
+	case bound != "" && msgJSON.VerifyKey == "":
+		return "", errSignatureNeeded
+	case bound != msgJSON.VerifyKey:
+		return "", errNameTaken
+	}
 
-	sk, err := handlers.GenerateKey(address, &pubKeyClient)
+	id, err := middlewares.NewSessionID()
 	if err != nil {
-		logger.HandleError(err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return "", errHandshakeFailed.because(err)
 	}
+	address := middlewares.SessionAddress(id)
+	httpLog.Info("handshake", "address", address, "user", msgJSON.Port, "request_id", middleware.GetReqID(r.Context()))
 
-	logger.Info("Generated Shared Key: " + sk)
+	if _, err := handlers.GenerateKey(address, msgJSON.Port, pubKeyClient); err != nil {
+		return "", classify(err, errInvalidPublicKey)
+	}
 
-	// // Send the public key to the client as string
-	// pubKeyX := pubKey.X.String()
-	// pubKeyY := pubKey.Y.String()
-	pubKeyJSON, err := json.Marshal(PubKeyClient{X: handlers.PubKey.X.String(), Y: handlers.PubKey.Y.String()})
-	if err != nil {
-		logger.HandleError(err)
-		return
+	if msgJSON.VerifyKey != "" {
+		if err := handlers.SetVerifyKey(address, msgJSON.VerifyKey); err != nil {
+			return "", classify(err, errInvalidVerifyKey)
+		}
 	}
+	return id, nil
+}
 
-	w.Write(pubKeyJSON)
+// The apiError for an error from handlers, invalid when the key was at fault
+func classify(err error, invalid *apiError) error {
+	switch {
+	case errors.Is(err, handlers.ErrInvalidKey):
+		return invalid.because(err)
+	case errors.Is(err, handlers.ErrStoreUnavailable):
+		return errStoreUnavailable.because(err)
+	}
+	return errHandshakeFailed.because(err)
+}
+
+// Tell the client why its handshake failed and log the cause with the request
+// id, returning the error code for the metrics
+func handshakeFailed(w http.ResponseWriter, r *http.Request, err error) string {
+	var e *apiError
+	if !errors.As(err, &e) {
+		e = errHandshakeFailed
+	}
 
-	logger.Info("Handshake Complete")
+	level := slog.LevelInfo
+	if e.status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	httpLog.Log(r.Context(), level, "handshake failed", "request_id", middleware.GetReqID(r.Context()), "remote", r.RemoteAddr, "code", e.code, "err", err)
+	middlewares.WriteError(w, r, e.status, e.code, e.message)
+	return e.code
 }
 
 func getParams(w http.ResponseWriter, r *http.Request) {
 	p, q, gen := handlers.GetSchnorr()
 
-	payload := []byte(`{"p": "` + hex.EncodeToString(p) + `", "q": "` + hex.EncodeToString(q) + `", "gen": "` + hex.EncodeToString(gen) + `"}`)
+	// Clients pin the id, a mismatch means their stored keys were made for other parameters
+	if pinned := r.URL.Query().Get("id"); pinned != "" && pinned != handlers.SchnorrParamsID {
+		http.Error(w, "Schnorr Parameters Changed", http.StatusConflict)
+		return
+	}
+
+	payload := []byte(`{"id": "` + handlers.SchnorrParamsID + `", "p": "` + hex.EncodeToString(p) + `", "q": "` + hex.EncodeToString(q) + `", "gen": "` + hex.EncodeToString(gen) + `"}`)
 	w.Write(payload)
 }
 
-func setupRoutes(hub *Hub) http.Handler {
+func setupRoutes(hub *Hub, cfg *config.Config) http.Handler {
+	origins := middlewares.NewOriginPolicy(cfg.Server.AllowedOrigins)
+	upgrader := newUpgrader(cfg.WebSocket, origins.CheckOrigin)
+
 	r := chi.NewRouter()
 
-	r.Use(cors.AllowAll().Handler)
-	r.Use(middleware.RealIP)
+	r.Use(middleware.RequestID)
+	r.Use(origins.CORS())
+	// Proxies were checked with the rest of the config
+	proxies, _ := middlewares.ParsePrefixes(cfg.Server.TrustedProxies)
+	r.Use(middlewares.RealIP(proxies))
 
-	r.Put("/key", keyEndpoint)
+	r.With(middlewares.RateLimit(hub.limits.handshakes, "handshakes")).Put("/key", keyEndpoint)
 
 	r.Get("/schnorr", getParams)
 
 	r.Get("/", homePage)
 
+	r.Get("/healthz", healthEndpoint)
+	r.Get("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyEndpoint(hub, providers.Ping, w, r)
+	})
+
+	if auth := adminAuth(cfg.Admin.Token, cfg.Server.TLS.ClientCAFile); auth != nil {
+		r.With(auth...).Mount("/admin", adminRoutes(hub))
+		// Metrics tell who is online and how busy each room is, so they are admin only
+		r.With(auth...).Handle("/metrics", promhttp.Handler())
+	} else {
+		httpLog.Info("admin API and metrics disabled, set admin.token or server.tls.client_ca_file to enable them")
+	}
+
+	// Everything a session calls over REST is encrypted under its key. The
+	// largest body taken is a file chunk after its 16 byte nonce, twice as
+	// long in hex.
+	encrypted := middlewares.Encrypted(handlers.SessionOf, handlers.ClaimNonce, 2*int64(cfg.Files.ChunkSize+16))
+
+	r.Mount("/api/v1", apiRoutes(hub, encrypted))
+
+	r.Group(func(r chi.Router) {
+		r.Use(encrypted)
+
+		r.Mount("/files", fileRoutes(hub.files, cfg.Files, hub.limits.uploads, handlers.ReserveUploads))
+
+		r.Get("/presence", func(w http.ResponseWriter, r *http.Request) {
+			presenceEndpoint(hub, w, r)
+		})
+	})
+
 	r.Route("/chat", func(r chi.Router) {
 		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-			serveWs(hub, w, r)
+			serveWs(hub, upgrader, w, r)
 		})
 	})
 
 	return r
 }
 
+// Listen until the server is shut down, over TLS when a certificate is configured
+func serve(ctx context.Context, srv *http.Server, cfg *config.Config) error {
+	if !cfg.Server.TLS.Enabled() {
+		httpLog.Info("server started", "url", "http://"+cfg.Server.Addr)
+		return srv.ListenAndServe()
+	}
+
+	tlsConfig, err := certs.ServerConfig(ctx, cfg.Server.TLS)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = tlsConfig
+
+	httpLog.Info("server started", "url", "https://"+cfg.Server.Addr)
+	return srv.ListenAndServeTLS("", "")
+}
+
+// Redis fans messages out to every instance sharing it, memory keeps them on this one
+func newBus(cfg config.Bus) bus.Bus {
+	if cfg.Driver == "memory" {
+		return bus.NewMemory()
+	}
+	return bus.NewRedis(providers.Pool)
+}
+
+// Messages for disconnected clients, in Redis unless a single instance is enough
+func newOffline(cfg config.Offline) offline.Queue {
+	if cfg.Driver == "memory" {
+		return offline.NewMemory(cfg.Limit, cfg.TTL)
+	}
+	return offline.NewRedis(providers.Pool, cfg.Limit, cfg.TTL)
+}
+
+// Room history in Redis unless a single instance is enough
+func newHistory(cfg config.History) history.Store {
+	if cfg.Driver == "memory" {
+		return history.NewMemory(cfg.Limit)
+	}
+	return history.NewRedis(providers.Pool, cfg.Limit)
+}
+
+// Rooms made through the API in Redis unless a single instance is enough
+func newRooms(cfg config.Rooms) rooms.Store {
+	if cfg.Driver == "memory" {
+		return rooms.NewMemory()
+	}
+	return rooms.NewRedis(providers.Pool)
+}
+
 func main() {
-	flag.Parse()
-	hub := newHub()
-	go hub.run()
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	logger.HandleFatal(err)
+
+	logger.HandleFatal(logger.Setup(cfg.Log, os.Stderr))
+	providers.Setup(cfg.Redis)
+
+	// Refuse to start rather than serve parameters that would break stored keys
+	logger.HandleFatal(handlers.LoadSchnorr(cfg.Server.SchnorrParams))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hubCtx, stopHub := context.WithCancel(context.Background())
+	hub := newHub(cfg, newBus(cfg.Bus), newOffline(cfg.Offline))
+	hub.history = newHistory(cfg.History)
+	hub.rooms = newRooms(cfg.Rooms)
+	go sweepHistory(hubCtx, hub.history, cfg.History.Sweep, systemClock{})
+	hub.files, err = newFiles(cfg.Files)
+	logger.HandleFatal(err)
+	go expireFiles(hubCtx, hub.files, cfg.Files.TTL)
+	logger.HandleFatal(hub.listen(hubCtx))
+	go hub.run(hubCtx)
+
+	r := setupRoutes(hub, cfg)
+	srv := &http.Server{Addr: cfg.Server.Addr, Handler: r}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, cfg)
+	}()
+
+	select {
+	case err := <-serveErr:
+		logger.HandleFatal(err)
+	case <-ctx.Done():
+	}
 
-	r:= setupRoutes(hub)
+	// Stop accepting first, then have the hub send going away to every client and
+	// wait for their queues to flush
+	httpLog.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
 
-	logger.Info("Server started at http://localhost:8080")
-	logger.HandleFatal(http.ListenAndServe(":8080", r))
-}
\ No newline at end of file
+	logger.HandleError(srv.Shutdown(shutdownCtx))
+	stopHub()
+	logger.HandleError(hub.wait(shutdownCtx))
+
+	httpLog.Info("server stopped")
+}
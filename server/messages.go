@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/history"
+)
+
+// Longest reaction accepted, in bytes, enough for any emoji sequence
+const maxReactionLength = 32
+
+var (
+	errNoSuchMessage      = errors.New("no such message")
+	errNotAuthor          = errors.New("only the sender may change a message")
+	errMessageDeleted     = errors.New("message was deleted")
+	errBadReaction        = errors.New("reaction must be a single emoji")
+	errHistoryUnavailable = errors.New("history unavailable, try again")
+)
+
+// Chat frames are checked against the room policy and relayed, anything else is a control frame
+func isChat(kind string) bool {
+	return kind == envelopeMessage || kind == envelopeFile || kind == envelopeEdit
+}
+
+// Handle a chat frame, false once the hub has stopped.
+func (c *Client) chat(env *Envelope) bool {
+	switch env.Type {
+	case envelopeFile:
+		if err := c.checkFile(env); err != nil {
+			return c.reject(err)
+		}
+	case envelopeEdit:
+		return c.amend(env)
+	}
+	return c.hub.broadcastRoom(c.room, c.record(env))
+}
+
+// Keep a chat message in the room's history, returning it as relayed with its
+// id. Without history the message still goes out, it just cannot be referred
+// to. The sender is always the session's, whatever the frame said.
+func (c *Client) record(env *Envelope) []byte {
+	env.Sender = c.id
+	now := time.Now()
+	m := history.Message{Room: c.room, Author: c.author(), Sender: c.id, SentAt: now}
+	if ttl := c.ttl(env); ttl > 0 {
+		m.ExpiresAt = now.Add(ttl)
+		env.Expires = &m.ExpiresAt
+	}
+	env.TTL = 0
+
+	data, _ := json.Marshal(env)
+	m.Envelope = data
+	m, err := c.hub.history.Append(context.Background(), m)
+	if err != nil {
+		wsLog.Error("history append failed, relaying without an id", "room", c.room, "err", err)
+		return data
+	}
+
+	env.ID = m.ID
+	data, _ = json.Marshal(env)
+	return data
+}
+
+// How long a message is kept, the shorter of the room's ttl and the one the sender asked for
+func (c *Client) ttl(env *Envelope) time.Duration {
+	ttl := c.hub.policies.get(c.room).TTL
+	if asked := time.Duration(env.TTL) * time.Second; asked > 0 && (ttl == 0 || asked < ttl) {
+		ttl = asked
+	}
+	return ttl
+}
+
+// Apply an edit, delete or reaction to the message it refers to and tell the
+// room, false once the hub has stopped. Whose message it is comes from the
+// user the session proved it is, never from the frame.
+func (c *Client) amend(env *Envelope) bool {
+	frame := Envelope{Type: env.Type, Ref: env.Ref, Sender: c.id}
+	_, err := c.hub.history.Update(context.Background(), c.room, env.Ref, func(m *history.Message) error {
+		if m.Deleted {
+			return errMessageDeleted
+		}
+
+		switch env.Type {
+		case envelopeEdit:
+			if m.Author != c.author() {
+				return errNotAuthor
+			}
+			if env.Message == "" {
+				return errMalformed
+			}
+			var stored Envelope
+			if err := json.Unmarshal(m.Envelope, &stored); err != nil {
+				return err
+			}
+			stored.Message, stored.Sign, stored.Hash = env.Message, env.Sign, env.Hash
+			data, err := json.Marshal(stored)
+			if err != nil {
+				return err
+			}
+			m.Envelope = data
+			m.EditedAt = time.Now()
+			frame.Message, frame.Sign, frame.Hash, frame.Expires = env.Message, env.Sign, env.Hash, stored.Expires
+		case envelopeDelete:
+			if m.Author != c.author() {
+				return errNotAuthor
+			}
+			m.Deleted = true
+			m.Envelope = nil
+			m.Reactions = nil
+		case envelopeReact, envelopeUnreact:
+			if env.Reaction == "" || len(env.Reaction) > maxReactionLength {
+				return errBadReaction
+			}
+			m.Reactions = react(m.Reactions, env.Reaction, c.id, env.Type == envelopeReact)
+			frame.Reaction = env.Reaction
+		}
+		return nil
+	})
+
+	switch {
+	case err == nil:
+	case errors.Is(err, history.ErrNotFound):
+		return c.reject(errNoSuchMessage)
+	case errors.Is(err, errNotAuthor), errors.Is(err, errMessageDeleted), errors.Is(err, errBadReaction), errors.Is(err, errMalformed):
+		return c.reject(err)
+	default:
+		wsLog.Error("history update failed", "room", c.room, "ref", env.Ref, "err", err)
+		return c.reject(errHistoryUnavailable)
+	}
+
+	data, _ := json.Marshal(frame)
+	return c.hub.broadcastRoom(c.room, data)
+}
+
+// Add or take back a user's reaction, each user reacts with an emoji once
+func react(reactions map[string][]string, emoji, user string, add bool) map[string][]string {
+	users := reactions[emoji]
+	i := slices.Index(users, user)
+	switch {
+	case add && i < 0:
+		if reactions == nil {
+			reactions = make(map[string][]string)
+		}
+		reactions[emoji] = append(users, user)
+	case !add && i >= 0:
+		if users = slices.Delete(users, i, i+1); len(users) == 0 {
+			delete(reactions, emoji)
+		} else {
+			reactions[emoji] = users
+		}
+	}
+	return reactions
+}
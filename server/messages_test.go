@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+)
+
+func ofType(kind string) func(Envelope) bool {
+	return func(env Envelope) bool { return env.Type == kind }
+}
+
+func sendEnvelope(t *testing.T, conn *websocket.Conn, env Envelope) {
+	t.Helper()
+	data, _ := json.Marshal(env)
+	send(t, conn, string(data))
+}
+
+func TestMessageEditDeleteAndReact(t *testing.T) {
+	hub := newTestHub(config.Default(), bus.NewMemory())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := hub.listen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go hub.run(ctx)
+
+	srv := newTestServer(t, hub)
+	alice := dial(t, srv, "id=alice")
+	bob := dial(t, srv, "id=bob")
+	expectEnvelope(t, alice, ofType(envelopePresence))
+
+	// The server numbers the message and keeps it
+	sendEnvelope(t, alice, Envelope{Type: envelopeMessage, Sender: "alice", Message: "first"})
+	sent := expectEnvelope(t, bob, ofType(envelopeMessage))
+	if sent.ID == "" || sent.Message != "first" {
+		t.Fatalf("Expected the message with an id, got %+v", sent)
+	}
+
+	// The sender is the session's, whatever the frame claims
+	sendEnvelope(t, bob, Envelope{Type: envelopeMessage, Sender: "alice", Message: "from bob"})
+	forged := expectEnvelope(t, alice, func(env Envelope) bool { return env.Message == "from bob" })
+	if m, _ := hub.history.Get(ctx, defaultRoom, forged.ID); forged.Sender != "bob" || m.Author != "bob" || m.Sender != "bob" {
+		t.Errorf("Expected bob's message kept as his, got %+v %+v", forged, m)
+	}
+
+	// Only alice may change it, whatever bob claims to be
+	sendEnvelope(t, bob, Envelope{Type: envelopeEdit, Ref: sent.ID, Sender: "alice", Message: "forged"})
+	if env := expectEnvelope(t, bob, ofType(envelopeError)); env.Error != errNotAuthor.Error() {
+		t.Errorf("Expected bob's edit to be refused, got %q", env.Error)
+	}
+	sendEnvelope(t, bob, Envelope{Type: envelopeDelete, Ref: sent.ID})
+	if env := expectEnvelope(t, bob, ofType(envelopeError)); env.Error != errNotAuthor.Error() {
+		t.Errorf("Expected bob's delete to be refused, got %q", env.Error)
+	}
+
+	sendEnvelope(t, alice, Envelope{Type: envelopeEdit, Ref: sent.ID, Message: "second"})
+	if env := expectEnvelope(t, bob, ofType(envelopeEdit)); env.Ref != sent.ID || env.Message != "second" || env.Sender != "alice" {
+		t.Errorf("Unexpected edit %+v", env)
+	}
+
+	sendEnvelope(t, bob, Envelope{Type: envelopeReact, Ref: sent.ID, Reaction: "👍"})
+	if env := expectEnvelope(t, alice, ofType(envelopeReact)); env.Reaction != "👍" || env.Sender != "bob" {
+		t.Errorf("Unexpected reaction %+v", env)
+	}
+
+	m, err := hub.history.Get(ctx, defaultRoom, sent.ID)
+	var stored Envelope
+	json.Unmarshal(m.Envelope, &stored)
+	if err != nil || stored.Message != "second" || m.EditedAt.IsZero() || len(m.Reactions["👍"]) != 1 {
+		t.Errorf("History does not hold the edit and reaction: %+v %v", m, err)
+	}
+
+	sendEnvelope(t, alice, Envelope{Type: envelopeDelete, Ref: sent.ID})
+	expectEnvelope(t, bob, ofType(envelopeDelete))
+	if m, _ := hub.history.Get(ctx, defaultRoom, sent.ID); !m.Deleted || m.Envelope != nil {
+		t.Errorf("Expected a tombstone, got %+v", m)
+	}
+
+	sendEnvelope(t, bob, Envelope{Type: envelopeReact, Ref: sent.ID, Reaction: "👍"})
+	if env := expectEnvelope(t, bob, ofType(envelopeError)); env.Error != errMessageDeleted.Error() {
+		t.Errorf("Expected reacting to a deleted message to fail, got %q", env.Error)
+	}
+	sendEnvelope(t, bob, Envelope{Type: envelopeReact, Ref: "404", Reaction: "👍"})
+	if env := expectEnvelope(t, bob, ofType(envelopeError)); env.Error != errNoSuchMessage.Error() {
+		t.Errorf("Expected an unknown message to be refused, got %q", env.Error)
+	}
+}
+
+func TestReact(t *testing.T) {
+	r := react(nil, "👍", "alice", true)
+	r = react(r, "👍", "alice", true)
+	r = react(r, "👍", "bob", true)
+	if len(r["👍"]) != 2 {
+		t.Fatalf("Expected each user to react once, got %v", r)
+	}
+	r = react(r, "👍", "alice", false)
+	r = react(r, "👍", "bob", false)
+	if _, ok := r["👍"]; ok {
+		t.Errorf("Expected the reaction gone with its last user, got %v", r)
+	}
+}
+
+// A session that only claimed its name still chats under it, it just cannot
+// use the name for anything that needs it proven
+func TestGuestKeepsClaimedName(t *testing.T) {
+	hub, mr, _ := newAdminHub(t)
+	srv := httptest.NewServer(setupRoutes(hub, hub.cfg))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/chat/?session="
+	carol, _, err := websocket.DefaultDialer.Dial(url+guest(mr, "carol"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { carol.Close() })
+	dave, _, err := websocket.DefaultDialer.Dial(url+guest(mr, "dave"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dave.Close() })
+	expectEnvelope(t, carol, isPresence("dave", presenceJoin))
+
+	sendEnvelope(t, carol, Envelope{Type: envelopeMessage, Message: "hello"})
+	if env := expectEnvelope(t, dave, ofType(envelopeMessage)); env.Sender != "carol" {
+		t.Errorf("Expected the message to come from carol, got %+v", env)
+	}
+	sendEnvelope(t, carol, Envelope{Type: envelopeTyping})
+	if env := expectEnvelope(t, dave, ofType(envelopeTyping)); env.Sender != "carol" {
+		t.Errorf("Expected carol to be typing, got %+v", env)
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "securechat"
+
+// 1ms to about 4s, a scalar multiplication on the project curve sits in the middle
+var latencyBuckets = prometheus.ExponentialBuckets(0.001, 2, 13)
+
+var (
+	ConnectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connected_clients",
+		Help:      "WebSocket clients registered with the hub.",
+	})
+
+	BroadcastQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hub_broadcast_queue_depth",
+		Help:      "Room messages waiting for the hub.",
+	})
+
+	MessagesIn = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_in_total",
+		Help:      "Frames read from clients.",
+	})
+
+	MessagesOut = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_out_total",
+		Help:      "Messages written to clients.",
+	})
+
+	DecryptFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decrypt_failures_total",
+		Help:      "Frames that could not be decrypted with the session key.",
+	})
+
+	// Per result: ok or failed
+	Handshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handshakes_total",
+		Help:      "Key exchanges handled, by result: ok or the error code the client got.",
+	}, []string{"result"})
+
+	HandshakeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handshake_duration_seconds",
+		Help:      "Time to handle a key exchange request.",
+		Buckets:   latencyBuckets,
+	})
+
+	ScalarMultDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scalar_mult_duration_seconds",
+		Help:      "Time to compute a shared secret.",
+		Buckets:   latencyBuckets,
+	})
+
+	// Per command, a missing key is not an error
+	RedisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Failed Redis commands.",
+	}, []string{"command"})
+
+	DroppedClients = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_slow_clients_total",
+		Help:      "Clients disconnected because their send buffer was full.",
+	})
+
+	DroppedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_messages_total",
+		Help:      "Messages not delivered because the client's send buffer was full.",
+	})
+
+	SpilledMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spilled_messages_total",
+		Help:      "Messages kept in the offline queue for clients dropped as too slow.",
+	})
+
+	// Refusals per limit: messages, users, handshakes, connects
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Frames and requests refused by a rate limit.",
+	}, []string{"limit"})
+)
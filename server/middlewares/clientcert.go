@@ -0,0 +1,22 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+)
+
+var log = logger.For("http")
+
+// Only let through requests that presented a client certificate the TLS layer verified.
+// Meant for admin routes when mTLS is configured.
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			log.Info("rejected request without client certificate", "remote", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "Client Certificate Required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
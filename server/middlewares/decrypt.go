@@ -1,54 +1,230 @@
 package middlewares
 
-// import (
-// 	"io"
-// 	"net/http"
-// 	"context"
-
-// 	"github.com/gomodule/redigo/redis"
-
-// 	"github.com/FelineJTD/secure-chat-kripto/server/logger"
-// 	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
-// )
-
-// type contextKey string
-
-// const (
-// 	BODY contextKey = "body"
-// )
-
-// func DecryptMiddleware(next http.Handler) http.Handler {
-// 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		var err error = nil
-// 		defer logger.HandleError(err)
-
-// 		body, err := io.ReadAll(r.Body)
-// 		if err != nil {
-// 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-// 			return
-// 		}
-
-// 		// Decrypt body
-// 		SharedKey, err := handlers.GetSharedKey(r.RemoteAddr)
-
-// 		if err != nil {
-// 			if err == redis.ErrNil {
-// 				http.Error(w, "No Shared Key Recorded, Must Perform Handshake", http.StatusBadRequest)
-// 				return
-// 			}
-
-// 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-// 			return
-// 		}
-
-// 		plaintext, err := handlers.Decrypt(SharedKey, body)
-
-// 		if err != nil {
-// 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-// 			return
-// 		}
-
-// 		ctx := context.WithValue(r.Context(), BODY, plaintext)
-// 		next.ServeHTTP(w, r.WithContext(ctx))
-// 	})
-// }
\ No newline at end of file
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+)
+
+const (
+	// The session id the handshake issued, the one the client connects to /chat with
+	SessionHeader = "X-Session-Id"
+
+	// Tag of the body, from Cipher.Sign, on requests and responses alike
+	BodyMACHeader = "X-Body-MAC"
+
+	// Hex encoded random value the client draws for every request, never reused
+	NonceHeader = "X-Request-Nonce"
+
+	// When the client sent the request, in Unix seconds
+	TimeHeader = "X-Request-Time"
+
+	// How far a request's time may be from the server's, either way. Nonces
+	// are only remembered this long, older requests are refused by their time.
+	RequestWindow = 5 * time.Minute
+)
+
+type contextKey string
+
+const sessionKey contextKey = "session"
+
+type session struct {
+	address string
+	user    string
+}
+
+// Looks up the cipher and user of a session, handlers.SessionOf outside tests
+type SessionLookup func(address string) (*handlers.Cipher, string, error)
+
+// Records a nonce of a session for ttl, false if it was recorded already.
+// handlers.ClaimNonce outside tests.
+type NonceClaim func(address, nonce string, ttl time.Duration) (bool, error)
+
+// Random id for a new session, the only thing it is looked up by. Nothing
+// about the client goes into it, so nobody can guess or spoof another's.
+func NewSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Whether id could have come from NewSessionID, checked before it goes into a Redis key
+func ValidSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Address the handshake stored the session under
+func SessionAddress(id string) string {
+	return "session:" + id
+}
+
+// Address and user id of the session an Encrypted request came from, empty outside one
+func Session(ctx context.Context) (address, user string) {
+	s, _ := ctx.Value(sessionKey).(session)
+	return s.address, s.user
+}
+
+// Bodies are hex encoded ciphertext under the session key named by the
+// X-Session-Id header. Requests are refused unless X-Body-MAC tags the
+// method, URI, time, nonce and body, so even a bodiless GET proves who sent
+// it. A request is only taken once, within RequestWindow of its time.
+// Responses are encrypted the same way, their tag covering the status and
+// the request they answer. Handlers read and write plaintext. Request bodies
+// are limited to limit bytes of hex.
+func Encrypted(lookup SessionLookup, claim NonceClaim, limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(SessionHeader)
+			if id == "" {
+				reject(w, r, http.StatusUnauthorized, "no_session", "X-Session-Id is required")
+				return
+			}
+			if !ValidSessionID(id) {
+				reject(w, r, http.StatusUnauthorized, "unknown_session", "no such session, perform the handshake first")
+				return
+			}
+			address := SessionAddress(id)
+
+			cipher, user, err := lookup(address)
+			if errors.Is(err, redis.ErrNil) {
+				reject(w, r, http.StatusUnauthorized, "unknown_session", "no session key, perform the handshake first")
+				return
+			}
+			if err != nil {
+				log.Error("session key lookup failed", "address", address, "request_id", middleware.GetReqID(r.Context()), "err", err)
+				WriteError(w, r, http.StatusServiceUnavailable, "unavailable", "session store unavailable, try again")
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				reject(w, r, http.StatusRequestEntityTooLarge, "body_too_large", "request body too large")
+				return
+			}
+			if err != nil {
+				reject(w, r, http.StatusBadRequest, "bad_body", "request body unreadable")
+				return
+			}
+
+			nonce, sent := r.Header.Get(NonceHeader), r.Header.Get(TimeHeader)
+			if !validNonce(nonce) {
+				reject(w, r, http.StatusUnauthorized, "bad_nonce", "X-Request-Nonce must be 16 to 32 random bytes in hex")
+				return
+			}
+			if !cipher.Verify(requestMAC(r, body), r.Header.Get(BodyMACHeader)) {
+				reject(w, r, http.StatusUnauthorized, "bad_mac", "X-Body-MAC does not match the request")
+				return
+			}
+			// Checked once the tag holds, so nobody else can use up a session's nonces
+			if !recent(sent, time.Now()) {
+				reject(w, r, http.StatusUnauthorized, "stale_request", "X-Request-Time is missing or too far from the server's clock")
+				return
+			}
+			fresh, err := claim(address, nonce, 2*RequestWindow)
+			if err != nil {
+				log.Error("nonce store failed", "address", address, "request_id", middleware.GetReqID(r.Context()), "err", err)
+				WriteError(w, r, http.StatusServiceUnavailable, "unavailable", "session store unavailable, try again")
+				return
+			}
+			if !fresh {
+				reject(w, r, http.StatusUnauthorized, "replayed_request", "request already received")
+				return
+			}
+			plaintext, err := cipher.Decrypt(string(body))
+			if err != nil {
+				reject(w, r, http.StatusBadRequest, "bad_body", "body must be hex encoded ciphertext")
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(plaintext))
+			r.ContentLength = int64(len(plaintext))
+			r = r.WithContext(context.WithValue(r.Context(), sessionKey, session{address: address, user: user}))
+
+			sw := &sealedWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+
+			ciphertext, err := cipher.Encrypt(sw.body.Bytes())
+			if err != nil {
+				log.Error("response encryption failed", "address", address, "request_id", middleware.GetReqID(r.Context()), "err", err)
+				WriteError(w, r, http.StatusInternalServerError, "internal", "internal server error")
+				return
+			}
+			w.Header().Del("Content-Length")
+			w.Header().Set(BodyMACHeader, cipher.Sign(responseMAC(r, sw.status, []byte(ciphertext))))
+			w.WriteHeader(sw.status)
+			io.WriteString(w, ciphertext)
+		})
+	}
+}
+
+// Errors before the session is known go out in the clear, the caller could not decrypt them
+func reject(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	log.Info("rejected encrypted request", "reason", code, "remote", r.RemoteAddr, "path", r.URL.Path, "request_id", middleware.GetReqID(r.Context()))
+	WriteError(w, r, status, code, message)
+}
+
+func validNonce(nonce string) bool {
+	if len(nonce) < 32 || len(nonce) > 64 {
+		return false
+	}
+	_, err := hex.DecodeString(nonce)
+	return err == nil
+}
+
+// Whether a request sent at sent, in Unix seconds, is within the window of now
+func recent(sent string, now time.Time) bool {
+	seconds, err := strconv.ParseInt(sent, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	return skew <= RequestWindow && skew >= -RequestWindow
+}
+
+// What a request's tag covers, so a body cannot be replayed to another route
+// or, with the nonce, to the same one
+func requestMAC(r *http.Request, body []byte) []byte {
+	return append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"+r.Header.Get(TimeHeader)+" "+r.Header.Get(NonceHeader)+"\n"), body...)
+}
+
+// What a response's tag covers, so it cannot pass for the answer to another request
+func responseMAC(r *http.Request, status int, body []byte) []byte {
+	return append([]byte(strconv.Itoa(status)+" "+r.Method+" "+r.URL.RequestURI()+"\n"+r.Header.Get(TimeHeader)+" "+r.Header.Get(NonceHeader)+"\n"), body...)
+}
+
+// Holds the response back until it can be encrypted whole
+type sealedWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+	body   bytes.Buffer
+}
+
+func (w *sealedWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.status, w.wrote = status, true
+	}
+}
+
+func (w *sealedWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.body.Write(p)
+}
@@ -0,0 +1,120 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+)
+
+const (
+	testKey     = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testSession = "00112233445566778899aabbccddeeff"
+)
+
+func TestEncrypted(t *testing.T) {
+	cipher, err := handlers.NewCipher(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(address string) (*handlers.Cipher, string, error) {
+		if address != "session:"+testSession {
+			return nil, "", redis.ErrNil
+		}
+		return cipher, "alice", nil
+	}
+
+	seen := map[string]bool{}
+	claim := func(address, nonce string, ttl time.Duration) (bool, error) {
+		fresh := !seen[address+nonce]
+		seen[address+nonce] = true
+		return fresh, nil
+	}
+
+	// Shouts back whatever it was sent, telling whose session it was
+	handler := Encrypted(lookup, claim, 64)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Length", "999")
+		w.WriteHeader(http.StatusCreated)
+		address, user := Session(r.Context())
+		io.WriteString(w, address+" "+user+" "+strings.ToUpper(string(body)))
+	}))
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	request := func(id, sent, nonce, body, mac string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/echo?x=1", strings.NewReader(body))
+		r.RemoteAddr = "192.0.2.1:50000"
+		if id != "" {
+			r.Header.Set(SessionHeader, id)
+		}
+		r.Header.Set(TimeHeader, sent)
+		r.Header.Set(NonceHeader, nonce)
+		r.Header.Set(BodyMACHeader, mac)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	nonce := strings.Repeat("ab", 16)
+	ciphertext, _ := cipher.Encrypt([]byte("hello"))
+	sign := func(sent, nonce, body string) string {
+		return cipher.Sign([]byte("POST /echo?x=1\n" + sent + " " + nonce + "\n" + body))
+	}
+	mac := sign(now, nonce, ciphertext)
+
+	rec := request(testSession, now, nonce, ciphertext, mac)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the handler's status, got %d: %s", rec.Code, rec.Body)
+	}
+	if !cipher.Verify([]byte("201 POST /echo?x=1\n"+now+" "+nonce+"\n"+rec.Body.String()), rec.Header().Get(BodyMACHeader)) {
+		t.Error("Response tag does not verify")
+	}
+	if rec.Header().Get("Content-Length") != "" {
+		t.Error("Plaintext length leaked into the response")
+	}
+	if plaintext, err := cipher.Decrypt(rec.Body.String()); err != nil || string(plaintext) != "session:"+testSession+" alice HELLO" {
+		t.Errorf("Unexpected response %q %v", plaintext, err)
+	}
+
+	tampered := []byte(ciphertext)
+	tampered[0] ^= 1
+	old := strconv.FormatInt(time.Now().Add(-RequestWindow-time.Minute).Unix(), 10)
+	other := strings.Repeat("cd", 16)
+	cases := []struct {
+		name                       string
+		id, sent, nonce, body, mac string
+		want                       int
+		code                       string
+	}{
+		{"no session id", "", now, other, ciphertext, mac, http.StatusUnauthorized, "no_session"},
+		{"made up session id", "alice", now, other, ciphertext, mac, http.StatusUnauthorized, "unknown_session"},
+		{"unknown session", "ffeeddccbbaa99887766554433221100", now, other, ciphertext, mac, http.StatusUnauthorized, "unknown_session"},
+		{"no mac", testSession, now, other, ciphertext, "", http.StatusUnauthorized, "bad_mac"},
+		{"tampered", testSession, now, nonce, string(tampered), mac, http.StatusUnauthorized, "bad_mac"},
+		{"other nonce", testSession, now, other, ciphertext, mac, http.StatusUnauthorized, "bad_mac"},
+		{"no nonce", testSession, now, "", ciphertext, sign(now, "", ciphertext), http.StatusUnauthorized, "bad_nonce"},
+		{"replayed", testSession, now, nonce, ciphertext, mac, http.StatusUnauthorized, "replayed_request"},
+		{"too old", testSession, old, other, ciphertext, sign(old, other, ciphertext), http.StatusUnauthorized, "stale_request"},
+		{"too large", testSession, now, other, strings.Repeat("00", 33), mac, http.StatusRequestEntityTooLarge, "body_too_large"},
+	}
+	for _, tc := range cases {
+		rec := request(tc.id, tc.sent, tc.nonce, tc.body, tc.mac)
+		var e ErrorBody
+		if json.Unmarshal(rec.Body.Bytes(), &e); rec.Code != tc.want || e.Code != tc.code {
+			t.Errorf("%s: expected %d %s, got %d %s", tc.name, tc.want, tc.code, rec.Code, rec.Body)
+		}
+	}
+
+	// A stale request was refused before its nonce was taken
+	if !seen["session:"+testSession+nonce] || seen["session:"+testSession+other] {
+		t.Error("Expected only the accepted request's nonce to be recorded")
+	}
+}
@@ -0,0 +1,82 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/cors"
+)
+
+// Origins allowed to call the API and open WebSockets. Entries are exact
+// origins, patterns with a single * such as https://*.example.com, or * alone
+// for any origin.
+type OriginPolicy struct {
+	any       bool
+	exact     map[string]bool
+	wildcards [][2]string
+}
+
+func NewOriginPolicy(origins []string) *OriginPolicy {
+	p := &OriginPolicy{exact: make(map[string]bool)}
+	for _, origin := range origins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		if origin == "*" {
+			p.any = true
+		} else if prefix, suffix, ok := strings.Cut(origin, "*"); ok {
+			p.wildcards = append(p.wildcards, [2]string{prefix, suffix})
+		} else {
+			p.exact[origin] = true
+		}
+	}
+	return p
+}
+
+func (p *OriginPolicy) Allowed(origin string) bool {
+	if p.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if len(origin) > len(w[0])+len(w[1]) && strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS for the allowed origins, others get no CORS headers so browsers block them
+func (p *OriginPolicy) CORS() func(http.Handler) http.Handler {
+	return cors.Handler(cors.Options{
+		AllowOriginFunc: func(r *http.Request, origin string) bool {
+			if !p.Allowed(origin) {
+				log.Info("rejected CORS request", "origin", origin, "remote", r.RemoteAddr)
+				return false
+			}
+			return true
+		},
+		AllowedMethods: []string{
+			http.MethodHead,
+			http.MethodGet,
+			http.MethodPost,
+			http.MethodPut,
+			http.MethodPatch,
+			http.MethodDelete,
+		},
+		AllowedHeaders: []string{"*"},
+		ExposedHeaders: []string{BodyMACHeader},
+	})
+}
+
+// For websocket.Upgrader. Requests without an Origin do not come from a
+// browser page, so there is no cross site request to protect against.
+func (p *OriginPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.Allowed(origin) {
+		return true
+	}
+	log.Info("rejected websocket", "origin", origin, "remote", r.RemoteAddr)
+	return false
+}
@@ -0,0 +1,46 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	p := NewOriginPolicy([]string{"http://localhost:5173/", "https://*.example.com"})
+
+	cases := map[string]bool{
+		"http://localhost:5173":    true,
+		"HTTP://LOCALHOST:5173":    true,
+		"http://localhost:8080":    false,
+		"https://chat.example.com": true,
+		"https://.example.com":     false,
+		"https://example.com":      false,
+		"https://evil.com":         false,
+		"https://example.com.evil": false,
+		"http://chat.example.com":  false,
+	}
+	for origin, want := range cases {
+		if got := p.Allowed(origin); got != want {
+			t.Errorf("%s: expected %v, got %v", origin, want, got)
+		}
+	}
+
+	if !NewOriginPolicy([]string{"*"}).Allowed("https://evil.com") {
+		t.Error("* did not allow every origin")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	p := NewOriginPolicy([]string{"http://localhost:5173"})
+
+	r := httptest.NewRequest(http.MethodGet, "/chat", nil)
+	if !p.CheckOrigin(r) {
+		t.Error("Request without an origin was rejected")
+	}
+
+	r.Header.Set("Origin", "https://evil.com")
+	if p.CheckOrigin(r) {
+		t.Error("Foreign origin was accepted")
+	}
+}
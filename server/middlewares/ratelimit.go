@@ -0,0 +1,39 @@
+package middlewares
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+	"github.com/FelineJTD/secure-chat-kripto/server/ratelimit"
+)
+
+// IP of the caller, RemoteAddr holds a bare IP once RealIP has replaced it
+func ClientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Refuse requests with 429 once the caller's IP runs out of tokens, name labels the metric
+func RateLimit(limits *ratelimit.Keyed, name string) func(http.Handler) http.Handler {
+	return RateLimitBy(limits, name, ClientIP)
+}
+
+// Refuse requests with 429 once whatever key gives for them runs out of tokens
+func RateLimitBy(limits *ratelimit.Keyed, name string, key func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if k := key(r); !limits.Allow(k) {
+				log.Info("rate limited", "limit", name, "client", k, "request_id", middleware.GetReqID(r.Context()))
+				metrics.RateLimited.WithLabelValues(name).Inc()
+				WriteError(w, r, http.StatusTooManyRequests, "rate_limited", "too many requests, slow down")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
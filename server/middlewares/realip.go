@@ -0,0 +1,78 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Parse proxy CIDRs, a bare address stands for itself alone
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Replace RemoteAddr with the client's IP from X-Forwarded-For or X-Real-IP,
+// but only for requests that came through one of the trusted proxies. Anyone
+// else could write whatever they like in those headers, so for them the
+// connection's address stands.
+func RealIP(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if peer, err := netip.ParseAddr(ClientIP(r)); err == nil && isTrusted(trusted, peer) {
+				if ip, ok := forwardedFor(trusted, r.Header); ok {
+					r.RemoteAddr = ip.String()
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isTrusted(trusted []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// The client a trusted proxy forwarded for. Each proxy appends the address it
+// was called from, so X-Forwarded-For is read from the right past the trusted
+// ones, what comes before the first untrusted hop may be made up.
+func forwardedFor(trusted []netip.Prefix, h http.Header) (netip.Addr, bool) {
+	if xff := h.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		var client netip.Addr
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr
+			if !isTrusted(trusted, addr) {
+				break
+			}
+		}
+		return client, client.IsValid()
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(h.Get("X-Real-IP")))
+	return addr, err == nil
+}
@@ -0,0 +1,49 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParsePrefixes([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	h := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = ClientIP(r)
+	}))
+
+	cases := []struct {
+		name, remote, xff, realIP, want string
+	}{
+		{"direct", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"untrusted peer", "203.0.113.7:5000", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"trusted single address", "192.168.1.1:5000", "", "198.51.100.2", "198.51.100.2"},
+		{"other address in its subnet", "192.168.1.2:5000", "198.51.100.1", "", "192.168.1.2"},
+		{"spoofed hop before proxies", "10.1.2.3:5000", "1.1.1.1, 198.51.100.1, 10.0.0.9", "", "198.51.100.1"},
+		{"only proxies", "10.1.2.3:5000", "10.0.0.8, 10.0.0.9", "", "10.0.0.8"},
+		{"garbage", "10.1.2.3:5000", "not an ip", "", "10.1.2.3"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+
+	if _, err := ParsePrefixes([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected an invalid CIDR to be refused")
+	}
+}
@@ -0,0 +1,23 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Only let through requests carrying Authorization: Bearer <token>
+func RequireBearerToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				log.Info("rejected request without a valid token", "remote", r.RemoteAddr, "path", r.URL.Path)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				WriteError(w, r, http.StatusUnauthorized, "unauthorized", "a valid bearer token is required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package offline
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type item struct {
+	data   []byte
+	queued time.Time
+}
+
+// In-process queues, lost on restart and only seen by this node
+type Memory struct {
+	mu     sync.Mutex
+	limit  int
+	ttl    time.Duration
+	queues map[string][]item
+}
+
+func NewMemory(limit int, ttl time.Duration) *Memory {
+	return &Memory{limit: limit, ttl: ttl, queues: make(map[string][]item)}
+}
+
+func (m *Memory) Push(ctx context.Context, address string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := append(m.queues[address], item{data: data, queued: time.Now()})
+	if len(q) > m.limit {
+		q = q[len(q)-m.limit:]
+	}
+	m.queues[address] = q
+	return nil
+}
+
+func (m *Memory) Drain(ctx context.Context, address string) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	q := m.queues[address]
+	delete(m.queues, address)
+	m.mu.Unlock()
+
+	var messages [][]byte
+	for _, it := range q {
+		if time.Since(it.queued) <= m.ttl {
+			messages = append(messages, it.data)
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,13 @@
+// Package offline keeps messages for clients that are not connected, to be
+// delivered when they come back.
+package offline
+
+import "context"
+
+type Queue interface {
+	// Append a message for address, dropping the oldest past the queue's limit
+	Push(ctx context.Context, address string, data []byte) error
+
+	// Take everything queued for address, oldest first
+	Drain(ctx context.Context, address string) ([][]byte, error)
+}
@@ -0,0 +1,63 @@
+package offline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func testQueue(t *testing.T, q Queue) {
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if err := q.Push(ctx, "alice", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Push(ctx, "bob", []byte("for bob"))
+
+	// Only the newest three are kept
+	messages, err := q.Drain(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%s", messages); got != "[2 3 4]" {
+		t.Errorf("Expected [2 3 4], got %s", got)
+	}
+
+	if messages, _ := q.Drain(ctx, "alice"); len(messages) != 0 {
+		t.Errorf("Expected the queue to be empty once drained, got %s", messages)
+	}
+	if messages, _ := q.Drain(ctx, "bob"); len(messages) != 1 {
+		t.Errorf("Expected bob's message to be kept, got %s", messages)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testQueue(t, NewMemory(3, time.Hour))
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	q := NewMemory(3, 0)
+	q.Push(context.Background(), "alice", []byte("stale"))
+	if messages, _ := q.Drain(context.Background(), "alice"); len(messages) != 0 {
+		t.Errorf("Expected expired messages to be skipped, got %s", messages)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) }}
+
+	testQueue(t, NewRedis(pool, 3, time.Hour))
+
+	q := NewRedis(pool, 3, time.Minute)
+	q.Push(context.Background(), "carol", []byte("stale"))
+	mr.FastForward(2 * time.Minute)
+	if messages, _ := q.Drain(context.Background(), "carol"); len(messages) != 0 {
+		t.Errorf("Expected the queue to expire, got %s", messages)
+	}
+}
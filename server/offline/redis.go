@@ -0,0 +1,66 @@
+package offline
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+)
+
+// Prefix of the Redis lists holding the queues, kept apart from the session keys
+const keyPrefix = "offline:"
+
+// Queues in Redis lists, shared by every node. The TTL applies to a whole
+// queue and is renewed by every push.
+type Redis struct {
+	pool  *redis.Pool
+	limit int
+	ttl   time.Duration
+}
+
+func NewRedis(pool *redis.Pool, limit int, ttl time.Duration) *Redis {
+	return &Redis{pool: pool, limit: limit, ttl: ttl}
+}
+
+// Run a transaction, counting a failure against its first command
+func (r *Redis) multi(ctx context.Context, commands ...[]any) ([]any, error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, c := range commands {
+		conn.Send(c[0].(string), c[1:]...)
+	}
+	replies, err := redis.Values(redis.DoContext(conn, ctx, "EXEC"))
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues(commands[0][0].(string)).Inc()
+	}
+	return replies, err
+}
+
+func (r *Redis) Push(ctx context.Context, address string, data []byte) error {
+	key := keyPrefix + address
+	_, err := r.multi(ctx,
+		[]any{"RPUSH", key, data},
+		[]any{"LTRIM", key, -r.limit, -1},
+		[]any{"PEXPIRE", key, r.ttl.Milliseconds()},
+	)
+	return err
+}
+
+func (r *Redis) Drain(ctx context.Context, address string) ([][]byte, error) {
+	key := keyPrefix + address
+	replies, err := r.multi(ctx,
+		[]any{"LRANGE", key, 0, -1},
+		[]any{"DEL", key},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return redis.ByteSlices(replies[0], nil)
+}
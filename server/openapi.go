@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/middlewares"
+)
+
+const apiDescription = `Everything but this spec is encrypted under the session key from the
+handshake. Requests name their session in ` + middlewares.SessionHeader + `, carry a fresh
+random nonce in ` + middlewares.NonceHeader + ` and their Unix time in ` + middlewares.TimeHeader + `,
+send the hex encoded ciphertext of their JSON body and tag "METHOD URI\nTIME NONCE\n"
+followed by that ciphertext in ` + middlewares.BodyMACHeader + `, bodiless requests included.
+A nonce is only taken once, and only within five minutes of the server's clock.
+Responses are encrypted the same way, their tag covering "STATUS METHOD
+URI\nTIME NONCE\n" and the ciphertext. Only sessions whose handshake was signed with
+the verification key bound to their name may call it, that name is the caller.
+The schemas below describe the plaintext.`
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// Errors any encrypted endpoint may answer with before reaching its handler
+var sessionErrors = map[int][]string{
+	http.StatusBadRequest:            {"bad_body"},
+	http.StatusUnauthorized:          {"no_session", "unknown_session", "bad_nonce", "bad_mac", "stale_request", "replayed_request", "unauthenticated"},
+	http.StatusRequestEntityTooLarge: {"body_too_large"},
+	http.StatusServiceUnavailable:    {"unavailable"},
+}
+
+// OpenAPI 3 description of the endpoints, with schemas from the Go types of their bodies
+func openAPISpec(endpoints []endpoint) map[string]any {
+	s := schemas{}
+	errorBody := s.of(reflect.TypeOf(middlewares.ErrorBody{}))
+
+	paths := map[string]map[string]any{}
+	for _, e := range endpoints {
+		var params []map[string]any
+		for _, m := range pathParam.FindAllStringSubmatch(e.path, -1) {
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, q := range e.query {
+			params = append(params, map[string]any{"name": q.name, "in": "query", "description": q.description, "schema": map[string]any{"type": "string"}})
+		}
+
+		success := map[string]any{"description": http.StatusText(e.status)}
+		if e.response != nil {
+			success["content"] = jsonContent(s.of(reflect.TypeOf(e.response)))
+		}
+		responses := map[string]any{strconv.Itoa(e.status): success}
+
+		codes := map[int][]string{}
+		for status, c := range sessionErrors {
+			codes[status] = slices.Clone(c)
+		}
+		for _, err := range e.errors {
+			codes[err.status] = append(codes[err.status], err.code)
+		}
+		for status, c := range codes {
+			responses[strconv.Itoa(status)] = map[string]any{
+				"description": http.StatusText(status) + ", code " + strings.Join(c, ", "),
+				"content":     jsonContent(errorBody),
+			}
+		}
+
+		op := map[string]any{"operationId": e.id, "summary": e.summary, "responses": responses}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if e.request != nil {
+			op["requestBody"] = map[string]any{"required": true, "content": jsonContent(s.of(reflect.TypeOf(e.request)))}
+		}
+		if paths[e.path] == nil {
+			paths[e.path] = map[string]any{}
+		}
+		paths[e.path][strings.ToLower(e.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "secure-chat",
+			"version":     "1",
+			"description": apiDescription,
+		},
+		"servers": []map[string]any{{"url": "/api/v1"}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": s,
+			"securitySchemes": map[string]any{
+				"session": map[string]any{"type": "apiKey", "in": "header", "name": middlewares.SessionHeader},
+			},
+		},
+		"security": []map[string]any{{"session": []string{}}},
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// Schemas of the named structs met so far, by name
+type schemas map[string]any
+
+// Schema of a type as encoding/json writes it, structs become references
+func (s schemas) of(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{"description": "Any JSON value"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.of(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case reflect.Struct:
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = nil // Taken, in case the struct refers to itself
+			s[t.Name()] = s.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func (s schemas) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = s.of(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+
+	object := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		object["required"] = required
+	}
+	return object
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Presence statuses and the events pushed when they change
+const (
+	statusOnline  = "online"
+	statusAway    = "away"
+	presenceJoin  = "join"
+	presenceLeave = "leave"
+)
+
+type memberKey struct {
+	room string
+	user string
+}
+
+// A user in a room as one node sees it
+type presenceEntry struct {
+	Room string `json:"room"`
+	User string `json:"user"`
+	Away bool   `json:"away,omitempty"`
+	Gone bool   `json:"gone,omitempty"`
+}
+
+// Presence announcement on the bus. A full update replaces everything known
+// about the node, Sync asks every other node to send one.
+type presenceUpdate struct {
+	Node    string          `json:"node"`
+	Full    bool            `json:"full,omitempty"`
+	Sync    bool            `json:"sync,omitempty"`
+	Entries []presenceEntry `json:"entries,omitempty"`
+}
+
+// Connections a node has for a user in a room, away when all of them are
+type localMember struct {
+	conns int
+	away  int
+}
+
+func (m *localMember) entry(key memberKey) presenceEntry {
+	return presenceEntry{Room: key.room, User: key.user, Away: m.conns > 0 && m.away == m.conns, Gone: m.conns == 0}
+}
+
+type presenceState struct {
+	present bool
+	away    bool
+}
+
+type presenceEvent struct {
+	key    memberKey
+	status string
+}
+
+// What each node last announced, with when it was last heard from
+type nodeMembers struct {
+	seen    time.Time
+	members map[memberKey]bool
+}
+
+// Cluster wide presence built from the announcements on the bus. Only the hub
+// writes to it, HTTP handlers read it.
+type presenceTracker struct {
+	mu    sync.RWMutex
+	ttl   time.Duration
+	nodes map[string]*nodeMembers
+	since map[memberKey]time.Time
+}
+
+func newPresenceTracker(ttl time.Duration) *presenceTracker {
+	return &presenceTracker{
+		ttl:   ttl,
+		nodes: make(map[string]*nodeMembers),
+		since: make(map[memberKey]time.Time),
+	}
+}
+
+// Present on any node, away unless online on at least one
+func (p *presenceTracker) state(key memberKey) presenceState {
+	var s presenceState
+	online := false
+	for _, n := range p.nodes {
+		if away, ok := n.members[key]; ok {
+			s.present = true
+			online = online || !away
+		}
+	}
+	s.away = s.present && !online
+	return s
+}
+
+// Apply an announcement, returning the changes it makes to the cluster view
+func (p *presenceTracker) apply(update presenceUpdate, now time.Time) []presenceEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n, ok := p.nodes[update.Node]
+	if !ok {
+		n = &nodeMembers{members: make(map[memberKey]bool)}
+		p.nodes[update.Node] = n
+	}
+	n.seen = now
+
+	before := make(map[memberKey]presenceState)
+	remember := func(key memberKey) {
+		if _, ok := before[key]; !ok {
+			before[key] = p.state(key)
+		}
+	}
+
+	if update.Full {
+		for key := range n.members {
+			remember(key)
+		}
+		clear(n.members)
+	}
+	for _, e := range update.Entries {
+		key := memberKey{room: e.Room, user: e.User}
+		remember(key)
+		if e.Gone {
+			delete(n.members, key)
+		} else {
+			n.members[key] = e.Away
+		}
+	}
+
+	return p.changes(before, now)
+}
+
+// Forget nodes that stopped announcing, they most likely crashed
+func (p *presenceTracker) expire(now time.Time) []presenceEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	before := make(map[memberKey]presenceState)
+	for node, n := range p.nodes {
+		if now.Sub(n.seen) <= p.ttl {
+			continue
+		}
+		for key := range n.members {
+			if _, ok := before[key]; !ok {
+				before[key] = p.state(key)
+			}
+		}
+		delete(p.nodes, node)
+	}
+
+	return p.changes(before, now)
+}
+
+func (p *presenceTracker) changes(before map[memberKey]presenceState, now time.Time) []presenceEvent {
+	var events []presenceEvent
+	for key, b := range before {
+		a := p.state(key)
+		if a == b {
+			continue
+		}
+
+		switch {
+		case !a.present:
+			delete(p.since, key)
+			events = append(events, presenceEvent{key, presenceLeave})
+		case !b.present:
+			p.since[key] = now
+			events = append(events, presenceEvent{key, presenceJoin})
+			if a.away {
+				events = append(events, presenceEvent{key, statusAway})
+			}
+		case a.away:
+			p.since[key] = now
+			events = append(events, presenceEvent{key, statusAway})
+		default:
+			p.since[key] = now
+			events = append(events, presenceEvent{key, statusOnline})
+		}
+	}
+
+	slices.SortStableFunc(events, func(x, y presenceEvent) int {
+		if c := strings.Compare(x.key.room, y.key.room); c != 0 {
+			return c
+		}
+		return strings.Compare(x.key.user, y.key.user)
+	})
+	return events
+}
+
+// A user present in a room, as served over HTTP
+type PresenceMember struct {
+	Room   string    `json:"room"`
+	User   string    `json:"user"`
+	Status string    `json:"status"`
+	Since  time.Time `json:"since"`
+}
+
+// Everyone present, optionally only in one room or only one user
+func (p *presenceTracker) members(room, user string) []PresenceMember {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	members := []PresenceMember{}
+	for key, since := range p.since {
+		if (room != "" && key.room != room) || (user != "" && key.user != user) {
+			continue
+		}
+		status := statusOnline
+		if p.state(key).away {
+			status = statusAway
+		}
+		members = append(members, PresenceMember{Room: key.room, User: key.user, Status: status, Since: since})
+	}
+
+	slices.SortFunc(members, func(x, y PresenceMember) int {
+		if c := strings.Compare(x.Room, y.Room); c != 0 {
+			return c
+		}
+		return strings.Compare(x.User, y.User)
+	})
+	return members
+}
+
+// GET /presence?room=&user=, both filters optional. Rooms the caller may
+// not enter are left out, private rooms do not show who is in them.
+func presenceEndpoint(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	members := []PresenceMember{}
+	visible := map[string]bool{}
+	for _, m := range hub.presence.members(r.URL.Query().Get("room"), r.URL.Query().Get("user")) {
+		ok, checked := visible[m.Room]
+		if !checked {
+			var err error
+			if ok, err = hub.mayEnter(r.Context(), m.Room, caller(r)); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			visible[m.Room] = ok
+		}
+		if ok {
+			members = append(members, m)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/rooms"
+)
+
+func TestPresenceTracker(t *testing.T) {
+	p := newPresenceTracker(time.Minute)
+	now := time.Now()
+	alice := memberKey{room: "general", user: "alice"}
+
+	check := func(got []presenceEvent, want ...string) {
+		t.Helper()
+		var statuses []string
+		for _, e := range got {
+			statuses = append(statuses, e.status)
+		}
+		if !slices.Equal(statuses, want) {
+			t.Errorf("Expected events %v, got %v", want, statuses)
+		}
+	}
+
+	check(p.apply(presenceUpdate{Node: "a", Entries: []presenceEntry{{Room: "general", User: "alice"}}}, now), presenceJoin)
+
+	// A second node changes nothing while alice is online on the first
+	check(p.apply(presenceUpdate{Node: "b", Entries: []presenceEntry{{Room: "general", User: "alice", Away: true}}}, now))
+	check(p.apply(presenceUpdate{Node: "a", Entries: []presenceEntry{{Room: "general", User: "alice", Gone: true}}}, now), statusAway)
+
+	// Node b stops announcing and alice goes with it
+	check(p.expire(now.Add(30 * time.Second)))
+	check(p.expire(now.Add(2*time.Minute)), presenceLeave)
+	if _, ok := p.since[alice]; ok {
+		t.Error("Alice is still listed after leaving")
+	}
+
+	// A full update replaces what the node announced before
+	p.apply(presenceUpdate{Node: "a", Entries: []presenceEntry{{Room: "general", User: "alice"}, {Room: "general", User: "bob"}}}, now)
+	check(p.apply(presenceUpdate{Node: "a", Full: true, Entries: []presenceEntry{{Room: "general", User: "bob"}}}, now), presenceLeave)
+	if members := p.members("general", ""); len(members) != 1 || members[0].User != "bob" || members[0].Status != statusOnline {
+		t.Errorf("Unexpected members %+v", members)
+	}
+}
+
+// Read envelopes until one matches, failing after a few seconds
+func expectEnvelope(t *testing.T, conn *websocket.Conn, match func(Envelope) bool) Envelope {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, part := range readFrame(t, conn) {
+			var env Envelope
+			if json.Unmarshal([]byte(part), &env) == nil && match(env) {
+				return env
+			}
+		}
+	}
+	t.Fatal("Expected envelope never arrived")
+	return Envelope{}
+}
+
+func isPresence(user, status string) func(Envelope) bool {
+	return func(env Envelope) bool {
+		return env.Type == envelopePresence && env.Sender == user && env.Status == status
+	}
+}
+
+func TestPresenceAcrossNodes(t *testing.T) {
+	b := bus.NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := config.Default()
+	cfg.Presence.TypingInterval = time.Hour
+
+	var hubs []*Hub
+	for i := 0; i < 2; i++ {
+		hub := newTestHub(cfg, b)
+		if err := hub.listen(ctx); err != nil {
+			t.Fatal(err)
+		}
+		go hub.run(ctx)
+		hubs = append(hubs, hub)
+	}
+
+	bob := dial(t, newTestServer(t, hubs[1]), "id=bob")
+	expectEnvelope(t, bob, isPresence("bob", presenceJoin))
+
+	alice := dial(t, newTestServer(t, hubs[0]), "id=alice")
+	expectEnvelope(t, bob, isPresence("alice", presenceJoin))
+
+	send(t, alice, `{"type":"status","status":"away"}`)
+	expectEnvelope(t, bob, isPresence("alice", statusAway))
+
+	// Only the first typing frame within the interval is relayed
+	send(t, alice, `{"type":"typing"}`)
+	send(t, alice, `{"type":"typing"}`)
+	send(t, alice, `{"sender":"alice","message":"hi"}`)
+	typing := 0
+	expectEnvelope(t, bob, func(env Envelope) bool {
+		if env.Type == envelopeTyping && env.Sender == "alice" {
+			typing++
+		}
+		return env.Message == "hi"
+	})
+	if typing != 1 {
+		t.Errorf("Expected 1 typing frame, got %d", typing)
+	}
+
+	send(t, alice, `{"type":"status","status":"asleep"}`)
+	if env := expectEnvelope(t, alice, func(env Envelope) bool { return env.Type == envelopeError }); env.Error != errUnknownStatus.Error() {
+		t.Errorf("Unexpected error %q", env.Error)
+	}
+
+	// Both nodes answer the same over HTTP
+	for _, hub := range hubs {
+		rec := httptest.NewRecorder()
+		presenceEndpoint(hub, rec, httptest.NewRequest("GET", "/presence?room=general", nil))
+		var members []PresenceMember
+		if err := json.Unmarshal(rec.Body.Bytes(), &members); err != nil {
+			t.Fatal(err)
+		}
+		if len(members) != 2 || members[0].User != "alice" || members[0].Status != statusAway || members[1].User != "bob" {
+			t.Errorf("Unexpected members %+v", members)
+		}
+	}
+
+	alice.Close()
+	expectEnvelope(t, bob, isPresence("alice", presenceLeave))
+}
+
+func TestPresenceHidesPrivateRooms(t *testing.T) {
+	hub := newTestHub(config.Default(), bus.NewMemory())
+	hub.rooms.Create(context.Background(), rooms.Room{Name: "ops", Owner: "alice", Private: true})
+	now := time.Now()
+	hub.presence.apply(presenceUpdate{Node: "a", Entries: []presenceEntry{{Room: "ops", User: "alice"}, {Room: "general", User: "bob"}}}, now)
+
+	rec := httptest.NewRecorder()
+	presenceEndpoint(hub, rec, httptest.NewRequest("GET", "/presence", nil))
+	var members []PresenceMember
+	if err := json.Unmarshal(rec.Body.Bytes(), &members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Room != "general" {
+		t.Errorf("Expected only the open room to show, got %+v", members)
+	}
+}
@@ -1,23 +1,40 @@
 package providers
 
 import (
+	"context"
+
 	"github.com/gomodule/redigo/redis"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
 )
 
 var (
 	Pool *redis.Pool
 )
 
-func init() {
-	Pool = newPool("redis://cache:6379/0")	
+// Must be called before Pool is used
+func Setup(cfg config.Redis) {
+	Pool = newPool(cfg)
 }
 
-func newPool(server string) *redis.Pool {
+func newPool(cfg config.Redis) *redis.Pool {
 	return &redis.Pool{
-		MaxIdle: 3,
-		IdleTimeout: 240,
+		MaxIdle:     cfg.MaxIdle,
+		IdleTimeout: cfg.IdleTimeout,
 		Dial: func() (redis.Conn, error) {
-			return redis.DialURL(server)
+			return redis.DialURL(cfg.URL)
 		},
 	}
 }
+
+// Check Redis answers, for readiness probes
+func Ping(ctx context.Context) error {
+	conn, err := Pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = redis.DoContext(conn, ctx, "PING")
+	return err
+}
@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+)
+
+// How often idle buckets are dropped
+const sweepInterval = time.Minute
+
+// Token bucket for a single caller, unlimited when the limit is disabled
+func New(l config.Limit) *rate.Limiter {
+	if !l.Enabled() {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(l.Rate), l.Burst)
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// One token bucket per key, such as an IP or a user
+type Keyed struct {
+	mu        sync.Mutex
+	limit     config.Limit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewKeyed(l config.Limit) *Keyed {
+	return &Keyed{limit: l, buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// Take a token from key's bucket, false if it is empty
+func (k *Keyed) Allow(key string) bool {
+	if !k.limit.Enabled() {
+		return true
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	k.sweep(now)
+
+	b, ok := k.buckets[key]
+	if !ok {
+		b = &bucket{limiter: New(k.limit)}
+		k.buckets[key] = b
+	}
+	b.seen = now
+	return b.limiter.AllowN(now, 1)
+}
+
+// Drop buckets idle long enough to have refilled, a new one behaves the same
+func (k *Keyed) sweep(now time.Time) {
+	if now.Sub(k.lastSweep) < sweepInterval {
+		return
+	}
+	k.lastSweep = now
+
+	refill := time.Duration(float64(k.limit.Burst) / k.limit.Rate * float64(time.Second))
+	for key, b := range k.buckets {
+		if now.Sub(b.seen) > refill {
+			delete(k.buckets, key)
+		}
+	}
+}
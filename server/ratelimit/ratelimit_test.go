@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+)
+
+func TestKeyedBurst(t *testing.T) {
+	k := NewKeyed(config.Limit{Rate: 0.001, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if !k.Allow("a") {
+			t.Fatalf("Request %d refused within the burst", i)
+		}
+	}
+	if k.Allow("a") {
+		t.Error("Request allowed past the burst")
+	}
+
+	// Keys do not share buckets
+	if !k.Allow("b") {
+		t.Error("Other key refused")
+	}
+}
+
+func TestKeyedDisabled(t *testing.T) {
+	k := NewKeyed(config.Limit{})
+	for i := 0; i < 100; i++ {
+		if !k.Allow("a") {
+			t.Fatal("Disabled limit refused a request")
+		}
+	}
+}
+
+func TestKeyedSweep(t *testing.T) {
+	k := NewKeyed(config.Limit{Rate: 1, Burst: 1})
+	k.Allow("a")
+
+	// Refilled after a second, gone at the next sweep
+	k.buckets["a"].seen = time.Now().Add(-2 * time.Second)
+	k.lastSweep = time.Now().Add(-2 * sweepInterval)
+	k.Allow("b")
+
+	if _, ok := k.buckets["a"]; ok {
+		t.Error("Idle bucket was not swept")
+	}
+}
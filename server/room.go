@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+	"github.com/FelineJTD/secure-chat-kripto/server/rooms"
+)
+
+// Room clients join when they do not ask for one
+const defaultRoom = "general"
+
+var (
+	errMalformed        = errors.New("malformed message")
+	errNotSigned        = errors.New("room requires signed messages")
+	errNoVerifyKey      = errors.New("room requires a registered verification key")
+	errSenderMismatch   = errors.New("sender does not match the session")
+	errInvalidSignature = errors.New("invalid signature")
+	errUnknownType      = errors.New("unknown message type")
+	errUnknownStatus    = errors.New("status must be online or away")
+)
+
+// Rules a room imposes on the messages sent to it
+type RoomPolicy struct {
+	// Every message must carry a valid signature from the sender's registered key
+	RequireSignature bool
+
+	// Broadcasts are encrypted once under a room key handed to every member,
+	// instead of under each member's session key
+	SharedKey bool
+
+	// Messages disappear this long after they were sent, zero to keep them
+	TTL time.Duration
+}
+
+// Policies are read from every readPump, so they are guarded rather than owned by the hub
+type roomPolicies struct {
+	mu       sync.RWMutex
+	policies map[string]RoomPolicy
+}
+
+func newRoomPolicies() *roomPolicies {
+	return &roomPolicies{policies: make(map[string]RoomPolicy)}
+}
+
+func (r *roomPolicies) get(room string) RoomPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.policies[room]
+}
+
+func (r *roomPolicies) set(room string, policy RoomPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policies[room] = policy
+}
+
+// Key of a room with SharedKey as this node last loaded it from the rooms
+// store. Every node seals with the same key, replaced whenever someone leaves.
+type roomKey struct {
+	version int64
+	key     logger.Secret
+	cipher  *handlers.Cipher
+}
+
+// Room keys are used from the shards and the hub alike, so they are guarded
+type roomKeys struct {
+	mu   sync.Mutex
+	keys map[string]*roomKey
+}
+
+func newRoomKeys() *roomKeys {
+	return &roomKeys{keys: make(map[string]*roomKey)}
+}
+
+// Key of a room on this node, nil until loaded
+func (r *roomKeys) get(room string) *roomKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys[room]
+}
+
+// Keep k unless a key as new is kept already, reporting whether it was
+func (r *roomKeys) set(room string, k *roomKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.keys[room]; ok && old.version >= k.version {
+		return false
+	}
+	r.keys[room] = k
+	return true
+}
+
+// Current key of a room from the store, ready to seal with
+func (h *Hub) fetchKey(ctx context.Context, room string) (*roomKey, error) {
+	k, err := h.rooms.Key(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+	c, err := handlers.NewCipher(k.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return &roomKey{version: k.Version, key: k.Secret, cipher: c}, nil
+}
+
+// Load a room's key the first time someone joins it on this node. Without it
+// the room's broadcasts go out under the session keys.
+func (h *Hub) loadKey(ctx context.Context, room string) {
+	if !h.policies.get(room).SharedKey || h.roomKeys.get(room) != nil {
+		return
+	}
+	k, err := h.fetchKey(ctx, room)
+	if err != nil {
+		hubLog.Error("room key unavailable", "room", room, "err", err)
+		return
+	}
+	h.roomKeys.set(room, k)
+}
+
+// Replace a room's key after someone left, so they cannot read what is sent
+// next, and have every node pick it up. When the bus is down only this node does.
+func (h *Hub) rotateKey(ctx context.Context, room string) {
+	if _, err := h.rooms.RotateKey(ctx, room); err != nil {
+		hubLog.Error("room key rotation failed", "room", room, "err", err)
+		return
+	}
+	data, err := json.Marshal(busFrame{RoomKey: room})
+	if err == nil {
+		err = h.bus.Publish(ctx, h.cfg.Bus.Channel, data)
+	}
+	if err != nil {
+		hubLog.Warn("publish failed, rotating locally", "err", err)
+		h.reloadKey(ctx, room)
+	}
+}
+
+// Take up a room's new key and hand it to the members on this node. Swapped
+// on the hub goroutine, so every shard queues it ahead of anything sealed with it.
+func (h *Hub) reloadKey(ctx context.Context, room string) {
+	k, err := h.fetchKey(ctx, room)
+	if err != nil {
+		hubLog.Error("room key unavailable", "room", room, "err", err)
+		return
+	}
+	h.do(ctx, func() {
+		if !h.roomKeys.set(room, k) {
+			return
+		}
+		frame := roomKeyFrame(k.key)
+		for _, s := range h.shards {
+			if s.wants(room) {
+				s.inbox.push(func() { s.rekey(room, frame) })
+			}
+		}
+	})
+}
+
+// Whether user may join room and read its history. Private rooms only let
+// their members in, rooms nobody made through the API are open.
+func (h *Hub) mayEnter(ctx context.Context, room, user string) (bool, error) {
+	r, err := h.rooms.Get(ctx, room)
+	if errors.Is(err, rooms.ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return r.Open(user), nil
+}
+
+// Whether someone is in room or wrote to it, on any node
+func (h *Hub) inUse(ctx context.Context, room string) (bool, error) {
+	if len(h.presence.members(room, "")) > 0 {
+		return true, nil
+	}
+	messages, _, err := h.history.Page(ctx, room, "", 1)
+	return len(messages) > 0, err
+}
+
+// Check a message against the policy of the client's room. Signatures cover
+// the message field exactly as sent, so the server can check them without
+// seeing the end-to-end plaintext.
+func (c *Client) checkPolicy(message []byte) error {
+	policy := c.hub.policies.get(c.room)
+	if !policy.RequireSignature {
+		return nil
+	}
+
+	env, err := parseEnvelope(message)
+	if err != nil {
+		return errMalformed
+	}
+
+	if env.Sign == "" || env.Hash == "" {
+		return errNotSigned
+	}
+	if c.verifyKey == "" {
+		return errNoVerifyKey
+	}
+	if env.Sender != c.id {
+		return errSenderMismatch
+	}
+
+	ok, err := handlers.VerifySignature(c.verifyKey, env.Sign, env.Hash, env.Message)
+	if err != nil || !ok {
+		return errInvalidSignature
+	}
+	return nil
+}
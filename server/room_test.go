@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nart4hire/goschnorr"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/handlers"
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+	"github.com/FelineJTD/secure-chat-kripto/server/rooms"
+)
+
+func signedEnvelope(t *testing.T, s schnorr.Schnorr, priv []byte, sender, message string) []byte {
+	t.Helper()
+	sign, hash, err := s.Sign(priv, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(Envelope{Sender: sender, Message: message, Sign: hex.EncodeToString(sign), Hash: hex.EncodeToString(hash)})
+	return data
+}
+
+func TestSignedRoomPolicy(t *testing.T) {
+	if err := handlers.LoadSchnorr(filepath.Join(t.TempDir(), "schnorr.json")); err != nil {
+		t.Fatal(err)
+	}
+	p, q, g := handlers.Schnorr.GetParams()
+	s := schnorr.NewSchnorrFromParam(p, q, g, rand.Reader, sha256.New())
+
+	priv, pub, _ := s.GenKeyPair()
+	otherPriv, _, _ := s.GenKeyPair()
+
+	hub := newTestHub(config.Default(), bus.NewMemory())
+	hub.policies.set("signed", RoomPolicy{RequireSignature: true})
+	c := &Client{hub: hub, id: "alice", room: "signed", verifyKey: hex.EncodeToString(pub)}
+
+	unsigned, _ := json.Marshal(Envelope{Sender: "alice", Message: "hello"})
+
+	cases := []struct {
+		name    string
+		message []byte
+		want    error
+	}{
+		{"valid", signedEnvelope(t, s, priv, "alice", "hello"), nil},
+		{"unsigned", unsigned, errNotSigned},
+		{"forged", signedEnvelope(t, s, otherPriv, "alice", "hello"), errInvalidSignature},
+		{"spoofed sender", signedEnvelope(t, s, priv, "bob", "hello"), errSenderMismatch},
+		{"malformed", []byte("hello"), errMalformed},
+	}
+	for _, tc := range cases {
+		if err := c.checkPolicy(tc.message); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	// Rooms without a policy relay anything
+	c.room = defaultRoom
+	if err := c.checkPolicy(unsigned); err != nil {
+		t.Errorf("Unrestricted room rejected a message: %v", err)
+	}
+}
+
+// Next message for a client, failing the test if none arrives
+func next(t *testing.T, client *Client) outbound {
+	t.Helper()
+	select {
+	case m := <-client.send:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s got nothing", client.address)
+		return outbound{}
+	}
+}
+
+func TestKeyedRoom(t *testing.T) {
+	cfg := config.Default()
+	cfg.Rooms.Keyed = []string{defaultRoom}
+	hub, _ := runShard(t, cfg)
+
+	alice, bob := newSlowClient(hub, "alice", 4), newSlowClient(hub, "bob", 4)
+	carol := newSlowClient(hub, "carol", 4)
+	carol.room = "other"
+	for _, c := range []*Client{alice, bob, carol} {
+		c.cipher = testCipher
+		hub.join(c)
+	}
+
+	// Members are handed the key as they join, under their session key
+	var keys []string
+	for _, c := range []*Client{alice, bob} {
+		m := next(t, c)
+		env, err := parseEnvelope(m.data)
+		if err != nil || env.Type != envelopeRoomKey || m.sealed != nil {
+			t.Fatalf("Expected a room key frame first, got %q", m.data)
+		}
+		keys = append(keys, env.Key)
+	}
+	if keys[0] != keys[1] {
+		t.Fatal("Members of one room got different keys")
+	}
+
+	hub.broadcast <- roomMessage{room: defaultRoom, data: []byte("hello")}
+	a, b := next(t, alice), next(t, bob)
+	if &a.sealed[0] != &b.sealed[0] {
+		t.Error("Expected the message sealed once for the room")
+	}
+	wire, _ := alice.encrypt(a)
+	plaintext, err := handlers.Decrypt(logger.Secret(keys[0]), strings.TrimPrefix(string(wire), sealedPrefix))
+	if !strings.HasPrefix(string(wire), sealedPrefix) || err != nil || plaintext != "hello" {
+		t.Errorf("Sealed message did not open with the room key, got %q", wire)
+	}
+
+	// Other rooms stay under the session keys
+	hub.broadcast <- roomMessage{room: "other", data: []byte("hi")}
+	if m := next(t, carol); m.sealed != nil || string(m.data) != "hi" {
+		t.Errorf("Unkeyed room got %+v", m)
+	}
+}
+
+// Next room key handed to a client, skipping presence frames
+func nextKey(t *testing.T, client *Client) string {
+	t.Helper()
+	for {
+		m := next(t, client)
+		if env, err := parseEnvelope(m.data); err == nil && env.Type == envelopeRoomKey {
+			return env.Key
+		}
+	}
+}
+
+// Next sealed message for a client opened with key, skipping presence and
+// anything under the session key
+func nextSealed(t *testing.T, client *Client, key string) string {
+	t.Helper()
+	for {
+		m := next(t, client)
+		if m.sealed == nil {
+			continue
+		}
+		wire, _ := client.encrypt(m)
+		plaintext, err := handlers.Decrypt(logger.Secret(key), strings.TrimPrefix(string(wire), sealedPrefix))
+		if err != nil {
+			t.Fatalf("Sealed message did not open with the room key: %v", err)
+		}
+		if env, err := parseEnvelope([]byte(plaintext)); err != nil || env.Type != envelopePresence {
+			return plaintext
+		}
+	}
+}
+
+func TestRoomKeyRotation(t *testing.T) {
+	b := bus.NewMemory()
+	store := rooms.NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := config.Default()
+	cfg.Hub.Shards = 1
+	cfg.Rooms.Keyed = []string{defaultRoom}
+
+	var hubs []*Hub
+	for i := 0; i < 2; i++ {
+		hub := newTestHub(cfg, b)
+		hub.rooms = store
+		if err := hub.listen(ctx); err != nil {
+			t.Fatal(err)
+		}
+		go hub.run(ctx)
+		hubs = append(hubs, hub)
+	}
+
+	alice, carol := newSlowClient(hubs[0], "alice", 64), newSlowClient(hubs[0], "carol", 64)
+	bob := newSlowClient(hubs[1], "bob", 64)
+	for _, c := range []*Client{alice, bob, carol} {
+		c.cipher = testCipher
+		c.hub.join(c)
+	}
+
+	// Every node seals with the key kept in the store
+	first := nextKey(t, alice)
+	if nextKey(t, bob) != first || nextKey(t, carol) != first {
+		t.Fatal("Members on different nodes got different keys")
+	}
+
+	// Once carol leaves, everyone left moves to a key she never had
+	hubs[0].leave(carol)
+	rotated := nextKey(t, alice)
+	if rotated == first || nextKey(t, bob) != rotated {
+		t.Fatal("Expected every member to get the same new key")
+	}
+	hubs[1].broadcastRoom(defaultRoom, []byte("after carol"))
+	if got := nextSealed(t, alice, rotated); got != "after carol" {
+		t.Errorf("Expected the message under the new key, got %q", got)
+	}
+
+	// Removing someone through the API rotates it too, connected or not
+	hubs[1].evictAll(ctx, defaultRoom, "dave")
+	if k := nextKey(t, alice); k == rotated || nextKey(t, bob) != k {
+		t.Error("Expected a new key after an eviction")
+	}
+}
+
+// What encrypting one broadcast costs for the whole room: the key decoded and
+// the cipher built for every member, a cached cipher per member, or sealing
+// once under the room key.
+func BenchmarkRoomEncryption(b *testing.B) {
+	message := []byte(strings.Repeat("m", 256))
+	for _, members := range []int{10, 100, 1000} {
+		keys := make([]logger.Secret, members)
+		ciphers := make([]*handlers.Cipher, members)
+		for i := range keys {
+			k := make([]byte, 32)
+			rand.Read(k)
+			keys[i] = logger.Secret(hex.EncodeToString(k))
+			ciphers[i], _ = handlers.NewCipher(keys[i])
+		}
+
+		b.Run(fmt.Sprintf("members=%d/per-message", members), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, key := range keys {
+					handlers.Encrypt(key, string(message))
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("members=%d/session", members), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, c := range ciphers {
+					c.Encrypt(message)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("members=%d/room", members), func(b *testing.B) {
+			hub := newTestHub(config.Default(), bus.NewMemory())
+			for i := 0; i < b.N; i++ {
+				hub.seal(defaultRoom, message)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package rooms
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Rooms in process memory, lost on restart and only seen by this node
+type Memory struct {
+	mu    sync.Mutex
+	rooms map[string]Room
+	keys  map[string]Key
+}
+
+func NewMemory() *Memory {
+	return &Memory{rooms: make(map[string]Room), keys: make(map[string]Key)}
+}
+
+func (s *Memory) Create(ctx context.Context, r Room) (Room, error) {
+	if !ValidName(r.Name) {
+		return Room{}, ErrInvalidName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[r.Name]; ok {
+		return Room{}, ErrExists
+	}
+	r.Members = []string{r.Owner}
+	s.rooms[r.Name] = r
+	return clone(r), nil
+}
+
+func (s *Memory) Get(ctx context.Context, name string) (Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[name]
+	if !ok {
+		return Room{}, ErrNotFound
+	}
+	return clone(r), nil
+}
+
+func (s *Memory) List(ctx context.Context) ([]Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := make([]Room, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		rooms = append(rooms, clone(r))
+	}
+	slices.SortFunc(rooms, byName)
+	return rooms, nil
+}
+
+func (s *Memory) AddMember(ctx context.Context, name, user string) (Room, error) {
+	return s.update(name, func(r *Room) {
+		if i, found := slices.BinarySearch(r.Members, user); !found {
+			r.Members = slices.Insert(r.Members, i, user)
+		}
+	})
+}
+
+func (s *Memory) RemoveMember(ctx context.Context, name, user string) (Room, error) {
+	return s.update(name, func(r *Room) {
+		if i, found := slices.BinarySearch(r.Members, user); found {
+			r.Members = slices.Delete(r.Members, i, i+1)
+		}
+	})
+}
+
+func (s *Memory) update(name string, f func(*Room)) (Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[name]
+	if !ok {
+		return Room{}, ErrNotFound
+	}
+	r = clone(r)
+	f(&r)
+	s.rooms[name] = r
+	return clone(r), nil
+}
+
+func (s *Memory) Key(ctx context.Context, name string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, ok := s.keys[name]; ok {
+		return k, nil
+	}
+	return s.rotate(name)
+}
+
+func (s *Memory) RotateKey(ctx context.Context, name string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotate(name)
+}
+
+func (s *Memory) rotate(name string) (Key, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return Key{}, err
+	}
+	k := Key{Version: s.keys[name].Version + 1, Secret: secret}
+	s.keys[name] = k
+	return k, nil
+}
+
+// Copy of a room sharing nothing with it
+func clone(r Room) Room {
+	r.Members = slices.Clone(r.Members)
+	return r
+}
+
+func byName(x, y Room) int {
+	return strings.Compare(x.Name, y.Name)
+}
@@ -0,0 +1,229 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+)
+
+const (
+	// Hash of every room by name, members are kept apart so they change atomically
+	roomsKey = "rooms"
+
+	// Prefix of the Redis sets of members, kept apart from the session keys
+	membersPrefix = "rooms:"
+
+	// Hash of every room key by room name, each stored as "version:secret"
+	keysKey = "roomkeys"
+)
+
+// Store a secret under the next version, whatever another node rotated to meanwhile
+var rotateScript = redis.NewScript(1, `
+local current = redis.call("HGET", KEYS[1], ARGV[1])
+local version = 1
+if current then
+	version = tonumber(string.match(current, "^(%d+):")) + 1
+end
+local key = version .. ":" .. ARGV[2]
+redis.call("HSET", KEYS[1], ARGV[1], key)
+return key
+`)
+
+// Rooms in Redis, shared by every node
+type Redis struct {
+	pool *redis.Pool
+}
+
+func NewRedis(pool *redis.Pool) *Redis {
+	return &Redis{pool: pool}
+}
+
+func membersKey(name string) string { return membersPrefix + name + ":members" }
+
+// Run a command, counting failures
+func do(ctx context.Context, conn redis.Conn, command string, args ...any) (any, error) {
+	reply, err := redis.DoContext(conn, ctx, command, args...)
+	if err != nil && err != redis.ErrNil {
+		metrics.RedisErrors.WithLabelValues(command).Inc()
+	}
+	return reply, err
+}
+
+func (s *Redis) Create(ctx context.Context, r Room) (Room, error) {
+	if !ValidName(r.Name) {
+		return Room{}, ErrInvalidName
+	}
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Room{}, err
+	}
+	defer conn.Close()
+
+	// Members live in their own set, the hash only holds the rest
+	r.Members = nil
+	data, err := json.Marshal(r)
+	if err != nil {
+		return Room{}, err
+	}
+	created, err := redis.Bool(do(ctx, conn, "HSETNX", roomsKey, r.Name, data))
+	if err != nil {
+		return Room{}, err
+	}
+	if !created {
+		return Room{}, ErrExists
+	}
+	if _, err := do(ctx, conn, "SADD", membersKey(r.Name), r.Owner); err != nil {
+		return Room{}, err
+	}
+	r.Members = []string{r.Owner}
+	return r, nil
+}
+
+func (s *Redis) Get(ctx context.Context, name string) (Room, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Room{}, err
+	}
+	defer conn.Close()
+	return get(ctx, conn, name)
+}
+
+func get(ctx context.Context, conn redis.Conn, name string) (Room, error) {
+	var r Room
+	data, err := redis.Bytes(do(ctx, conn, "HGET", roomsKey, name))
+	if err == redis.ErrNil {
+		return r, ErrNotFound
+	}
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, err
+	}
+	return r, members(ctx, conn, &r)
+}
+
+func members(ctx context.Context, conn redis.Conn, r *Room) error {
+	members, err := redis.Strings(do(ctx, conn, "SMEMBERS", membersKey(r.Name)))
+	if err != nil {
+		return err
+	}
+	slices.Sort(members)
+	r.Members = members
+	return nil
+}
+
+func (s *Redis) List(ctx context.Context) ([]Room, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	all, err := redis.StringMap(do(ctx, conn, "HGETALL", roomsKey))
+	if err != nil {
+		return nil, err
+	}
+	rooms := make([]Room, 0, len(all))
+	for _, data := range all {
+		var r Room
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return nil, err
+		}
+		if err := members(ctx, conn, &r); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, r)
+	}
+	slices.SortFunc(rooms, byName)
+	return rooms, nil
+}
+
+func (s *Redis) AddMember(ctx context.Context, name, user string) (Room, error) {
+	return s.update(ctx, name, "SADD", user)
+}
+
+func (s *Redis) RemoveMember(ctx context.Context, name, user string) (Room, error) {
+	return s.update(ctx, name, "SREM", user)
+}
+
+// Rooms are never deleted, so checking it exists first leaves no gap
+func (s *Redis) update(ctx context.Context, name, command, user string) (Room, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Room{}, err
+	}
+	defer conn.Close()
+
+	exists, err := redis.Bool(do(ctx, conn, "HEXISTS", roomsKey, name))
+	if err != nil {
+		return Room{}, err
+	}
+	if !exists {
+		return Room{}, ErrNotFound
+	}
+	if _, err := do(ctx, conn, command, membersKey(name), user); err != nil {
+		return Room{}, err
+	}
+	return get(ctx, conn, name)
+}
+
+func (s *Redis) Key(ctx context.Context, name string) (Key, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Key{}, err
+	}
+	defer conn.Close()
+
+	stored, err := redis.String(do(ctx, conn, "HGET", keysKey, name))
+	if err == redis.ErrNil {
+		// Whichever node makes the first key wins, the others read it back
+		var secret logger.Secret
+		if secret, err = newSecret(); err != nil {
+			return Key{}, err
+		}
+		if _, err = do(ctx, conn, "HSETNX", keysKey, name, "1:"+secret.Reveal()); err != nil {
+			return Key{}, err
+		}
+		stored, err = redis.String(do(ctx, conn, "HGET", keysKey, name))
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	return parseKey(stored)
+}
+
+func (s *Redis) RotateKey(ctx context.Context, name string) (Key, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return Key{}, err
+	}
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Key{}, err
+	}
+	defer conn.Close()
+
+	stored, err := redis.String(rotateScript.DoContext(ctx, conn, keysKey, name, secret.Reveal()))
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues("EVALSHA").Inc()
+		return Key{}, err
+	}
+	return parseKey(stored)
+}
+
+func parseKey(stored string) (Key, error) {
+	version, secret, _ := strings.Cut(stored, ":")
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{Version: v, Secret: logger.Secret(secret)}, nil
+}
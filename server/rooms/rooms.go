@@ -0,0 +1,91 @@
+// Package rooms keeps the rooms made through the API and who belongs to them,
+// and the keys broadcasts to keyed rooms are sealed with. Rooms nobody made
+// stay open to everyone, as every room used to be.
+package rooms
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/logger"
+)
+
+// Longest room name accepted
+const maxNameLength = 64
+
+var (
+	ErrNotFound    = errors.New("rooms: no such room")
+	ErrExists      = errors.New("rooms: room already exists")
+	ErrInvalidName = errors.New("rooms: name must be 1 to 64 letters, digits, '-', '_' or '.'")
+)
+
+type Room struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`   // User who made it, the only one who may invite and remove others
+	Private   bool      `json:"private"` // Only members may join it and read its history
+	Members   []string  `json:"members"` // Sorted, the owner included
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (r Room) Member(user string) bool {
+	_, found := slices.BinarySearch(r.Members, user)
+	return found
+}
+
+// Whether user may join the room and read its history
+func (r Room) Open(user string) bool {
+	return !r.Private || r.Member(user)
+}
+
+type Store interface {
+	// Make a room with its owner as the only member
+	Create(ctx context.Context, r Room) (Room, error)
+
+	Get(ctx context.Context, name string) (Room, error)
+
+	// Every room, by name
+	List(ctx context.Context) ([]Room, error)
+
+	// Adding a member twice or removing one that is not there changes nothing
+	AddMember(ctx context.Context, name, user string) (Room, error)
+	RemoveMember(ctx context.Context, name, user string) (Room, error)
+
+	// Current key of a room, made on first use. Any room has one, made through
+	// the API or not.
+	Key(ctx context.Context, name string) (Key, error)
+
+	// Replace the key of a room with a fresh one of the next version
+	RotateKey(ctx context.Context, name string) (Key, error)
+}
+
+// Key a room's broadcasts are sealed with. It is replaced whenever someone
+// leaves the room, so they cannot read what is sent after.
+type Key struct {
+	Version int64
+	Secret  logger.Secret // Hex encoded
+}
+
+func newSecret() (logger.Secret, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return logger.Secret(hex.EncodeToString(b)), nil
+}
+
+// Names end up in Redis keys and URLs, so only a plain set of characters passes
+func ValidName(name string) bool {
+	if name == "" || len(name) > maxNameLength {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
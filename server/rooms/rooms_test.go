@@ -0,0 +1,100 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	created, err := s.Create(ctx, Room{Name: "ops", Owner: "alice", Private: true, CreatedAt: time.Now()})
+	if err != nil || !created.Member("alice") || len(created.Members) != 1 {
+		t.Fatalf("Room not created: %+v %v", created, err)
+	}
+	if _, err := s.Create(ctx, Room{Name: "ops", Owner: "bob"}); !errors.Is(err, ErrExists) {
+		t.Errorf("Expected a taken name to be refused, got %v", err)
+	}
+	if _, err := s.Create(ctx, Room{Name: "no spaces", Owner: "bob"}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Expected an invalid name to be refused, got %v", err)
+	}
+	s.Create(ctx, Room{Name: "lobby", Owner: "bob"})
+
+	s.AddMember(ctx, "ops", "carol")
+	r, err := s.AddMember(ctx, "ops", "bob")
+	if err != nil || !slices.Equal(r.Members, []string{"alice", "bob", "carol"}) {
+		t.Errorf("Expected sorted members, got %v %v", r.Members, err)
+	}
+	if !r.Private || r.Owner != "alice" || r.CreatedAt.IsZero() {
+		t.Errorf("Room lost its settings: %+v", r)
+	}
+	if r.Open("dave") || !r.Open("bob") {
+		t.Errorf("Expected only members to be let in, got %+v", r)
+	}
+
+	s.RemoveMember(ctx, "ops", "carol")
+	if r, _ := s.Get(ctx, "ops"); r.Member("carol") || len(r.Members) != 2 {
+		t.Errorf("Expected carol to be removed, got %v", r.Members)
+	}
+	if _, err := s.AddMember(ctx, "nowhere", "bob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an unknown room, got %v", err)
+	}
+	if _, err := s.Get(ctx, "nowhere"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an unknown room, got %v", err)
+	}
+
+	rooms, err := s.List(ctx)
+	if err != nil || len(rooms) != 2 || rooms[0].Name != "lobby" || rooms[1].Name != "ops" || len(rooms[1].Members) != 2 {
+		t.Errorf("Unexpected rooms %+v %v", rooms, err)
+	}
+
+	// Any room has a key, made once and kept until rotated
+	first, err := s.Key(ctx, "anywhere")
+	if err != nil || first.Version != 1 || len(first.Secret) != 32 {
+		t.Fatalf("Expected a first key, got %+v %v", first, err)
+	}
+	if again, _ := s.Key(ctx, "anywhere"); again != first {
+		t.Errorf("Expected the same key, got %+v", again)
+	}
+	rotated, err := s.RotateKey(ctx, "anywhere")
+	if err != nil || rotated.Version != 2 || rotated.Secret == first.Secret {
+		t.Errorf("Expected a new key of the next version, got %+v %v", rotated, err)
+	}
+	if current, _ := s.Key(ctx, "anywhere"); current != rotated {
+		t.Errorf("Expected the rotated key, got %+v", current)
+	}
+	if other, _ := s.RotateKey(ctx, "elsewhere"); other.Version != 1 {
+		t.Errorf("Expected rotating a room without a key to make its first, got %+v", other)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) }}
+	testStore(t, NewRedis(pool))
+}
+
+func TestValidName(t *testing.T) {
+	cases := map[string]bool{
+		"general":    true,
+		"team-ops.2": true,
+		"":           false,
+		"a b":        false,
+		"a:b":        false,
+		"ünicode":    false,
+	}
+	for name, want := range cases {
+		if got := ValidName(name); got != want {
+			t.Errorf("%q: expected %v, got %v", name, want, got)
+		}
+	}
+}
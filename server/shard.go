@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+	"github.com/FelineJTD/secure-chat-kripto/server/metrics"
+)
+
+// Unbounded queue of work for a shard, so the hub never waits on one. Pushes
+// fail once the shard has stopped.
+type inbox struct {
+	mu     sync.Mutex
+	queue  []func()
+	closed bool
+	ready  chan struct{}
+}
+
+func newInbox() *inbox {
+	return &inbox{ready: make(chan struct{}, 1)}
+}
+
+func (q *inbox) push(f func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.queue = append(q.queue, f)
+
+	select {
+	case q.ready <- struct{}{}:
+	default: // Already signalled
+	}
+	return true
+}
+
+// Everything queued so far, oldest first
+func (q *inbox) take() []func() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue := q.queue
+	q.queue = nil
+	return queue
+}
+
+// Refuse further pushes, returning what was queued before
+func (q *inbox) close() []func() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	queue := q.queue
+	q.queue = nil
+	return queue
+}
+
+func (q *inbox) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queue)
+}
+
+// Who a shard has per room, replaced whole so readers need no lock
+type membership struct {
+	rooms   map[string]int // Clients per room
+	spilled map[string]int // Spilled addresses per room
+}
+
+// A change to a user's connection counts in a room, reported to the hub for presence.
+type memberDelta struct {
+	key   memberKey
+	conns int
+	away  int
+}
+
+// A partition of the clients, owned by its own goroutine so deliveries to
+// different shards run in parallel. An address always lands on the same shard.
+type shard struct {
+	hub *Hub
+
+	inbox *inbox
+
+	// Registered clients.
+	clients map[*Client]bool
+
+	// Clients disconnected by the spill policy, by address.
+	spilled map[string]spilledClient
+
+	// Kept up to date with clients and spilled, copied into members when published.
+	counts membership
+
+	// Published by the shard after each batch of work, read by anyone.
+	members atomic.Pointer[membership]
+
+	// Set whenever counts change, until members is published again.
+	dirty bool
+
+	// Clients still flushing their queues when run returned.
+	draining []*Client
+
+	// Closed once run has returned.
+	done chan struct{}
+}
+
+func newShard(hub *Hub) *shard {
+	s := &shard{
+		hub:     hub,
+		inbox:   newInbox(),
+		clients: make(map[*Client]bool),
+		spilled: make(map[string]spilledClient),
+		counts:  membership{rooms: map[string]int{}, spilled: map[string]int{}},
+		done:    make(chan struct{}),
+	}
+	s.members.Store(&membership{rooms: map[string]int{}, spilled: map[string]int{}})
+	return s
+}
+
+// Adjust a room's count, dropping it at zero so snapshots only hold rooms in use
+func count(counts map[string]int, room string, delta int) {
+	if counts[room] += delta; counts[room] <= 0 {
+		delete(counts, room)
+	}
+}
+
+func shardIndex(address string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(address))
+	return int(h.Sum32() % uint32(n))
+}
+
+func (s *shard) run(ctx context.Context) {
+	defer close(s.done)
+	for {
+		select {
+		case <-ctx.Done():
+			// Work queued before the shard stopped still runs, registrations included,
+			// so every client it accepted gets the going away
+			for _, f := range s.inbox.close() {
+				f()
+			}
+			s.shutdown()
+			return
+		case <-s.inbox.ready:
+			for _, f := range s.inbox.take() {
+				f()
+			}
+			s.publish()
+		}
+	}
+}
+
+// Run f on the shard goroutine and wait for it, so f may use the shard's state.
+func (s *shard) do(ctx context.Context, f func()) error {
+	finished := make(chan struct{})
+	if !s.inbox.push(func() { defer close(finished); f() }) {
+		return errHubStopped
+	}
+
+	select {
+	case <-finished:
+		return nil
+	case <-s.done:
+		// Ran during shutdown or never will, either way it is over
+		select {
+		case <-finished:
+			return nil
+		default:
+			return errHubStopped
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Replace the membership snapshot if anything changed since the last one
+func (s *shard) publish() {
+	if !s.dirty {
+		return
+	}
+	s.dirty = false
+
+	s.members.Store(&membership{rooms: maps.Clone(s.counts.rooms), spilled: maps.Clone(s.counts.spilled)})
+}
+
+// Publish at once when the shard gains a room, so nothing sent after a client
+// joined skips it. Leaving can wait for the end of the batch.
+func (s *shard) gained(room string) {
+	m := s.members.Load()
+	if m.rooms[room] == 0 && m.spilled[room] == 0 {
+		s.publish()
+	}
+}
+
+// Anything in the room for this shard, checked before handing it a message
+func (s *shard) wants(room string) bool {
+	m := s.members.Load()
+	return m.rooms[room] > 0 || m.spilled[room] > 0
+}
+
+// Report a presence change to the hub. Only blocks until the hub takes it.
+func (s *shard) track(key memberKey, conns, away int) {
+	select {
+	case s.hub.members <- memberDelta{key: key, conns: conns, away: away}:
+	case <-s.hub.done:
+	}
+}
+
+func (s *shard) add(client *Client) {
+	metrics.ConnectedClients.Inc()
+	s.clients[client] = true
+	count(s.counts.rooms, client.room, 1)
+	s.dirty = true
+	s.gained(client.room)
+	s.track(client.member(), 1, 0)
+
+	// Before anything sealed with it
+	if s.hub.policies.get(client.room).SharedKey {
+		if key := s.hub.roomKeys.get(client.room); key != nil {
+			s.deliver(client, outbound{data: roomKeyFrame(key.key)})
+		}
+	}
+
+	if s.hub.cfg.Backpressure.Policy == config.PolicySpill {
+		s.resume(client.address)
+		s.hub.resume(client.address)
+		go s.hub.redeliver(client)
+	}
+}
+
+func (s *shard) remove(client *Client) {
+	if _, ok := s.clients[client]; !ok {
+		return
+	}
+	metrics.ConnectedClients.Dec()
+	delete(s.clients, client)
+	count(s.counts.rooms, client.room, -1)
+	s.dirty = true
+	close(client.send)
+	if client.away {
+		s.track(client.member(), -1, -1)
+	} else {
+		s.track(client.member(), -1, 0)
+	}
+
+	// What is sent after they left must not open with the key they hold
+	if s.hub.policies.get(client.room).SharedKey {
+		go s.hub.rotateKey(context.Background(), client.room)
+	}
+}
+
+// Hand a room's new key to its members here
+func (s *shard) rekey(room string, frame []byte) {
+	for client := range s.clients {
+		if client.room == room {
+			s.deliver(client, outbound{data: frame})
+		}
+	}
+}
+
+func (s *shard) setAway(client *Client, away bool) {
+	if _, ok := s.clients[client]; !ok || client.away == away {
+		return
+	}
+	client.away = away
+	if away {
+		s.track(client.member(), 0, 1)
+	} else {
+		s.track(client.member(), 0, -1)
+	}
+}
+
+func (s *shard) broadcast(message roomMessage) {
+	// Before delivering, a client spilled by this message already has it queued
+	if !message.transient {
+		for address, sc := range s.spilled {
+			if sc.room == message.room {
+				s.hub.spill(address, message.data)
+			}
+		}
+	}
+	for client := range s.clients {
+		if client.room == message.room {
+			s.deliver(client, outbound{data: message.data, sealed: message.sealed})
+		}
+	}
+}
+
+func (s *shard) direct(message directMessage) {
+	if message.client != nil {
+		if _, ok := s.clients[message.client]; ok {
+			s.deliver(message.client, outbound{data: message.data})
+		}
+		return
+	}
+
+	if _, ok := s.spilled[message.address]; ok {
+		s.hub.spill(message.address, message.data)
+	}
+	for client := range s.clients {
+		if client.address == message.address {
+			s.deliver(client, outbound{data: message.data})
+		}
+	}
+}
+
+// Queue a message for a client, applying the backpressure policy if its buffer is full.
+// Only the shard sends on client.send, so room made here cannot be taken.
+func (s *shard) deliver(client *Client, message outbound) {
+	// Caught up enough to be told what it missed, with room left for message
+	if client.dropped > 0 && len(client.send) < cap(client.send)-1 {
+		client.send <- outbound{data: gapFrame(client.dropped)}
+		client.dropped = 0
+	}
+
+	select {
+	case client.send <- message:
+		client.fullSince = time.Time{}
+		return
+	default:
+	}
+
+	switch s.hub.cfg.Backpressure.Policy {
+	case config.PolicyDropOldest:
+		select {
+		case <-client.send:
+		default: // writePump took it in the meantime
+		}
+		client.send <- message
+		client.dropped++
+		metrics.DroppedMessages.Inc()
+	case config.PolicySpill:
+		if _, ok := s.spilled[client.address]; !ok {
+			count(s.counts.spilled, client.room, 1)
+		}
+		s.spilled[client.address] = spilledClient{room: client.room, since: time.Now()}
+		s.hub.spill(client.address, message.data)
+		s.drop(client, "too slow, reconnect to catch up")
+		s.gained(client.room)
+	default:
+		now := time.Now()
+		if client.fullSince.IsZero() {
+			client.fullSince = now
+		}
+		if now.Sub(client.fullSince) < s.hub.cfg.Backpressure.Grace {
+			client.dropped++
+			metrics.DroppedMessages.Inc()
+			return
+		}
+		s.drop(client, "too slow")
+	}
+}
+
+// Disconnect a slow client, telling it to try again later.
+func (s *shard) drop(client *Client, reason string) {
+	hubLog.Info("dropping slow client", "address", client.address, "policy", s.hub.cfg.Backpressure.Policy)
+	metrics.DroppedClients.Inc()
+	client.closeMessage = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason)
+	s.remove(client)
+}
+
+// Close every connection of an address.
+func (s *shard) disconnect(address string) int {
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "disconnected by an administrator")
+	n := 0
+	for client := range s.clients {
+		if client.address == address {
+			client.closeMessage = closeMessage
+			s.remove(client)
+			n++
+		}
+	}
+	if n > 0 {
+		hubLog.Info("disconnected", "address", address, "connections", n)
+	}
+	return n
+}
+
+// Close a user's connections to a room, they were removed from it
+func (s *shard) evict(room, user string) {
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "removed from the room")
+	for client := range s.clients {
+		if client.room == room && client.user == user {
+			client.closeMessage = closeMessage
+			s.remove(client)
+			hubLog.Info("evicted", "address", client.address, "room", room)
+		}
+	}
+}
+
+// Stop spilling for an address
+func (s *shard) resume(address string) {
+	if sc, ok := s.spilled[address]; ok {
+		delete(s.spilled, address)
+		count(s.counts.spilled, sc.room, -1)
+		s.dirty = true
+	}
+}
+
+// Stop spilling for addresses that have been away longer than the offline queue keeps messages
+func (s *shard) expireSpilled(now time.Time) {
+	for address, sc := range s.spilled {
+		if now.Sub(sc.since) > s.hub.cfg.Offline.TTL {
+			s.resume(address)
+		}
+	}
+}
+
+// Tell every client the server is going away. Closing send lets each writePump
+// flush what is already queued before it writes the close frame.
+func (s *shard) shutdown() {
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for client := range s.clients {
+		metrics.ConnectedClients.Dec()
+		client.closeMessage = closeMessage
+		close(client.send)
+		delete(s.clients, client)
+		s.draining = append(s.draining, client)
+	}
+	clear(s.counts.rooms)
+	s.dirty = true
+	s.publish()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/FelineJTD/secure-chat-kripto/server/bus"
+	"github.com/FelineJTD/secure-chat-kripto/server/config"
+)
+
+func TestShardsSpreadClients(t *testing.T) {
+	cfg := config.Default()
+	cfg.Hub.Shards = 4
+	hub := newTestHub(cfg, bus.NewMemory())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.run(ctx)
+
+	var clients []*Client
+	for i := 0; i < 64; i++ {
+		client := newSlowClient(hub, fmt.Sprint("client", i), 4)
+		if !hub.join(client) {
+			t.Fatal("Hub refused the client")
+		}
+		clients = append(clients, client)
+	}
+
+	used := 0
+	for _, s := range hub.shards {
+		if s.wants(defaultRoom) {
+			used++
+		}
+	}
+	if used != len(hub.shards) {
+		t.Errorf("Expected clients on all %d shards, got %d", len(hub.shards), used)
+	}
+
+	hub.broadcast <- roomMessage{room: defaultRoom, data: []byte("everyone")}
+	for _, client := range clients {
+		select {
+		case m := <-client.send:
+			if string(m.data) != "everyone" {
+				t.Fatalf("Unexpected message %q", m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s never got the broadcast", client.address)
+		}
+	}
+
+	if stats := hub.stats(); stats.Clients != len(clients) || stats.Rooms[defaultRoom] != len(clients) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Another connection of the same address lands on the same shard
+	again := newSlowClient(hub, clients[0].address, 4)
+	hub.join(again)
+	if again.shard != clients[0].shard {
+		t.Error("Connections of one address were split across shards")
+	}
+}
+
+// Wait until everything broadcast so far has reached the clients' buffers
+func settle(hub *Hub) {
+	for len(hub.broadcast) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	hub.do(context.Background(), func() {})
+	for _, s := range hub.shards {
+		s.do(context.Background(), func() {})
+	}
+}
+
+// Fan out to every client in one room. One shard is the single goroutine
+// design, more let the deliveries run on every CPU, try it with -cpu.
+func BenchmarkHubBroadcast(b *testing.B) {
+	for _, clients := range []int{10_000, 100_000} {
+		for _, shards := range []int{1, 8} {
+			b.Run(fmt.Sprintf("clients=%d/shards=%d", clients, shards), func(b *testing.B) {
+				cfg := config.Default()
+				cfg.Hub.Shards = shards
+				cfg.Backpressure.Policy = config.PolicyDropOldest // Buffers stay full without readers
+				hub := newTestHub(cfg, bus.NewMemory())
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go hub.run(ctx)
+
+				for i := 0; i < clients; i++ {
+					hub.join(newSlowClient(hub, fmt.Sprint("client", i), 8))
+				}
+				message := []byte("hello everyone")
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					hub.broadcast <- roomMessage{room: defaultRoom, data: message}
+				}
+				settle(hub)
+				b.StopTimer()
+
+				b.ReportMetric(float64(b.N)*float64(clients)/b.Elapsed().Seconds(), "deliveries/s")
+			})
+		}
+	}
+}